@@ -0,0 +1,407 @@
+/* The agent runs the plugins of a worker machine for remote hosts. It owns a
+ * local plugin registry that discovers, launches and supervises the plugins,
+ * and serves a control API and the plugin calls over tcp with mutual TLS.
+ * The calls are served with the plugin protocol so that a host uses an agent
+ * plugin like a local one
+ */
+
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The url prefix of the agent control API
+	agentControlPath = "/agent/"
+	// The url prefix of the plugin calls, followed by the plugin id
+	agentPluginPath = "/plugins/"
+)
+
+/* The configuration of an agent */
+type AgentServerConf struct {
+	// The registry conf of the local plugins
+	Registry PluginRegConf
+	// The tcp address the agent listens on
+	Listen string
+	// The TLS files of the agent, the hosts must present a certificate signed by the CA
+	Tls *common.TlsConf
+	// The secret the hosts must send (not checked if empty)
+	Secret string
+}
+
+/* An agent serving the plugins of its local registry */
+type Agent struct {
+	// The local registry
+	Registry *PluginReg
+	server   *PluginConn.PluginServer
+	// The callback notifications waiting for the hosts by plugin id and callback name
+	callbacks map[string]*agentCallback
+	access    sync.Mutex
+}
+
+// The notifications of a callback registered by a host
+type agentCallback struct {
+	key           string
+	notifications chan []byte
+	done          chan struct{}
+}
+
+/* Start an agent. It initializes the local registry and serves the hosts on the listen address */
+func StartAgent(conf AgentServerConf) (*Agent, error) {
+	if conf.Tls == nil {
+		return nil, fmt.Errorf("The agent requires a TLS conf")
+	}
+	tlsConfig, err := PluginConn.ServerTlsConfig(conf.Tls.CA, conf.Tls.Cert, conf.Tls.Key)
+	if err != nil {
+		return nil, err
+	}
+	// The registry is owned by the agent, the registry of the process (if any) is left as it is
+	registry, err := newPluginReg(conf.Registry)
+	if err != nil {
+		return nil, err
+	}
+
+	agent := &Agent{Registry: registry, callbacks: make(map[string]*agentCallback)}
+	// The agent serves on its own handler so that several agents could run in a process
+	config := &PluginConn.ServerConfiguration{Handler: agent, SockFile: conf.Listen, Addr: conf.Listen}
+	config.Network = common.TransportTcp
+	config.Tls = tlsConfig
+	config.Secret = conf.Secret
+	server, err := PluginConn.NewPluginServer(config)
+	if err != nil {
+		registry.Stop(context.Background())
+		return nil, err
+	}
+	agent.server = server
+	server.Start()
+	log.INFO.Printf("Agent serving %s on %s", conf.Registry.PluginLocation, agent.Addr())
+
+	return agent, nil
+}
+
+/* Get the address the agent listens on */
+func (agent *Agent) Addr() string {
+	return agent.server.Listener.Addr().String()
+}
+
+/* Stop serving the hosts and stop the local plugins */
+func (agent *Agent) Stop(ctx context.Context) error {
+	agent.server.Shutdown()
+
+	agent.access.Lock()
+	for id, callback := range agent.callbacks {
+		close(callback.done)
+		delete(agent.callbacks, id)
+	}
+	agent.access.Unlock()
+
+	return agent.Registry.Stop(ctx)
+}
+
+/* Internal Method: Serve the control API and the plugin calls. Should not be called explicitly */
+func (agent *Agent) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	switch {
+	case strings.HasPrefix(path, agentControlPath):
+		agent.serveControl(res, strings.TrimPrefix(path, agentControlPath))
+	case strings.HasPrefix(path, agentPluginPath):
+		parts := strings.SplitN(strings.TrimPrefix(path, agentPluginPath), "/", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			res.WriteHeader(400)
+			return
+		}
+		agent.servePlugin(res, req, parts[0], parts[1])
+	default:
+		res.WriteHeader(404)
+	}
+}
+
+// Internal: get a loaded plugin by id
+func (pluginReg *PluginReg) pluginByKey(key string) *Plugin {
+	pluginReg.regAccess.Lock()
+	defer pluginReg.regAccess.Unlock()
+
+	return pluginReg.plugins[key]
+}
+
+// Internal: serve a control request (plugins, load/<id>, unload/<id>, reload/<id>)
+func (agent *Agent) serveControl(res http.ResponseWriter, action string) {
+	parts := strings.SplitN(action, "/", 2)
+	if parts[0] == "plugins" {
+		PluginConn.WriteJsonResponse(agent.plugins(), 200, res)
+		return
+	}
+	if len(parts) != 2 || parts[1] == "" || filepath.Base(parts[1]) != parts[1] || strings.HasPrefix(parts[1], ".") {
+		http.Error(res, "Invalid plugin id", 400)
+		return
+	}
+
+	key := parts[1]
+	registry := agent.Registry
+	var err error
+	switch parts[0] {
+	case "load":
+		if registry.pluginByKey(key) != nil {
+			break
+		}
+		pluginLoc := filepath.Join(registry.discoveredPluginLoc, key)
+		if _, statErr := os.Stat(pluginLoc); statErr != nil {
+			http.Error(res, fmt.Sprintf("Plugin %s is not discovered", key), 404)
+			return
+		}
+		_, err = registry.LoadPluginInstance(pluginLoc)
+	case "unload", "reload":
+		plugin := registry.pluginByKey(key)
+		if plugin == nil {
+			http.Error(res, fmt.Sprintf("Plugin %s is not loaded", key), 404)
+			return
+		}
+		if parts[0] == "reload" {
+			err = plugin.ReloadPlugin()
+			break
+		}
+		agent.dropCallbacks(key)
+		err = plugin.UnloadPlugin()
+	default:
+		res.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.ERROR.Printf("Agent failed to %s plugin %s: %v", parts[0], key, err)
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	PluginConn.WriteJsonResponse(agent.pluginInfo(key), 200, res)
+}
+
+// Internal: get the discovered plugins of the agent
+func (agent *Agent) plugins() []AgentPluginInfo {
+	plugins := make([]AgentPluginInfo, 0)
+	folders, err := ioutil.ReadDir(agent.Registry.discoveredPluginLoc)
+	if err != nil {
+		log.ERROR.Printf("Failed to read discovered plugin location: %v", err)
+		return plugins
+	}
+	for _, folder := range folders {
+		if folder.IsDir() {
+			plugins = append(plugins, agent.pluginInfo(folder.Name()))
+		}
+	}
+	return plugins
+}
+
+// Internal: get the information of a plugin
+func (agent *Agent) pluginInfo(key string) AgentPluginInfo {
+	info := AgentPluginInfo{Key: key}
+	plugin := agent.Registry.pluginByKey(key)
+	if plugin != nil {
+		info.Loaded = true
+		info.Methods = plugin.GetMethods()
+	}
+	return info
+}
+
+// Internal: serve a request of the plugin protocol on a local plugin
+func (agent *Agent) servePlugin(res http.ResponseWriter, req *http.Request, key string, name string) {
+	plugin := agent.Registry.pluginByKey(key)
+	if plugin == nil {
+		http.Error(res, fmt.Sprintf("Plugin %s is not loaded", key), 404)
+		return
+	}
+
+	switch name {
+	case "Activate":
+		// The plugin is activated by the agent, only the codec to the host is negotiated
+		codec := common.NegotiateCodec(req.Header.Get(common.CodecsHeader))
+		res.Header().Set(common.CodecHeader, codec.Name())
+		PluginConn.WriteJsonResponse(plugin.GetMethods(), 200, res)
+	case "Stop", common.ControlLive:
+		// The plugin is stopped by the unload control request
+		res.WriteHeader(200)
+	case common.ControlReady:
+		PluginConn.WriteJsonResponse(map[string]interface{}{"ready": plugin.Health().Ready}, 200, res)
+	case "Ping":
+		err := plugin.Ping()
+		if err != nil {
+			http.Error(res, err.Error(), 500)
+			return
+		}
+		defer req.Body.Close()
+		input, _ := ioutil.ReadAll(req.Body)
+		res.WriteHeader(200)
+		res.Write(input)
+	case common.ControlDescribe:
+		descriptors, err := plugin.DescribeMethods()
+		if err != nil {
+			http.Error(res, err.Error(), 404)
+			return
+		}
+		PluginConn.WriteJsonResponse(descriptors, 200, res)
+	case "RegisterCallback":
+		agent.serveCallback(res, req, plugin)
+	default:
+		agent.serveCall(res, req, plugin, name)
+	}
+}
+
+// Internal: get the context of a call, it is cancelled at the deadline sent by the host
+func agentContext(req *http.Request) (context.Context, context.CancelFunc) {
+	header := req.Header.Get(PluginConn.DeadlineHeader)
+	if header != "" {
+		deadline, err := time.Parse(time.RFC3339Nano, header)
+		if err == nil {
+			return context.WithDeadline(req.Context(), deadline)
+		}
+	}
+	return context.WithCancel(req.Context())
+}
+
+// Internal: execute a method of a local plugin for a host
+func (agent *Agent) serveCall(res http.ResponseWriter, req *http.Request, plugin *Plugin, name string) {
+	defer req.Body.Close()
+	input, readErr := ioutil.ReadAll(req.Body)
+	if readErr != nil {
+		http.Error(res, readErr.Error(), 400)
+		return
+	}
+	codec := common.CodecByContentType(req.Header.Get("Content-Type"))
+	args, decodeErr := codec.Decode(input)
+	if decodeErr != nil {
+		PluginConn.WriteErrorResponse(common.NewErrorEnvelope(common.ErrorBadArguments, "%v", decodeErr), res)
+		return
+	}
+
+	ctx, cancel := agentContext(req)
+	defer cancel()
+
+	if req.Header.Get("Accept") == PluginConn.StreamContentType {
+		agent.serveStream(ctx, res, plugin, name, args)
+		return
+	}
+
+	// The error of the local plugin is sent on as it is
+	err, results := plugin.ExecuteContext(ctx, name, args...)
+	if err != nil {
+		writeCallError(res, err)
+		return
+	}
+	data, encodeErr := codec.Encode(results)
+	if encodeErr != nil {
+		writeCallError(res, encodeErr)
+		return
+	}
+	res.Header().Set("Content-Type", codec.ContentType())
+	res.WriteHeader(200)
+	res.Write(data)
+}
+
+// Internal: forward the items of a streaming method of a local plugin to a host
+func (agent *Agent) serveStream(ctx context.Context, res http.ResponseWriter, plugin *Plugin, name string, args []interface{}) {
+	items, err := plugin.ExecuteStream(ctx, name, args...)
+	if err != nil {
+		writeCallError(res, err)
+		return
+	}
+
+	flusher, _ := res.(http.Flusher)
+	res.Header().Set("Content-Type", PluginConn.StreamContentType)
+	res.WriteHeader(200)
+
+	encoder := json.NewEncoder(res)
+	for item := range items {
+		frame := PluginConn.StreamFrame{Item: item.Data}
+		if item.Err != nil {
+			envelope := errorEnvelope(item.Err)
+			frame = PluginConn.StreamFrame{Error: envelope.Message, Fault: envelope}
+		}
+		if encoder.Encode(frame) != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if item.Err != nil {
+			return
+		}
+	}
+	if ctx.Err() == nil {
+		encoder.Encode(PluginConn.StreamFrame{End: true})
+	}
+}
+
+// Internal: wait for the next notification of a callback registered by a host
+func (agent *Agent) serveCallback(res http.ResponseWriter, req *http.Request, plugin *Plugin) {
+	defer req.Body.Close()
+	input, _ := ioutil.ReadAll(req.Body)
+	var funcName string
+	unmarshalError := json.Unmarshal(input, &funcName)
+	if unmarshalError != nil || funcName == "" {
+		http.Error(res, "Invalid callback name", 400)
+		return
+	}
+
+	callback, err := agent.callback(plugin, funcName)
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	select {
+	case data := <-callback.notifications:
+		res.WriteHeader(200)
+		res.Write(data)
+	case <-callback.done:
+		http.Error(res, "Plugin is unloaded", 404)
+	case <-req.Context().Done():
+	}
+}
+
+// Internal: get the notifications of a callback, the callback is registered on the plugin on first use
+func (agent *Agent) callback(plugin *Plugin, funcName string) (*agentCallback, error) {
+	agent.access.Lock()
+	defer agent.access.Unlock()
+
+	id := plugin.key + "/" + funcName
+	callback, ok := agent.callbacks[id]
+	if ok {
+		return callback, nil
+	}
+	callback = &agentCallback{key: plugin.key, notifications: make(chan []byte), done: make(chan struct{})}
+	// The plugin waits till the host polls the notification
+	err := plugin.registerNamedCallback(funcName, func(data []byte) {
+		select {
+		case callback.notifications <- data:
+		case <-callback.done:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	agent.callbacks[id] = callback
+	return callback, nil
+}
+
+// Internal: release the callbacks of an unloaded plugin
+func (agent *Agent) dropCallbacks(key string) {
+	agent.access.Lock()
+	defer agent.access.Unlock()
+
+	for id, callback := range agent.callbacks {
+		if callback.key == key {
+			close(callback.done)
+			delete(agent.callbacks, id)
+		}
+	}
+}
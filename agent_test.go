@@ -0,0 +1,230 @@
+package pluginmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Internal: serve an agent over mutual TLS on a loopback port, it returns the conf a host reaches it with
+func serveAgent(t *testing.T, agent *Agent, secret string) *AgentConf {
+	certDir := t.TempDir()
+	err := PluginConn.GenerateCerts(certDir, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Failed to generate the certificates: %v", err)
+	}
+	tlsConfig, err := PluginConn.ServerTlsConfig(filepath.Join(certDir, PluginConn.CACertFile),
+		filepath.Join(certDir, PluginConn.PluginCertFile), filepath.Join(certDir, PluginConn.PluginKeyFile))
+	if err != nil {
+		t.Fatalf("Failed to load the agent TLS config: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go http.Serve(listener, PluginConn.AuthHandler(agent, secret))
+
+	return &AgentConf{
+		Name:   "test",
+		Addr:   listener.Addr().String(),
+		Secret: secret,
+		Tls: &common.TlsConf{
+			CA:   filepath.Join(certDir, PluginConn.CACertFile),
+			Cert: filepath.Join(certDir, PluginConn.HostCertFile),
+			Key:  filepath.Join(certDir, PluginConn.HostKeyFile),
+		},
+	}
+}
+
+// Internal: get an agent with a registry that discovered the given plugins, none is loaded
+func testAgent(t *testing.T, keys ...string) *Agent {
+	pluginLoc := t.TempDir()
+	for _, key := range keys {
+		err := os.Mkdir(filepath.Join(pluginLoc, key), 0700)
+		if err != nil {
+			t.Fatalf("Failed to create the plugin folder: %v", err)
+		}
+	}
+	registry := &PluginReg{
+		discoveredPluginLoc: pluginLoc,
+		regAccess:           &sync.Mutex{},
+		plugins:             make(map[string]*Plugin),
+	}
+	return &Agent{Registry: registry, callbacks: make(map[string]*agentCallback)}
+}
+
+func TestAgentControl(t *testing.T) {
+	agent := testAgent(t, "ns_calc_1", "ns_echo_1")
+	conf := serveAgent(t, agent, "secret")
+	conn, _, err := conf.connect()
+	if err != nil {
+		t.Fatalf("Failed to connect to the agent: %v", err)
+	}
+	defer conn.Close()
+
+	plugins := make([]AgentPluginInfo, 0)
+	err = agentControl(conn, "plugins", "", &plugins)
+	if err != nil {
+		t.Fatalf("Failed to list the plugins: %v", err)
+	}
+	expected := []AgentPluginInfo{{Key: "ns_calc_1"}, {Key: "ns_echo_1"}}
+	if !reflect.DeepEqual(plugins, expected) {
+		t.Errorf("Listed %v, expected %v", plugins, expected)
+	}
+
+	// A plugin loaded by the agent registry is reported with its methods
+	agent.Registry.plugins["ns_calc_1"] = &Plugin{key: "ns_calc_1", methods: []string{"Add"}}
+	info := AgentPluginInfo{}
+	err = agentControl(conn, "load", "ns_calc_1", &info)
+	if err != nil {
+		t.Fatalf("Failed to load the plugin: %v", err)
+	}
+	if !info.Loaded || !reflect.DeepEqual(info.Methods, []string{"Add"}) {
+		t.Errorf("Loaded plugin reported as %v", info)
+	}
+
+	failures := []struct {
+		name   string
+		action string
+		key    string
+		status string
+	}{
+		{"not discovered", "load", "ns_missing_1", "404"},
+		{"hidden id", "load", ".ns_calc_1", "400"},
+		{"missing id", "load", "", "400"},
+		{"unload not loaded", "unload", "ns_echo_1", "404"},
+		{"reload not loaded", "reload", "ns_echo_1", "404"},
+		{"unknown action", "restart", "ns_calc_1", "404"},
+	}
+	for _, test := range failures {
+		err = agentControl(conn, test.action, test.key, nil)
+		if err == nil || !strings.Contains(err.Error(), "Status: "+test.status) {
+			t.Errorf("%s: got error %v, expected status %s", test.name, err, test.status)
+		}
+	}
+}
+
+func TestAgentPluginProtocol(t *testing.T) {
+	agent := testAgent(t, "ns_calc_1")
+	agent.Registry.plugins["ns_calc_1"] = &Plugin{key: "ns_calc_1", methods: []string{"Add"}}
+	conf := serveAgent(t, agent, "")
+	conn, _, err := conf.connect()
+	if err != nil {
+		t.Fatalf("Failed to connect to the agent: %v", err)
+	}
+	defer conn.Close()
+
+	pluginUrl := PluginUrl + agentPluginPath + "ns_calc_1/"
+	request := &PluginConn.PluginRequest{Url: pluginUrl + "Activate", Header: http.Header{}}
+	request.Header.Set(common.CodecsHeader, "msgpack,json")
+	resp, err := conn.Request(request)
+	if err != nil || resp.Status != "200 OK" {
+		t.Fatalf("Activate failed: %v %v", err, resp)
+	}
+	if codec := resp.Header.Get(common.CodecHeader); codec != "msgpack" {
+		t.Errorf("Negotiated codec %q", codec)
+	}
+	methods := make([]string, 0)
+	json.Unmarshal(resp.Body, &methods)
+	if !reflect.DeepEqual(methods, []string{"Add"}) {
+		t.Errorf("Activated methods %v", methods)
+	}
+
+	resp, err = conn.Request(&PluginConn.PluginRequest{Url: pluginUrl + common.ControlLive})
+	if err != nil || resp.Status != "200 OK" {
+		t.Errorf("Live check failed: %v %v", err, resp)
+	}
+	resp, err = conn.Request(&PluginConn.PluginRequest{Url: pluginUrl + common.ControlReady})
+	if err != nil || resp.Status != "200 OK" {
+		t.Fatalf("Ready check failed: %v %v", err, resp)
+	}
+	report := healthReport{Ready: true}
+	json.Unmarshal(resp.Body, &report)
+	if report.Ready {
+		t.Errorf("A plugin without health state reported ready")
+	}
+
+	for _, path := range []string{agentPluginPath + "ns_missing_1/Add", agentPluginPath + "ns_calc_1/", "/other"} {
+		resp, err = conn.Request(&PluginConn.PluginRequest{Url: PluginUrl + path})
+		if err != nil || resp.Status == "200 OK" {
+			t.Errorf("Request to %s: got %v %v", path, err, resp)
+		}
+	}
+}
+
+func TestAgentSecret(t *testing.T) {
+	agent := testAgent(t)
+	conf := serveAgent(t, agent, "secret")
+	conf.Secret = "wrong"
+	conn, _, err := conf.connect()
+	if err != nil {
+		t.Fatalf("Failed to connect to the agent: %v", err)
+	}
+	defer conn.Close()
+
+	err = agentControl(conn, "plugins", "", nil)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Request with a wrong secret got %v", err)
+	}
+}
+
+func TestStartAgentTwice(t *testing.T) {
+	certDir := t.TempDir()
+	err := PluginConn.GenerateCerts(certDir, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Failed to generate the certificates: %v", err)
+	}
+	agentTls := &common.TlsConf{
+		CA:   filepath.Join(certDir, PluginConn.CACertFile),
+		Cert: filepath.Join(certDir, PluginConn.PluginCertFile),
+		Key:  filepath.Join(certDir, PluginConn.PluginKeyFile),
+	}
+	global := pluginReg
+
+	// Each agent serves its own registry in the same process
+	for _, key := range []string{"ns_calc_1", "ns_echo_1"} {
+		pluginLocation := t.TempDir()
+		err = os.MkdirAll(filepath.Join(pluginLocation, DefaultDiscoveredPlugin, key), 0700)
+		if err != nil {
+			t.Fatalf("Failed to create the plugin folder: %v", err)
+		}
+		agent, err := StartAgent(AgentServerConf{
+			Registry: PluginRegConf{PluginLocation: pluginLocation},
+			Listen:   "127.0.0.1:0",
+			Tls:      agentTls,
+		})
+		if err != nil {
+			t.Fatalf("Failed to start the agent for %s: %v", key, err)
+		}
+		defer agent.Stop(context.Background())
+		if pluginReg != global {
+			t.Errorf("The agent replaced the registry of the process")
+		}
+
+		conf := &AgentConf{Name: key, Addr: agent.Addr(), Tls: &common.TlsConf{
+			CA:   agentTls.CA,
+			Cert: filepath.Join(certDir, PluginConn.HostCertFile),
+			Key:  filepath.Join(certDir, PluginConn.HostKeyFile),
+		}}
+		conn, _, err := conf.connect()
+		if err != nil {
+			t.Fatalf("Failed to connect to the agent: %v", err)
+		}
+		defer conn.Close()
+		plugins := make([]AgentPluginInfo, 0)
+		err = agentControl(conn, "plugins", "", &plugins)
+		if err != nil || !reflect.DeepEqual(plugins, []AgentPluginInfo{{Key: key}}) {
+			t.Errorf("Agent for %s listed %v, %v", key, plugins, err)
+		}
+	}
+}
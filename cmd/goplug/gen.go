@@ -0,0 +1,382 @@
+/* goplug gen generates the typed code of a plugin interface.
+ *
+ *   goplug gen -type Store [-client store_client.go] [-server store_server.go] store.go
+ *
+ * The interface methods must return an error as the last result. The client
+ * implements the interface on the host by calling a *GoPlug.Plugin, the server
+ * adapter registers an implementation of the interface with pluginlib and
+ * describes its methods. Both are written in the package of the interface
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The header of the generated files
+	genHeader = "// Code generated by goplug gen. DO NOT EDIT.\n\n"
+	// The import paths of the host and the plugin libraries
+	hostImport   = "github.com/swarvanusg/GoPlug"
+	pluginImport = "github.com/swarvanusg/GoPlug/pluginlib"
+)
+
+// A method of the interface
+type genMethod struct {
+	name string
+	doc  string
+	// The parameter names given in the interface
+	paramNames []string
+	// The parameter types, the context is not included
+	params   []string
+	variadic bool
+	// The result types, the trailing error is not included
+	results    []string
+	hasContext bool
+}
+
+// The interface to generate the code of
+type genInterface struct {
+	name    string
+	pkg     string
+	methods []*genMethod
+	// The imports of the source file by name
+	imports map[string]string
+	// The import names used by the method types
+	used map[string]bool
+}
+
+func runGen(args []string) error {
+	flags := flag.NewFlagSet("gen", flag.ExitOnError)
+	typeName := flags.String("type", "", "The interface to generate the code of")
+	client := flags.String("client", "", "The host client file, <type>_client.go by default (- to skip)")
+	server := flags.String("server", "", "The plugin server file, <type>_server.go by default (- to skip)")
+	flags.Parse(args)
+
+	if *typeName == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("-type and the source file are required")
+	}
+	source := flags.Arg(0)
+	iface, err := parseInterface(source, *typeName)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(source)
+	outputs := []struct {
+		file     string
+		fallback string
+		generate func(*genInterface) []byte
+	}{
+		{*client, strings.ToLower(*typeName) + "_client.go", generateClient},
+		{*server, strings.ToLower(*typeName) + "_server.go", generateServer},
+	}
+	for _, output := range outputs {
+		if output.file == "-" {
+			continue
+		}
+		file := output.file
+		if file == "" {
+			file = filepath.Join(dir, output.fallback)
+		}
+		code, err := format.Source(output.generate(iface))
+		if err != nil {
+			return fmt.Errorf("Failed to format the generated code: %v", err)
+		}
+		err = ioutil.WriteFile(file, code, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write %s: %v", file, err)
+		}
+		fmt.Printf("Generated %s\n", file)
+	}
+	return nil
+}
+
+// Internal: parse the interface of a source file
+func parseInterface(source string, typeName string) (*genInterface, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, source, nil, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", source, err)
+	}
+
+	iface := &genInterface{name: typeName, pkg: file.Name.Name, imports: make(map[string]string), used: make(map[string]bool)}
+	for _, spec := range file.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		name := filepath.Base(path)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		iface.imports[name] = path
+	}
+
+	var ifaceType *ast.InterfaceType
+	ast.Inspect(file, func(node ast.Node) bool {
+		spec, ok := node.(*ast.TypeSpec)
+		if ok && spec.Name.Name == typeName {
+			ifaceType, _ = spec.Type.(*ast.InterfaceType)
+		}
+		return ifaceType == nil
+	})
+	if ifaceType == nil {
+		return nil, fmt.Errorf("Interface %s is not found in %s", typeName, source)
+	}
+
+	for _, field := range ifaceType.Methods.List {
+		funcType, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) == 0 {
+			return nil, fmt.Errorf("Embedded interfaces are not supported in %s", typeName)
+		}
+		method, err := iface.parseMethod(fset, field.Names[0].Name, funcType)
+		if err != nil {
+			return nil, err
+		}
+		if field.Doc != nil {
+			method.doc = strings.TrimSpace(field.Doc.Text())
+		}
+		iface.methods = append(iface.methods, method)
+	}
+	return iface, nil
+}
+
+// Internal: parse a method of the interface
+func (iface *genInterface) parseMethod(fset *token.FileSet, name string, funcType *ast.FuncType) (*genMethod, error) {
+	switch name {
+	case "Init", "Start", "Stop":
+		return nil, fmt.Errorf("Method %s.%s is reserved for the plugin lifecycle", iface.name, name)
+	}
+	method := &genMethod{name: name}
+
+	for i, field := range fieldList(funcType.Params) {
+		typeExpr := field.Type
+		if ellipsis, ok := typeExpr.(*ast.Ellipsis); ok {
+			method.variadic = true
+			typeExpr = ellipsis.Elt
+		}
+		typeText := iface.typeText(fset, typeExpr)
+		if i == 0 && typeText == iface.contextName()+".Context" {
+			method.hasContext = true
+			continue
+		}
+		method.params = append(method.params, typeText)
+		method.paramNames = append(method.paramNames, field.name)
+	}
+
+	results := fieldList(funcType.Results)
+	if len(results) == 0 || iface.typeText(fset, results[len(results)-1].Type) != "error" {
+		return nil, fmt.Errorf("Method %s.%s must return an error as the last result", iface.name, name)
+	}
+	for _, field := range results[:len(results)-1] {
+		if _, ok := field.Type.(*ast.ChanType); ok {
+			return nil, fmt.Errorf("Method %s.%s streams its results, streaming methods are called with ExecuteStream", iface.name, name)
+		}
+		method.results = append(method.results, iface.typeText(fset, field.Type))
+	}
+	return method, nil
+}
+
+// A parameter or a result, the fields with several names are split
+type genField struct {
+	name string
+	Type ast.Expr
+}
+
+// Internal: get the parameters or the results of a method one by one
+func fieldList(list *ast.FieldList) []genField {
+	fields := make([]genField, 0)
+	if list == nil {
+		return fields
+	}
+	for _, field := range list.List {
+		if len(field.Names) == 0 {
+			fields = append(fields, genField{Type: field.Type})
+			continue
+		}
+		for _, name := range field.Names {
+			fields = append(fields, genField{name: name.Name, Type: field.Type})
+		}
+	}
+	return fields
+}
+
+// Internal: get the source text of a type, the imports it uses are recorded
+func (iface *genInterface) typeText(fset *token.FileSet, expr ast.Expr) string {
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if selector, ok := node.(*ast.SelectorExpr); ok {
+			if ident, ok := selector.X.(*ast.Ident); ok {
+				iface.used[ident.Name] = true
+			}
+		}
+		return true
+	})
+	var buffer bytes.Buffer
+	printer.Fprint(&buffer, fset, expr)
+	return buffer.String()
+}
+
+// Internal: get the import name of the context package
+func (iface *genInterface) contextName() string {
+	for name, path := range iface.imports {
+		if path == "context" {
+			return name
+		}
+	}
+	return "context"
+}
+
+// Internal: write the header, the package and the imports of a generated file
+func (iface *genInterface) writeHeader(buffer *bytes.Buffer, imports map[string]string) {
+	buffer.WriteString(genHeader)
+	fmt.Fprintf(buffer, "package %s\n\nimport (\n", iface.pkg)
+	for name := range iface.used {
+		if path, ok := iface.imports[name]; ok {
+			imports[name] = path
+		}
+	}
+	names := make([]string, 0, len(imports))
+	for name := range imports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// the package name of a module path may differ from its base, only the standard library is not aliased
+		path := imports[name]
+		if name == filepath.Base(path) && !strings.Contains(strings.Split(path, "/")[0], ".") {
+			fmt.Fprintf(buffer, "\t%q\n", imports[name])
+			continue
+		}
+		fmt.Fprintf(buffer, "\t%s %q\n", name, imports[name])
+	}
+	buffer.WriteString(")\n\n")
+}
+
+// Internal: get the parameter list of a method, the arguments are named a0, a1 ...
+func (method *genMethod) signature(contextName string) string {
+	params := make([]string, 0, len(method.params)+1)
+	if method.hasContext {
+		params = append(params, "ctx "+contextName+".Context")
+	}
+	for i, param := range method.params {
+		if method.variadic && i == len(method.params)-1 {
+			param = "..." + param
+		}
+		params = append(params, fmt.Sprintf("a%d %s", i, param))
+	}
+	results := append(append([]string{}, method.results...), "error")
+	return fmt.Sprintf("%s(%s) (%s)", method.name, strings.Join(params, ", "), strings.Join(results, ", "))
+}
+
+// Internal: generate the host client
+func generateClient(iface *genInterface) []byte {
+	var buffer bytes.Buffer
+	contextName := iface.contextName()
+	iface.writeHeader(&buffer, map[string]string{"GoPlug": hostImport, contextName: "context"})
+
+	client := iface.name + "Client"
+	fmt.Fprintf(&buffer, "/* %s calls the %s methods of a plugin */\ntype %s struct {\n\tPlugin *GoPlug.Plugin\n}\n\n", client, iface.name, client)
+	fmt.Fprintf(&buffer, "// The client implements the interface\nvar _ %s = (*%s)(nil)\n\n", iface.name, client)
+	fmt.Fprintf(&buffer, "/* Create a %s client of a loaded plugin */\nfunc New%s(plugin *GoPlug.Plugin) *%s {\n\treturn &%s{Plugin: plugin}\n}\n", iface.name, client, client, client)
+
+	for _, method := range iface.methods {
+		buffer.WriteString("\n")
+		if method.doc != "" {
+			fmt.Fprintf(&buffer, "/* %s */\n", method.doc)
+		}
+		fmt.Fprintf(&buffer, "func (client *%s) %s {\n", client, method.signature(contextName))
+
+		args := make([]string, 0, len(method.params))
+		for i := range method.params {
+			args = append(args, fmt.Sprintf("a%d", i))
+		}
+		if method.variadic {
+			last := args[len(args)-1]
+			fmt.Fprintf(&buffer, "\targs := []interface{}{%s}\n", strings.Join(args[:len(args)-1], ", "))
+			fmt.Fprintf(&buffer, "\tfor _, arg := range %s {\n\t\targs = append(args, arg)\n\t}\n", last)
+		} else {
+			fmt.Fprintf(&buffer, "\targs := []interface{}{%s}\n", strings.Join(args, ", "))
+		}
+		ctx := contextName + ".Background()"
+		if method.hasContext {
+			ctx = "ctx"
+		}
+
+		// The results are declared to be returned on error as zero values
+		returns := make([]string, 0, len(method.results)+1)
+		targets := make([]string, 0, len(method.results)+1)
+		for i, result := range method.results {
+			fmt.Fprintf(&buffer, "\tvar r%d %s\n", i, result)
+			returns = append(returns, fmt.Sprintf("r%d", i))
+			targets = append(targets, fmt.Sprintf("&r%d", i))
+		}
+		// The plugin sends the trailing error as nil, a failure is the error of the call
+		targets = append(targets, "nil")
+		fmt.Fprintf(&buffer, "\terr, results := client.Plugin.ExecuteContext(%s, %q, args...)\n", ctx, method.name)
+		fmt.Fprintf(&buffer, "\tif err == nil {\n\t\terr = GoPlug.DecodeResults(results, %s)\n\t}\n", strings.Join(targets, ", "))
+		fmt.Fprintf(&buffer, "\treturn %s\n}\n", strings.Join(append(returns, "err"), ", "))
+	}
+	return buffer.Bytes()
+}
+
+// Internal: generate the plugin server adapter
+func generateServer(iface *genInterface) []byte {
+	var buffer bytes.Buffer
+	contextName := iface.contextName()
+	imports := map[string]string{"pluginlib": pluginImport}
+	for _, method := range iface.methods {
+		if method.hasContext {
+			imports[contextName] = "context"
+		}
+	}
+	iface.writeHeader(&buffer, imports)
+
+	server := iface.name + "Server"
+	fmt.Fprintf(&buffer, "/* %s serves a %s implementation as a plugin, only the interface methods are exposed */\n", server, iface.name)
+	fmt.Fprintf(&buffer, "type %s struct {\n\timpl %s\n}\n\n", server, iface.name)
+	fmt.Fprintf(&buffer, "/* Initialize a plugin serving the implementation, it gets the Init, Start and Stop calls if it has the methods */\n")
+	fmt.Fprintf(&buffer, "func New%s(impl %s) (*pluginlib.Plugin, error) {\n", server, iface.name)
+	fmt.Fprintf(&buffer, "\tplugin, err := pluginlib.PluginInit(&%s{impl: impl})\n\tif err != nil {\n\t\treturn nil, err\n\t}\n", server)
+	for _, method := range iface.methods {
+		names := make([]string, 0, len(method.paramNames))
+		for _, name := range method.paramNames {
+			names = append(names, strconv.Quote(name))
+		}
+		fmt.Fprintf(&buffer, "\tplugin.DescribeMethod(%q, pluginlib.MethodInfo{Doc: %q, Params: []string{%s}})\n",
+			method.name, method.doc, strings.Join(names, ", "))
+	}
+	buffer.WriteString("\treturn plugin, nil\n}\n\n")
+
+	fmt.Fprintf(&buffer, "func (server *%s) Init() error {\n\tif impl, ok := server.impl.(interface{ Init() error }); ok {\n\t\treturn impl.Init()\n\t}\n\treturn nil\n}\n\n", server)
+	fmt.Fprintf(&buffer, "func (server *%s) Start(conf map[string]interface{}) error {\n\tif impl, ok := server.impl.(interface {\n\t\tStart(map[string]interface{}) error\n\t}); ok {\n\t\treturn impl.Start(conf)\n\t}\n\treturn nil\n}\n\n", server)
+	fmt.Fprintf(&buffer, "func (server *%s) Stop() error {\n\tif impl, ok := server.impl.(interface{ Stop() error }); ok {\n\t\treturn impl.Stop()\n\t}\n\treturn nil\n}\n", server)
+
+	for _, method := range iface.methods {
+		args := make([]string, 0, len(method.params)+1)
+		if method.hasContext {
+			args = append(args, "ctx")
+		}
+		for i := range method.params {
+			arg := fmt.Sprintf("a%d", i)
+			if method.variadic && i == len(method.params)-1 {
+				arg += "..."
+			}
+			args = append(args, arg)
+		}
+		fmt.Fprintf(&buffer, "\nfunc (server *%s) %s {\n\treturn server.impl.%s(%s)\n}\n",
+			server, method.signature(contextName), method.name, strings.Join(args, ", "))
+	}
+	return buffer.Bytes()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Update the golden files of the generated code")
+
+// The declarations of the host and the plugin libraries used by the generated code
+var libraries = map[string]string{
+	hostImport: `package GoPlug
+
+import "context"
+
+type Plugin struct{}
+
+func (plugin *Plugin) ExecuteContext(ctx context.Context, funcName string, args ...interface{}) (error, []interface{}) {
+	return nil, nil
+}
+
+func DecodeResults(results []interface{}, targets ...interface{}) error { return nil }
+`,
+	pluginImport: `package pluginlib
+
+type Plugintype interface {
+	Init() error
+	Start(map[string]interface{}) error
+	Stop() error
+}
+
+type Plugin struct{}
+
+type MethodInfo struct {
+	Doc        string
+	Params     []string
+	Idempotent bool
+}
+
+func PluginInit(plugin Plugintype) (*Plugin, error) { return nil, nil }
+
+func (plugin *Plugin) DescribeMethod(name string, info MethodInfo) {}
+`,
+}
+
+// Internal: import the libraries from their declarations and the standard library from source
+type libraryImporter struct {
+	fset     *token.FileSet
+	std      types.Importer
+	packages map[string]*types.Package
+}
+
+func (imp *libraryImporter) Import(path string) (*types.Package, error) {
+	if pkg, ok := imp.packages[path]; ok {
+		return pkg, nil
+	}
+	source, ok := libraries[path]
+	if !ok {
+		return imp.std.Import(path)
+	}
+	file, err := parser.ParseFile(imp.fset, path+".go", source, 0)
+	if err != nil {
+		return nil, err
+	}
+	conf := types.Config{Importer: imp}
+	pkg, err := conf.Check(path, imp.fset, []*ast.File{file}, nil)
+	if err != nil {
+		return nil, err
+	}
+	imp.packages[path] = pkg
+	return pkg, nil
+}
+
+func TestGenerate(t *testing.T) {
+	source := filepath.Join("testdata", "store.go")
+	iface, err := parseInterface(source, "Store")
+	if err != nil {
+		t.Fatalf("Failed to parse the interface: %v", err)
+	}
+	if len(iface.methods) != 3 {
+		t.Fatalf("Parsed %d methods", len(iface.methods))
+	}
+	get, set := iface.methods[0], iface.methods[1]
+	if !get.hasContext || len(get.params) != 1 || len(get.results) != 2 {
+		t.Errorf("Parsed Get as %+v", get)
+	}
+	if !set.variadic || set.params[1] != "string" {
+		t.Errorf("Parsed Set as %+v", set)
+	}
+
+	fset := token.NewFileSet()
+	sourceFile, err := parser.ParseFile(fset, source, nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", source, err)
+	}
+	files := []*ast.File{sourceFile}
+	for _, output := range []struct {
+		golden   string
+		generate func(*genInterface) []byte
+	}{
+		{"store_client.golden", generateClient},
+		{"store_server.golden", generateServer},
+	} {
+		code, err := format.Source(output.generate(iface))
+		if err != nil {
+			t.Fatalf("Failed to format %s: %v", output.golden, err)
+		}
+		golden := filepath.Join("testdata", output.golden)
+		if *update {
+			if err := ioutil.WriteFile(golden, code, 0644); err != nil {
+				t.Fatalf("Failed to update %s: %v", golden, err)
+			}
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", golden, err)
+		}
+		if !bytes.Equal(code, expected) {
+			t.Errorf("The generated code differs from %s:\n%s", golden, code)
+		}
+
+		file, err := parser.ParseFile(fset, output.golden, code, 0)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", output.golden, err)
+		}
+		files = append(files, file)
+	}
+
+	// The generated code compiles with the interface in its package
+	imp := &libraryImporter{fset: fset, std: importer.ForCompiler(fset, "source", nil), packages: make(map[string]*types.Package)}
+	conf := types.Config{Importer: imp}
+	if _, err := conf.Check("store", fset, files, nil); err != nil {
+		t.Errorf("The generated code doesn't type-check: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+/* The goplug command.
+ *
+ *   goplug agent -dir <plugin location> [-listen host:port] -certs <dir> [-secret <secret>]
+ *
+ * runs an agent serving the plugins of the directory to remote hosts
+ *
+ *   goplug gen -type <interface> [-client <file>] [-server <file>] <source file>
+ *
+ * generates the typed host client and plugin server of an interface
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	GoPlug "github.com/swarvanusg/GoPlug"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// The env the agent secret is read from if not given as a flag
+	AgentSecretEnv = "GOPLUG_AGENT_SECRET"
+	// The time the plugins get to stop on shutdown
+	stopTimeout = 30 * time.Second
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: goplug <command> [flags]\n\nCommands:\n  agent  serve the plugins of a directory to remote hosts\n  gen    generate the typed client and server of a plugin interface\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "agent":
+		err = runAgent(os.Args[2:])
+	case "gen":
+		err = runGen(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "goplug %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func runAgent(args []string) error {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	dir := flags.String("dir", "", "The plugin location served by the agent")
+	listen := flags.String("listen", "127.0.0.1:7070", "The address the agent listens on")
+	certs := flags.String("certs", "", "The certificate directory, the certificates are generated if missing")
+	secret := flags.String("secret", os.Getenv(AgentSecretEnv), "The secret the hosts must send")
+	flags.Parse(args)
+
+	if *dir == "" || *certs == "" {
+		flags.Usage()
+		return fmt.Errorf("-dir and -certs are required")
+	}
+	if !PluginConn.CertsValid(*certs, time.Hour) {
+		host, _, splitErr := net.SplitHostPort(*listen)
+		if splitErr != nil {
+			return fmt.Errorf("Invalid listen address %s: %v", *listen, splitErr)
+		}
+		err := PluginConn.GenerateCerts(*certs, host)
+		if err != nil {
+			return fmt.Errorf("Failed to generate certificates: %v", err)
+		}
+		fmt.Printf("Generated certificates in %s, the hosts use %s, %s and %s\n", *certs,
+			PluginConn.CACertFile, PluginConn.HostCertFile, PluginConn.HostKeyFile)
+	}
+
+	conf := GoPlug.AgentServerConf{
+		Registry: GoPlug.PluginRegConf{PluginLocation: *dir},
+		Listen:   *listen,
+		Tls: &common.TlsConf{
+			CA:   filepath.Join(*certs, PluginConn.CACertFile),
+			Cert: filepath.Join(*certs, PluginConn.PluginCertFile),
+			Key:  filepath.Join(*certs, PluginConn.PluginKeyFile),
+		},
+		Secret: *secret,
+	}
+	agent, err := GoPlug.StartAgent(conf)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Agent listening on %s\n", agent.Addr())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	return agent.Stop(ctx)
+}
@@ -0,0 +1,15 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// The sample interface of the generator test
+type Store interface {
+	// Get a value and its age
+	Get(ctx context.Context, key string) (string, time.Duration, error)
+	// Set the values of the keys
+	Set(key string, values ...string) error
+	Keys(prefix string, limit int) ([]string, error)
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"encoding/base64"
+)
+
+var (
+	// The blobs larger than this size are sent as a sealed memfd instead of inline in the body
+	BlobInlineThreshold = 64 * 1024
+)
+
+const (
+	// The key of a reference to a payload sent as a file descriptor
+	FdRefKey = "$fd"
+	// The kind of the file descriptor reference
+	FdRefKind = "kind"
+	// The kind of a blob sent as a sealed memfd
+	FdKindBlob = "blob"
+	// The kind of an open file, socket or listener
+	FdKindFile = "file"
+	// The key of a blob sent inline
+	BlobInlineKey = "$blob"
+)
+
+/* Blob is a binary argument of a method call. The host sends a large blob as a sealed memfd
+   that the plugin maps read only, a small blob is sent inline in the payload.
+   On the plugin side the Data of a mapped blob is valid only till the method returns */
+type Blob struct {
+	Data []byte
+	// The unmap function of a mapped blob
+	release func()
+}
+
+/* Create a blob of the data */
+func NewBlob(data []byte) *Blob {
+	return &Blob{Data: data}
+}
+
+/* Release the memory of a mapped blob. It is called by the plugin library after the method returns */
+func (blob *Blob) Release() {
+	if blob.release != nil {
+		blob.release()
+		blob.release = nil
+	}
+	blob.Data = nil
+}
+
+/* Get the reference sent in place of a payload passed as a file descriptor */
+func FdRef(id string, kind string) map[string]interface{} {
+	return map[string]interface{}{FdRefKey: id, FdRefKind: kind}
+}
+
+/* Get the id and the kind of a file descriptor reference, ok is false if value is not a reference */
+func ParseFdRef(value interface{}) (id string, kind string, ok bool) {
+	ref, isMap := value.(map[string]interface{})
+	if !isMap {
+		return "", "", false
+	}
+	id, ok = ref[FdRefKey].(string)
+	kind, _ = ref[FdRefKind].(string)
+	return id, kind, ok
+}
+
+/* Get the inline blob data of a value, ok is false if value is not an inline blob */
+func ParseInlineBlob(value interface{}) ([]byte, bool) {
+	ref, isMap := value.(map[string]interface{})
+	if !isMap {
+		return nil, false
+	}
+	switch data := ref[BlobInlineKey].(type) {
+	case []byte:
+		return data, true
+	case string:
+		// json sends the bytes as base64
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		return decoded, err == nil
+	}
+	return nil, false
+}
@@ -0,0 +1,73 @@
+//go:build linux
+// +build linux
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	mfdCloexec      = 0x1
+	mfdAllowSealing = 0x2
+	fAddSeals       = 1033
+	// F_SEAL_SEAL | F_SEAL_SHRINK | F_SEAL_GROW | F_SEAL_WRITE
+	blobSeals = 0x1 | 0x2 | 0x4 | 0x8
+)
+
+// The memfd_create syscall number of the architecture (0 if unknown)
+var memfdCreateTrap = map[string]uintptr{"amd64": 319, "arm64": 279, "386": 356, "arm": 385}[runtime.GOARCH]
+
+/* Check if the blobs could be sent as memfd */
+func MemfdSupported() bool {
+	return memfdCreateTrap != 0
+}
+
+/* Create a sealed memfd with the blob data. The caller owns the returned file */
+func BlobMemfd(name string, data []byte) (*os.File, error) {
+	if memfdCreateTrap == 0 {
+		return nil, fmt.Errorf("memfd is not supported on %s", runtime.GOARCH)
+	}
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	fd, _, errno := syscall.Syscall(memfdCreateTrap, uintptr(unsafe.Pointer(namePtr)), mfdCloexec|mfdAllowSealing, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("Failed to create memfd: %v", errno)
+	}
+	file := os.NewFile(fd, name)
+
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to write memfd: %v", err)
+	}
+	// Seal the memfd so that the plugin could map it safely
+	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, fAddSeals, blobSeals)
+	if errno != 0 {
+		file.Close()
+		return nil, fmt.Errorf("Failed to seal memfd: %v", errno)
+	}
+	return file, nil
+}
+
+/* Map a blob file read only. The file could be closed once it is mapped */
+func MapBlob(file *os.File) (*Blob, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return &Blob{Data: []byte{}}, nil
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to map blob: %v", err)
+	}
+	return &Blob{Data: data, release: func() { syscall.Munmap(data) }}, nil
+}
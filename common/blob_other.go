@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+/* Check if the blobs could be sent as memfd */
+func MemfdSupported() bool {
+	return false
+}
+
+/* Create a sealed memfd with the blob data. The caller owns the returned file */
+func BlobMemfd(name string, data []byte) (*os.File, error) {
+	return nil, fmt.Errorf("memfd is not supported on %s", runtime.GOOS)
+}
+
+/* Map a blob file read only. The file could be closed once it is mapped */
+func MapBlob(file *os.File) (*Blob, error) {
+	return nil, fmt.Errorf("Blob mapping is not supported on %s", runtime.GOOS)
+}
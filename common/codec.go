@@ -0,0 +1,191 @@
+package common
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// The request header the host lists its codecs in (in preference order) on activation
+	CodecsHeader = "X-Goplug-Codecs"
+	// The response header the plugin returns the chosen codec in
+	CodecHeader = "X-Goplug-Codec"
+	// The codec used when none is negotiated
+	DefaultCodec = "json"
+)
+
+/* Codec encodes and decodes the arguments and the results of a method call */
+type Codec interface {
+	// The codec name used in negotiation
+	Name() string
+	// The Content-Type of the encoded payload
+	ContentType() string
+	// Encode a list of values
+	Encode(values []interface{}) ([]byte, error)
+	// Decode a list of values
+	Decode(data []byte) ([]interface{}, error)
+}
+
+var (
+	codecs      = map[string]Codec{}
+	codecAccess sync.Mutex
+)
+
+func init() {
+	// The generic containers sent in gob interface values
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+
+	RegisterCodec(JsonCodec{})
+	RegisterCodec(GobCodec{})
+	RegisterCodec(MsgpackCodec{})
+}
+
+/* Register a codec, it replaces a codec of the same name */
+func RegisterCodec(codec Codec) {
+	codecAccess.Lock()
+	defer codecAccess.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+/* Get a codec by name, nil if not registered */
+func GetCodec(name string) Codec {
+	codecAccess.Lock()
+	defer codecAccess.Unlock()
+
+	return codecs[name]
+}
+
+/* Get the codec of a Content-Type. JSON is returned for an empty or unknown Content-Type */
+func CodecByContentType(contentType string) Codec {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+
+	codecAccess.Lock()
+	defer codecAccess.Unlock()
+
+	for _, codec := range codecs {
+		if codec.ContentType() == mediaType {
+			return codec
+		}
+	}
+	return codecs[DefaultCodec]
+}
+
+/* Choose the first codec of the offered list (comma separated) that is registered. JSON is
+   chosen if none matches */
+func NegotiateCodec(offered string) Codec {
+	for _, name := range strings.Split(offered, ",") {
+		codec := GetCodec(strings.TrimSpace(name))
+		if codec != nil {
+			return codec
+		}
+	}
+	return GetCodec(DefaultCodec)
+}
+
+/* JSON codec, the numbers are decoded as int64 when they are integers */
+type JsonCodec struct{}
+
+func (JsonCodec) Name() string        { return "json" }
+func (JsonCodec) ContentType() string { return "application/json" }
+
+func (JsonCodec) Encode(values []interface{}) ([]byte, error) {
+	if values == nil {
+		values = []interface{}{}
+	}
+	return json.Marshal(values)
+}
+
+func (JsonCodec) Decode(data []byte) ([]interface{}, error) {
+	values := make([]interface{}, 0)
+	if len(data) == 0 {
+		return values, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&values)
+	if err != nil {
+		return nil, fmt.Errorf("Json decode failed: %v", err)
+	}
+	for i, value := range values {
+		values[i] = jsonNumbers(value)
+	}
+	return values, nil
+}
+
+// Internal: replace the json numbers with int64 or float64
+func jsonNumbers(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case json.Number:
+		if integer, err := typed.Int64(); err == nil {
+			return integer
+		}
+		float, _ := typed.Float64()
+		return float
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = jsonNumbers(item)
+		}
+	case map[string]interface{}:
+		for key, item := range typed {
+			typed[key] = jsonNumbers(item)
+		}
+	}
+	return value
+}
+
+/* Gob codec, the custom types sent in interface values should be registered with gob.Register */
+type GobCodec struct{}
+
+// The gob payload, gob can't encode nil interface values so their positions are sent apart
+type gobPayload struct {
+	Values []interface{}
+	Nil    []int
+}
+
+func (GobCodec) Name() string        { return "gob" }
+func (GobCodec) ContentType() string { return "application/x-gob" }
+
+func (GobCodec) Encode(values []interface{}) ([]byte, error) {
+	payload := gobPayload{Values: make([]interface{}, 0, len(values))}
+	for i, value := range values {
+		if value == nil {
+			payload.Nil = append(payload.Nil, i)
+			continue
+		}
+		payload.Values = append(payload.Values, value)
+	}
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(&payload)
+	if err != nil {
+		return nil, fmt.Errorf("Gob encode failed: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte) ([]interface{}, error) {
+	values := make([]interface{}, 0)
+	if len(data) == 0 {
+		return values, nil
+	}
+	payload := gobPayload{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&payload)
+	if err != nil {
+		return nil, fmt.Errorf("Gob decode failed: %v", err)
+	}
+	next := 0
+	for len(values) < len(payload.Values)+len(payload.Nil) {
+		if next < len(payload.Nil) && payload.Nil[next] == len(values) {
+			values = append(values, nil)
+			next++
+			continue
+		}
+		values = append(values, payload.Values[len(values)-next])
+	}
+	return values, nil
+}
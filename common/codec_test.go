@@ -0,0 +1,128 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The values every codec round-trips as they are
+var codecValues = []interface{}{
+	nil,
+	true,
+	int64(-5),
+	int64(300),
+	int64(1) << 40,
+	1.5,
+	"text",
+	[]interface{}{int64(1), "a", false},
+	map[string]interface{}{"key": int64(1), "nested": map[string]interface{}{"list": []interface{}{"x"}}},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, name := range []string{"json", "gob", "msgpack"} {
+		codec := GetCodec(name)
+		if codec == nil {
+			t.Fatalf("Codec %s is not registered", name)
+		}
+		data, err := codec.Encode(codecValues)
+		if err != nil {
+			t.Fatalf("%s: encode failed: %v", name, err)
+		}
+		values, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("%s: decode failed: %v", name, err)
+		}
+		if !reflect.DeepEqual(values, codecValues) {
+			t.Errorf("%s: got %#v, expected %#v", name, values, codecValues)
+		}
+	}
+}
+
+func TestCodecEmpty(t *testing.T) {
+	for _, name := range []string{"json", "gob", "msgpack"} {
+		codec := GetCodec(name)
+		values, err := codec.Decode(nil)
+		if err != nil || len(values) != 0 {
+			t.Errorf("%s: empty payload decoded as %v, %v", name, values, err)
+		}
+	}
+}
+
+// The values msgpack encodes as encoding/json does
+type codecItem struct {
+	Name    string    `json:"name"`
+	Count   int       `json:"count,omitempty"`
+	Skipped string    `json:"-"`
+	When    time.Time `json:"when"`
+	Tags    map[int]string
+}
+
+func TestMsgpackEncodesAsJson(t *testing.T) {
+	item := codecItem{
+		Name:    "item",
+		Skipped: "skipped",
+		When:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Tags:    map[int]string{1: "one"},
+	}
+	input := []interface{}{item, &item, item.When, map[int]int{2: 4}}
+
+	jsonValues, err := JsonCodec{}.Decode(mustEncode(t, JsonCodec{}, input))
+	if err != nil {
+		t.Fatalf("json decode failed: %v", err)
+	}
+	msgpackValues, err := MsgpackCodec{}.Decode(mustEncode(t, MsgpackCodec{}, input))
+	if err != nil {
+		t.Fatalf("msgpack decode failed: %v", err)
+	}
+	if !reflect.DeepEqual(msgpackValues, jsonValues) {
+		t.Errorf("msgpack decoded %#v, json decoded %#v", msgpackValues, jsonValues)
+	}
+
+	expected := map[string]interface{}{
+		"name": "item",
+		"when": "2024-01-02T03:04:05Z",
+		"Tags": map[string]interface{}{"1": "one"},
+	}
+	if !reflect.DeepEqual(msgpackValues[0], expected) {
+		t.Errorf("Struct decoded as %#v, expected %#v", msgpackValues[0], expected)
+	}
+}
+
+func TestMsgpackTruncated(t *testing.T) {
+	data := mustEncode(t, MsgpackCodec{}, codecValues)
+	for length := 0; length < len(data); length++ {
+		_, err := MsgpackCodec{}.Decode(data[:length])
+		if length > 0 && err == nil {
+			t.Errorf("Truncated payload of %d bytes decoded without error", length)
+		}
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	cases := map[string]string{
+		"msgpack, json": "msgpack",
+		"unknown,gob":   "gob",
+		"unknown":       "json",
+		"":              "json",
+	}
+	for offered, expected := range cases {
+		if name := NegotiateCodec(offered).Name(); name != expected {
+			t.Errorf("Offered %q: got %s, expected %s", offered, name, expected)
+		}
+	}
+	if name := CodecByContentType("application/msgpack; charset=binary").Name(); name != "msgpack" {
+		t.Errorf("Content-Type resolved to %s", name)
+	}
+	if name := CodecByContentType("text/plain").Name(); name != DefaultCodec {
+		t.Errorf("Unknown Content-Type resolved to %s", name)
+	}
+}
+
+func mustEncode(t *testing.T, codec Codec, values []interface{}) []byte {
+	data, err := codec.Encode(values)
+	if err != nil {
+		t.Fatalf("%s encode failed: %v", codec.Name(), err)
+	}
+	return data
+}
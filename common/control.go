@@ -0,0 +1,15 @@
+package common
+
+const (
+	// The path prefix of the control endpoints served by a plugin. A plugin method name can't start
+	// with it (an exported method starts with a letter) so the endpoints don't shadow the methods
+	ControlPrefix = "_goplug/"
+	// Liveness: the plugin is able to serve requests
+	ControlLive = ControlPrefix + "Live"
+	// Readiness: the health report of the plugin
+	ControlReady = ControlPrefix + "Ready"
+	// The identity of the plugin instance, verified by the registry on reattach
+	ControlIdentity = ControlPrefix + "Identity"
+	// The descriptors of the plugin methods
+	ControlDescribe = ControlPrefix + "Describe"
+)
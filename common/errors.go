@@ -0,0 +1,94 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// The Content-Type of an error envelope response
+	ErrorContentType = "application/vnd.goplug.error+json"
+)
+
+// The error codes of the envelope
+const (
+	// The method is not registered by the plugin
+	ErrorMethodNotFound = "method_not_found"
+	// The arguments could not be decoded or don't match the method
+	ErrorBadArguments = "bad_arguments"
+	// The method didn't complete before the deadline
+	ErrorTimeout = "timeout"
+	// The plugin crashed or the connection to it is lost
+	ErrorPluginCrashed = "plugin_crashed"
+	// The method panicked
+	ErrorPanic = "panic"
+	// The method returned an error
+	ErrorPlugin = "plugin_error"
+	// Any other failure
+	ErrorInternal = "internal"
+)
+
+/* ErrorEnvelope is the error of a method call sent over the wire. A plugin method could return
+   an *ErrorEnvelope to set the code, details or retryable flag, other errors are sent with the
+   ErrorPlugin code */
+type ErrorEnvelope struct {
+	// The error code
+	Code string `json:"code"`
+	// The error message
+	Message string `json:"message"`
+	// Additional details of the error
+	Details map[string]interface{} `json:"details,omitempty"`
+	// The call could be retried
+	Retryable bool `json:"retryable,omitempty"`
+	// The plugin stack trace of a panic
+	Stack string `json:"stack,omitempty"`
+}
+
+func (envelope *ErrorEnvelope) Error() string {
+	return envelope.Message
+}
+
+/* Get the http status an envelope is sent with */
+func (envelope *ErrorEnvelope) Status() int {
+	switch envelope.Code {
+	case ErrorMethodNotFound:
+		return 404
+	case ErrorBadArguments:
+		return 400
+	case ErrorTimeout:
+		return 504
+	case ErrorPluginCrashed:
+		return 502
+	}
+	return 500
+}
+
+/* Create an error envelope */
+func NewErrorEnvelope(code string, format string, args ...interface{}) *ErrorEnvelope {
+	return &ErrorEnvelope{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+/* Encode an error envelope */
+func (envelope *ErrorEnvelope) Encode() []byte {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		// The details are not encodable, they are dropped
+		data, _ = json.Marshal(&ErrorEnvelope{Code: envelope.Code, Message: envelope.Message,
+			Retryable: envelope.Retryable, Stack: envelope.Stack})
+	}
+	return data
+}
+
+/* Decode the error envelope of a response, ok is false if the response is not an envelope */
+func ParseErrorEnvelope(contentType string, body []byte) (*ErrorEnvelope, bool) {
+	if strings.TrimSpace(strings.Split(contentType, ";")[0]) != ErrorContentType {
+		return nil, false
+	}
+	envelope := &ErrorEnvelope{}
+	err := json.Unmarshal(body, envelope)
+	if err != nil || envelope.Code == "" {
+		return nil, false
+	}
+	return envelope, true
+}
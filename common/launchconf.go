@@ -0,0 +1,38 @@
+package common
+
+/* The launch configuration of a plugin process. It could be declared in
+ * the plugin conf and overridden by the host. The env allowlist and the
+ * working directory are taken from the host launch confs only */
+type LaunchConf struct {
+	// The host environment variables passed to the plugin, an entry ending with '*' matches a prefix
+	EnvAllowlist []string `json:"envallowlist,omitempty"`
+	// The extra environment variables set for the plugin
+	Env map[string]string `json:"env,omitempty"`
+	// The command line arguments (without the binary name)
+	Args []string `json:"args,omitempty"`
+	// The working directory, relative to the plugin folder if not absolute
+	WorkDir string `json:"workdir,omitempty"`
+}
+
+// Merge the plugin declared launch conf with the host launch confs, later confs takes precedence when set
+func MergeLaunchConf(confs ...*LaunchConf) *LaunchConf {
+	launch := &LaunchConf{Env: make(map[string]string)}
+	for _, source := range confs {
+		if source == nil {
+			continue
+		}
+		if source.EnvAllowlist != nil {
+			launch.EnvAllowlist = source.EnvAllowlist
+		}
+		for key, value := range source.Env {
+			launch.Env[key] = value
+		}
+		if source.Args != nil {
+			launch.Args = source.Args
+		}
+		if source.WorkDir != "" {
+			launch.WorkDir = source.WorkDir
+		}
+	}
+	return launch
+}
@@ -0,0 +1,237 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// The schema keyword of the goplug specific kinds (the values passed as file descriptors)
+	SchemaKindKey = "x-goplug-kind"
+)
+
+/* A JSON Schema */
+type Schema map[string]interface{}
+
+/* The descriptor of a method published by a plugin */
+type MethodDescriptor struct {
+	// The method name
+	Name string `json:"name"`
+	// The method documentation
+	Doc string `json:"doc,omitempty"`
+	// The parameters, the request context and the stream writer are not listed
+	Params []ParamDescriptor `json:"params"`
+	// The last parameter takes any number of arguments
+	Variadic bool `json:"variadic,omitempty"`
+	// The schemas of the results, a trailing error is not listed
+	Results []Schema `json:"results"`
+	// The method streams its results
+	Stream bool `json:"stream,omitempty"`
+	// The schema of the streamed items if known
+	StreamItem Schema `json:"streamitem,omitempty"`
+	// The method could be retried safely
+	Idempotent bool `json:"idempotent,omitempty"`
+	// The deprecation notice of a deprecated method
+	Deprecated string `json:"deprecated,omitempty"`
+}
+
+/* The descriptor of a method parameter */
+type ParamDescriptor struct {
+	// The parameter name if given by the plugin
+	Name string `json:"name,omitempty"`
+	// The schema of the argument (of each argument for the variadic parameter)
+	Schema Schema `json:"schema"`
+}
+
+/* Check that the arguments of a call match the method descriptor */
+func (descriptor *MethodDescriptor) ValidateArgs(args []interface{}) error {
+	params := len(descriptor.Params)
+	if descriptor.Variadic && len(args) < params-1 {
+		return fmt.Errorf("Method %s takes at least %d arguments, %d given", descriptor.Name, params-1, len(args))
+	}
+	if !descriptor.Variadic && len(args) != params {
+		return fmt.Errorf("Method %s takes %d arguments, %d given", descriptor.Name, params, len(args))
+	}
+	for i, arg := range args {
+		param := descriptor.Params[params-1]
+		if i < params {
+			param = descriptor.Params[i]
+		}
+		err := ValidateSchema(param.Schema, arg)
+		if err != nil {
+			name := fmt.Sprintf("argument %d", i+1)
+			if param.Name != "" {
+				name += " (" + param.Name + ")"
+			}
+			return fmt.Errorf("Method %s %s: %v", descriptor.Name, name, err)
+		}
+	}
+	return nil
+}
+
+/* Check that a value matches a schema. The value is checked in its json form, the values passed
+   as file descriptors are not checked. The keywords type, items, minItems, maxItems, properties,
+   additionalProperties, minimum and maximum are supported */
+func ValidateSchema(schema Schema, value interface{}) error {
+	if _, ok := schema[SchemaKindKey]; ok {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("not encodable: %v", err)
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	err = decoder.Decode(&generic)
+	if err != nil {
+		return err
+	}
+	return validateValue(schema, generic, "")
+}
+
+// Internal: check a json decoded value, path is the location of the value in the argument
+func validateValue(schema Schema, value interface{}, path string) error {
+	if len(schema) == 0 {
+		return nil
+	}
+	if _, ok := schema[SchemaKindKey]; ok {
+		return nil
+	}
+	fail := func(format string, args ...interface{}) error {
+		message := fmt.Sprintf(format, args...)
+		if path != "" {
+			message = path + ": " + message
+		}
+		return fmt.Errorf("%s", message)
+	}
+
+	kind := jsonKind(value)
+	if types := schemaTypes(schema); len(types) > 0 && !matchesType(types, kind) {
+		return fail("%s is not %s", kind, strings.Join(types, " or "))
+	}
+
+	switch typed := value.(type) {
+	case json.Number:
+		number, _ := typed.Float64()
+		if minimum, ok := schemaNumber(schema, "minimum"); ok && number < minimum {
+			return fail("%s is less than %g", typed, minimum)
+		}
+		if maximum, ok := schemaNumber(schema, "maximum"); ok && number > maximum {
+			return fail("%s is greater than %g", typed, maximum)
+		}
+	case []interface{}:
+		if minItems, ok := schemaNumber(schema, "minItems"); ok && float64(len(typed)) < minItems {
+			return fail("%d items, at least %g expected", len(typed), minItems)
+		}
+		if maxItems, ok := schemaNumber(schema, "maxItems"); ok && float64(len(typed)) > maxItems {
+			return fail("%d items, at most %g expected", len(typed), maxItems)
+		}
+		items := subSchema(schema["items"])
+		for i, item := range typed {
+			err := validateValue(items, item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional := subSchema(schema["additionalProperties"])
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			property := additional
+			if propertySchema, ok := properties[key]; ok {
+				property = subSchema(propertySchema)
+			}
+			err := validateValue(property, typed[key], path+"."+key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Internal: get the json schema type of a decoded value
+func jsonKind(value interface{}) string {
+	switch typed := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := typed.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// Internal: get the types allowed by a schema
+func schemaTypes(schema Schema) []string {
+	switch typed := schema["type"].(type) {
+	case string:
+		return []string{typed}
+	case []string:
+		return typed
+	case []interface{}:
+		types := make([]string, 0, len(typed))
+		for _, item := range typed {
+			if name, ok := item.(string); ok {
+				types = append(types, name)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// Internal: check if a value kind is allowed, an integer is a number as well
+func matchesType(types []string, kind string) bool {
+	for _, name := range types {
+		if name == kind || (name == "number" && kind == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// Internal: get a numeric keyword of a schema
+func schemaNumber(schema Schema, keyword string) (float64, bool) {
+	switch typed := schema[keyword].(type) {
+	case float64:
+		return typed, true
+	case int:
+		return float64(typed), true
+	case int64:
+		return float64(typed), true
+	case uint64:
+		return float64(typed), true
+	case json.Number:
+		number, err := typed.Float64()
+		return number, err == nil
+	}
+	return 0, false
+}
+
+// Internal: get a sub schema, it is a Schema when built and a map when decoded
+func subSchema(value interface{}) Schema {
+	switch typed := value.(type) {
+	case Schema:
+		return typed
+	case map[string]interface{}:
+		return Schema(typed)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+	point := Schema{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"x": Schema{"type": "integer", "minimum": 0},
+			"y": Schema{"type": "integer", "maximum": 10},
+		},
+		"additionalProperties": Schema{"type": "string"},
+	}
+	cases := []struct {
+		schema Schema
+		value  interface{}
+		err    string
+	}{
+		{Schema{}, struct{}{}, ""},
+		{Schema{"type": "integer"}, 3, ""},
+		{Schema{"type": "integer"}, 3.5, "number is not integer"},
+		{Schema{"type": "number"}, 3, ""},
+		{Schema{"type": []interface{}{"string", "null"}}, nil, ""},
+		{Schema{"type": "string"}, nil, "null is not string"},
+		{Schema{"type": "boolean"}, "true", "string is not boolean"},
+		{Schema{"type": "integer", "minimum": 1}, 0, "0 is less than 1"},
+		{Schema{"type": "integer", "maximum": 1}, 2, "2 is greater than 1"},
+		{Schema{"type": "array", "items": Schema{"type": "string"}}, []string{"a", "b"}, ""},
+		{Schema{"type": "array", "items": Schema{"type": "string"}}, []interface{}{"a", 1}, "[1]: integer is not string"},
+		{Schema{"type": "array", "minItems": 2}, []int{1}, "1 items, at least 2 expected"},
+		{Schema{"type": "array", "maxItems": 1}, []int{1, 2}, "2 items, at most 1 expected"},
+		{point, map[string]interface{}{"x": 1, "y": 2, "label": "p"}, ""},
+		{point, map[string]interface{}{"x": -1}, ".x: -1 is less than 0"},
+		{point, map[string]interface{}{"label": 1}, ".label: integer is not string"},
+		{point, struct {
+			X int `json:"x"`
+			Y int `json:"y"`
+		}{1, 20}, ".y: 20 is greater than 10"},
+		{Schema{"type": "integer", SchemaKindKey: "file"}, "not checked", ""},
+	}
+	for _, test := range cases {
+		err := ValidateSchema(test.schema, test.value)
+		if test.err == "" && err != nil {
+			t.Errorf("%v against %v: unexpected error %v", test.value, test.schema, err)
+		}
+		if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%v against %v: got error %v, expected %q", test.value, test.schema, err, test.err)
+		}
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	// The descriptor as the host decodes it from the plugin
+	data := `{"name": "Sum", "params": [
+		{"name": "label", "schema": {"type": "string"}},
+		{"name": "values", "schema": {"type": "integer", "minimum": 0}}
+	], "variadic": true, "results": [{"type": "integer"}]}`
+	descriptor := MethodDescriptor{}
+	err := json.Unmarshal([]byte(data), &descriptor)
+	if err != nil {
+		t.Fatalf("Failed to decode the descriptor: %v", err)
+	}
+
+	valid := [][]interface{}{
+		{"total"},
+		{"total", 1},
+		{"total", 1, 2, 3},
+	}
+	for _, args := range valid {
+		if err := descriptor.ValidateArgs(args); err != nil {
+			t.Errorf("Arguments %v: unexpected error %v", args, err)
+		}
+	}
+
+	invalid := map[string][]interface{}{
+		"takes at least 1 arguments, 0 given":        {},
+		"argument 1 (label): integer is not string":  {1, 2},
+		"argument 3 (values): -1 is less than 0":     {"total", 1, -1},
+		"argument 2 (values): string is not integer": {"total", "1"},
+	}
+	for expected, args := range invalid {
+		err := descriptor.ValidateArgs(args)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Arguments %v: got error %v, expected %q", args, err, expected)
+		}
+	}
+
+	descriptor.Variadic = false
+	err = descriptor.ValidateArgs([]interface{}{"total", 1, 2})
+	if err == nil || !strings.Contains(err.Error(), "takes 2 arguments, 3 given") {
+		t.Errorf("Extra argument: got error %v", err)
+	}
+}
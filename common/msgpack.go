@@ -0,0 +1,344 @@
+package common
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+/* MessagePack codec. It supports nil, bool, the integer and float types, string, []byte, slices
+   and maps. Structs, maps with non string keys and the types implementing json.Marshaler or
+   encoding.TextMarshaler are encoded as encoding/json encodes them. Integers are decoded as int64
+   (uint64 if they don't fit), byte slices are kept as []byte */
+type MsgpackCodec struct{}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (MsgpackCodec) Name() string        { return "msgpack" }
+func (MsgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (MsgpackCodec) Encode(values []interface{}) ([]byte, error) {
+	buffer := make([]byte, 0, 64)
+	return msgpackEncode(buffer, reflect.ValueOf(values))
+}
+
+func (MsgpackCodec) Decode(data []byte) ([]interface{}, error) {
+	if len(data) == 0 {
+		return make([]interface{}, 0), nil
+	}
+	value, rest, err := msgpackDecode(data)
+	if err != nil {
+		return nil, fmt.Errorf("Msgpack decode failed: %v", err)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("Msgpack decode failed: %d trailing bytes", len(rest))
+	}
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Msgpack decode failed: payload is not an array")
+	}
+	return values, nil
+}
+
+// Internal: append the msgpack encoding of a value
+func msgpackEncode(buffer []byte, value reflect.Value) ([]byte, error) {
+	if !value.IsValid() {
+		return append(buffer, 0xc0), nil
+	}
+	if value.Kind() != reflect.Interface && !(value.Kind() == reflect.Ptr && value.IsNil()) &&
+		(value.Type().Implements(jsonMarshalerType) || value.Type().Implements(textMarshalerType)) {
+		return msgpackJson(buffer, value)
+	}
+
+	switch value.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if value.IsNil() {
+			return append(buffer, 0xc0), nil
+		}
+		return msgpackEncode(buffer, value.Elem())
+	case reflect.Bool:
+		if value.Bool() {
+			return append(buffer, 0xc3), nil
+		}
+		return append(buffer, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		integer := value.Int()
+		if integer >= 0 {
+			return msgpackUint(buffer, uint64(integer)), nil
+		}
+		if integer >= -32 {
+			return append(buffer, byte(integer)), nil
+		}
+		buffer = append(buffer, 0xd3)
+		return msgpackAppend(buffer, 8, uint64(integer)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return msgpackUint(buffer, value.Uint()), nil
+	case reflect.Float32:
+		buffer = append(buffer, 0xca)
+		return msgpackAppend(buffer, 4, uint64(math.Float32bits(float32(value.Float())))), nil
+	case reflect.Float64:
+		buffer = append(buffer, 0xcb)
+		return msgpackAppend(buffer, 8, math.Float64bits(value.Float())), nil
+	case reflect.String:
+		str := value.String()
+		buffer = msgpackHeader(buffer, len(str), 0xa0, 31, 0xd9)
+		return append(buffer, str...), nil
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8 {
+			data := value.Bytes()
+			buffer = msgpackHeader(buffer, len(data), 0, -1, 0xc4)
+			return append(buffer, data...), nil
+		}
+		buffer = msgpackHeader(buffer, value.Len(), 0x90, 15, 0xdc)
+		var err error
+		for i := 0; i < value.Len(); i++ {
+			buffer, err = msgpackEncode(buffer, value.Index(i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buffer, nil
+	case reflect.Struct:
+		return msgpackJson(buffer, value)
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return msgpackJson(buffer, value)
+		}
+		keys := value.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		buffer = msgpackHeader(buffer, len(keys), 0x80, 15, 0xde)
+		var err error
+		for _, key := range keys {
+			buffer, err = msgpackEncode(buffer, key)
+			if err != nil {
+				return nil, err
+			}
+			buffer, err = msgpackEncode(buffer, value.MapIndex(key))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buffer, nil
+	}
+	return nil, fmt.Errorf("Msgpack encode failed: unsupported type %s", value.Type())
+}
+
+// Internal: append a value as encoding/json encodes it (the exported fields of a struct named by their
+// json tags), the json is decoded to the generic values that are appended
+func msgpackJson(buffer []byte, value reflect.Value) ([]byte, error) {
+	data, err := json.Marshal(value.Interface())
+	if err != nil {
+		return nil, fmt.Errorf("Msgpack encode failed: %v", err)
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&generic)
+	if err != nil {
+		return nil, fmt.Errorf("Msgpack encode failed: %v", err)
+	}
+	return msgpackEncode(buffer, reflect.ValueOf(jsonNumbers(generic)))
+}
+
+// Internal: append a positive integer in the smallest format
+func msgpackUint(buffer []byte, integer uint64) []byte {
+	switch {
+	case integer < 128:
+		return append(buffer, byte(integer))
+	case integer <= math.MaxUint8:
+		return append(buffer, 0xcc, byte(integer))
+	case integer <= math.MaxUint16:
+		return msgpackAppend(append(buffer, 0xcd), 2, uint64(integer))
+	case integer <= math.MaxUint32:
+		return msgpackAppend(append(buffer, 0xce), 4, uint64(integer))
+	}
+	return msgpackAppend(append(buffer, 0xcf), 8, integer)
+}
+
+// Internal: append a length header, fix format if the length fits in fixMax, else the 8/16/32 bit format
+// (the formats of a family are consecutive, str8 is followed by str16 and str32)
+func msgpackHeader(buffer []byte, length int, fix byte, fixMax int, format byte) []byte {
+	if length <= fixMax {
+		return append(buffer, fix|byte(length))
+	}
+	// array and map have no 8 bit format
+	if format == 0xdc || format == 0xde {
+		if length <= math.MaxUint16 {
+			return msgpackAppend(append(buffer, format), 2, uint64(length))
+		}
+		return msgpackAppend(append(buffer, format+1), 4, uint64(length))
+	}
+	switch {
+	case length <= math.MaxUint8:
+		return append(buffer, format, byte(length))
+	case length <= math.MaxUint16:
+		return msgpackAppend(append(buffer, format+1), 2, uint64(length))
+	}
+	return msgpackAppend(append(buffer, format+2), 4, uint64(length))
+}
+
+// Internal: decode a value, it returns the remaining data
+func msgpackDecode(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+	code := data[0]
+	data = data[1:]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), data, nil
+	case code >= 0xe0:
+		return int64(int8(code)), data, nil
+	case code&0xe0 == 0xa0:
+		return msgpackString(data, int(code&0x1f))
+	case code&0xf0 == 0x90:
+		return msgpackArray(data, int(code&0x0f))
+	case code&0xf0 == 0x80:
+		return msgpackMap(data, int(code&0x0f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, data, nil
+	case 0xc2:
+		return false, data, nil
+	case 0xc3:
+		return true, data, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		size := 1 << (code - 0xcc)
+		integer, rest, err := msgpackInt(data, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		if integer > math.MaxInt64 {
+			return integer, rest, nil
+		}
+		return int64(integer), rest, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		integer, rest, err := msgpackInt(data, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		// sign extend
+		shift := uint(64 - 8*size)
+		return int64(integer<<shift) >> shift, rest, nil
+	case 0xca:
+		bits, rest, err := msgpackInt(data, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		return float64(math.Float32frombits(uint32(bits))), rest, nil
+	case 0xcb:
+		bits, rest, err := msgpackInt(data, 8)
+		if err != nil {
+			return nil, nil, err
+		}
+		return math.Float64frombits(bits), rest, nil
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		base := byte(0xd9)
+		if code <= 0xc6 {
+			base = 0xc4
+		}
+		length, rest, err := msgpackInt(data, 1<<(code-base))
+		if err != nil {
+			return nil, nil, err
+		}
+		if base == 0xd9 {
+			return msgpackString(rest, int(length))
+		}
+		if uint64(len(rest)) < length {
+			return nil, nil, fmt.Errorf("unexpected end of data")
+		}
+		return append([]byte{}, rest[:length]...), rest[length:], nil
+	case 0xdc, 0xdd:
+		length, rest, err := msgpackInt(data, 2<<(code-0xdc))
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackArray(rest, int(length))
+	case 0xde, 0xdf:
+		length, rest, err := msgpackInt(data, 2<<(code-0xde))
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackMap(rest, int(length))
+	}
+	return nil, nil, fmt.Errorf("unsupported format 0x%x", code)
+}
+
+// Internal: append a big endian integer of size bytes
+func msgpackAppend(buffer []byte, size int, integer uint64) []byte {
+	for shift := 8 * (size - 1); shift >= 0; shift -= 8 {
+		buffer = append(buffer, byte(integer>>uint(shift)))
+	}
+	return buffer
+}
+
+// Internal: read a big endian integer of size bytes
+func msgpackInt(data []byte, size int) (uint64, []byte, error) {
+	if len(data) < size {
+		return 0, nil, fmt.Errorf("unexpected end of data")
+	}
+	var integer uint64
+	for _, b := range data[:size] {
+		integer = integer<<8 | uint64(b)
+	}
+	return integer, data[size:], nil
+}
+
+func msgpackString(data []byte, length int) (interface{}, []byte, error) {
+	if len(data) < length {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+	return string(data[:length]), data[length:], nil
+}
+
+func msgpackArray(data []byte, length int) (interface{}, []byte, error) {
+	// each element takes at least a byte
+	if len(data) < length {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+	values := make([]interface{}, length)
+	var err error
+	for i := range values {
+		values[i], data, err = msgpackDecode(data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return values, data, nil
+}
+
+func msgpackMap(data []byte, length int) (interface{}, []byte, error) {
+	if len(data) < 2*length {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+	values := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		var key, value interface{}
+		var err error
+		key, data, err = msgpackDecode(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyStr, ok := key.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported map key %v", key)
+		}
+		value, data, err = msgpackDecode(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[keyStr] = value
+	}
+	return values, data, nil
+}
@@ -22,12 +22,44 @@ type PluginConf struct {
 	Name      string `json:"name"`
 	Version   string `json:"Version"`
 	LazyLoad  bool   `json:"LazyLoad"`
+	// The resource limits requested by the plugin
+	Limits *ResourceLimits `json:"limits,omitempty"`
+	// The launch configuration (environment, arguments, working dir)
+	Launch *LaunchConf `json:"launch,omitempty"`
+	// The instance pool configuration
+	Pool *PoolConf `json:"pool,omitempty"`
+	// Start the plugin process on the first call and stop it when idle
+	OnDemand bool `json:"ondemand,omitempty"`
+	// The idle time (in seconds) after which an on-demand plugin is stopped
+	IdleTimeout int `json:"idletimeout,omitempty"`
+	// The plugin ids (namespace _ name _ version) that are loaded before this plugin
+	Depends []string `json:"depends,omitempty"`
+	// The transport the plugin is served on, a unix socket if not set
+	Transport *TransportConf `json:"transport,omitempty"`
 }
 
+// The environment variable that holds the runtime conf file of a plugin instance
+const RuntimeConfEnv = "GOPLUG_RUNTIME_CONF"
+
+// The environment variable that holds the secret of a plugin instance (removed by the plugin on init)
+const AuthSecretEnv = "GOPLUG_AUTH_SECRET"
+
 // Struct to define the runtime configuration of the plugin
 type RuntimeConf struct {
 	Url  string `json:"url"`
 	Sock string `json:"sockpath"`
+	// The id of the plugin instance given by the registry
+	InstanceId string `json:"instanceid"`
+	// The socket to call the host functions on
+	HostSock string `json:"hostsock,omitempty"`
+	// The socket the file descriptors are passed on
+	FdSock string `json:"fdsock,omitempty"`
+	// The uid of the host, the only peer allowed to connect to the plugin
+	HostUid int `json:"hostuid"`
+	// The network the plugin is served on, Sock is the listen address for TransportTcp
+	Network string `json:"network,omitempty"`
+	// The TLS files of a tcp plugin
+	Tls *TlsConf `json:"tls,omitempty"`
 }
 
 // Create json for i/p and o/p data of method execution
@@ -0,0 +1,96 @@
+package pluginconn
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// The request header that carries the secret of the plugin instance
+const AuthHeader = "X-Goplug-Auth"
+
+// The error returned when the peer credentials are not available on the platform
+var PeerCredUnsupported = errors.New("Peer credentials are not supported")
+
+/* Check a secret sent by a peer in constant time */
+func ValidSecret(secret string, sent string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(sent)) == 1
+}
+
+/* Wrap a handler to reject the requests that don't carry the secret. No check is done if
+   the secret is empty */
+func AuthHandler(handler http.Handler, secret string) http.Handler {
+	if secret == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !ValidSecret(secret, req.Header.Get(AuthHeader)) {
+			http.Error(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
+
+/* Listen on a unix socket only the owner could connect to (0600). The socket should be created
+   in a private directory so that it is not reachable before its mode is set */
+func ListenPrivate(sockFile string) (net.Listener, error) {
+	os.Remove(sockFile)
+	listener, err := net.Listen("unix", sockFile)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(sockFile, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Failed to set the socket mode: %v", err)
+	}
+	return listener, nil
+}
+
+/* Wrap a unix listener to reject the peers whose uid is not allowed (SO_PEERCRED). No check is
+   done if no uid is given or the platform doesn't support the peer credentials */
+func PeerListener(listener net.Listener, uids ...int) net.Listener {
+	if len(uids) == 0 {
+		return listener
+	}
+	return &peerListener{Listener: listener, uids: uids}
+}
+
+// A listener that checks the peer uid of the accepted connections
+type peerListener struct {
+	net.Listener
+	uids []int
+}
+
+func (listener *peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, credErr := PeerUid(conn)
+		if credErr == PeerCredUnsupported || listener.allowed(uid) {
+			return conn, nil
+		}
+		if credErr != nil {
+			fmt.Printf("[ERROR] Rejected connection, peer credentials not available: %v\n", credErr)
+		} else {
+			fmt.Printf("[ERROR] Rejected connection from uid %d\n", uid)
+		}
+		conn.Close()
+	}
+}
+
+// Internal: check if a peer uid is allowed
+func (listener *peerListener) allowed(uid int) bool {
+	for _, allowed := range listener.uids {
+		if allowed == uid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+//go:build unix
+// +build unix
+
+package pluginconn
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The maximum size of the id sent with the file descriptors
+const maxFdIdSize = 256
+
+/* The connection the file descriptors are passed on (SCM_RIGHTS over a unix seqpacket
+   socket). Each message carries an id and the file descriptors referenced by it */
+type FdConn struct {
+	conn *net.UnixConn
+	// Guard the writes, a message must not interleave with another
+	access sync.Mutex
+}
+
+/* Connect to the fd socket of a plugin. The secret is sent as the first message (if not empty) */
+func DialFdConn(sockFile string, secret string) (*FdConn, error) {
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: sockFile, Net: "unixpacket"})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect fd socket %s: %v", sockFile, err)
+	}
+	if secret != "" {
+		_, err = conn.Write([]byte(secret))
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed to authenticate on fd socket %s: %v", sockFile, err)
+		}
+	}
+	return &FdConn{conn: conn}, nil
+}
+
+/* Listen for the fd connections on a socket only the owner could connect to (0600) */
+func ListenFdConn(sockFile string) (*net.UnixListener, error) {
+	os.Remove(sockFile)
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: sockFile, Net: "unixpacket"})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on fd socket %s: %v", sockFile, err)
+	}
+	err = os.Chmod(sockFile, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Failed to set the fd socket mode: %v", err)
+	}
+	return listener, nil
+}
+
+/* Accept a fd connection */
+func AcceptFdConn(listener *net.UnixListener) (*FdConn, error) {
+	conn, err := listener.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+	return &FdConn{conn: conn}, nil
+}
+
+/* Check the secret sent as the first message of an accepted connection */
+func (fdConn *FdConn) Authenticate(secret string, timeout time.Duration) error {
+	if secret == "" {
+		return nil
+	}
+	fdConn.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer fdConn.conn.SetReadDeadline(time.Time{})
+
+	buffer := make([]byte, maxFdIdSize)
+	n, err := fdConn.conn.Read(buffer)
+	if err != nil {
+		return fmt.Errorf("Failed to read the fd socket secret: %v", err)
+	}
+	if !ValidSecret(secret, string(buffer[:n])) {
+		return fmt.Errorf("Invalid fd socket secret")
+	}
+	return nil
+}
+
+/* Send file descriptors with an id. The sender keeps the ownership of its descriptors,
+   the receiver gets duplicates */
+func (fdConn *FdConn) SendFds(id string, fds ...int) error {
+	if len(id) > maxFdIdSize {
+		return fmt.Errorf("Fd id is too long: %d", len(id))
+	}
+	fdConn.access.Lock()
+	defer fdConn.access.Unlock()
+
+	_, _, err := fdConn.conn.WriteMsgUnix([]byte(id), syscall.UnixRights(fds...), nil)
+	if err != nil {
+		return fmt.Errorf("Failed to send fds: %v", err)
+	}
+	return nil
+}
+
+/* Receive the next file descriptors with their id. The receiver owns the returned files */
+func (fdConn *FdConn) RecvFds() (string, []*os.File, error) {
+	buffer := make([]byte, maxFdIdSize)
+	oob := make([]byte, syscall.CmsgSpace(4*16))
+	n, oobn, _, _, err := fdConn.conn.ReadMsgUnix(buffer, oob)
+	if err != nil {
+		return "", nil, err
+	}
+	if n == 0 && oobn == 0 {
+		return "", nil, fmt.Errorf("Fd connection closed")
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to parse fd message: %v", err)
+	}
+	id := string(buffer[:n])
+	files := make([]*os.File, 0)
+	for _, message := range messages {
+		fds, err := syscall.ParseUnixRights(&message)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), id))
+		}
+	}
+	return id, files, nil
+}
+
+/* Close the fd connection */
+func (fdConn *FdConn) Close() error {
+	return fdConn.conn.Close()
+}
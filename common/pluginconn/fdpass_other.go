@@ -0,0 +1,54 @@
+//go:build !unix
+// +build !unix
+
+package pluginconn
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"time"
+)
+
+// The error returned where the file descriptors could not be passed
+var errFdPassUnsupported = fmt.Errorf("File descriptor passing is not supported on %s", runtime.GOOS)
+
+/* The connection the file descriptors are passed on. It is not supported on this platform */
+type FdConn struct {
+}
+
+/* Connect to the fd socket of a plugin. It is not supported on this platform */
+func DialFdConn(sockFile string, secret string) (*FdConn, error) {
+	return nil, errFdPassUnsupported
+}
+
+/* Listen for the fd connections. It is not supported on this platform */
+func ListenFdConn(sockFile string) (*net.UnixListener, error) {
+	return nil, errFdPassUnsupported
+}
+
+/* Accept a fd connection. It is not supported on this platform */
+func AcceptFdConn(listener *net.UnixListener) (*FdConn, error) {
+	return nil, errFdPassUnsupported
+}
+
+/* Check the secret sent as the first message of an accepted connection */
+func (fdConn *FdConn) Authenticate(secret string, timeout time.Duration) error {
+	return errFdPassUnsupported
+}
+
+/* Send file descriptors with an id */
+func (fdConn *FdConn) SendFds(id string, fds ...int) error {
+	return errFdPassUnsupported
+}
+
+/* Receive the next file descriptors with their id */
+func (fdConn *FdConn) RecvFds() (string, []*os.File, error) {
+	return "", nil, errFdPassUnsupported
+}
+
+/* Close the fd connection */
+func (fdConn *FdConn) Close() error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package pluginconn
+
+import (
+	"net"
+)
+
+/* Get the uid of the process on the other end of a unix socket connection */
+func PeerUid(conn net.Conn) (int, error) {
+	return -1, PeerCredUnsupported
+}
@@ -2,92 +2,218 @@ package pluginconn
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	httputil "net/http/httputil"
+	"net/url"
+	"time"
 )
 
+var (
+	// The maximum idle connections kept open to a plugin for the method calls
+	MaxIdleConns = 16
+	// The time an idle connection is kept open
+	IdleConnTimeout = 90 * time.Second
+)
+
+// The request header that carries the caller deadline to the plugin (RFC3339 with nano seconds)
+const DeadlineHeader = "X-Goplug-Deadline"
+
+/* The client connection to a plugin. Method calls are sent concurrently over a pool of
+   connections to the plugin socket, the callback long polls use their own connections
+   so that they never block the method calls. A tcp plugin is reached over mutual TLS */
 type PluginClient struct {
-	Conn *httputil.ClientConn
+	// The client for the method calls
+	Conn *http.Client
+	// The client for the callback long polls
+	PollConn *http.Client
+	sockFile string
+	// The network of the plugin (unix or tcp), sockFile is the address for tcp
+	network string
+	// The TLS config of a tcp connection
+	tlsConfig *tls.Config
+	// The secret sent with each request
+	secret string
+	// Cancelled on close to abort the in-flight requests
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type PluginRequest struct {
 	Url  string
 	Body []byte
+	// Additional request headers (the body is sent as json if no Content-Type is set)
+	Header http.Header
 }
 
 type PluginResponse struct {
 	Status string
 	Body   []byte
+	Header http.Header
 }
 
 func NewPluginClient(sockFile string) (*PluginClient, error) {
+	return NewAuthPluginClient(sockFile, "")
+}
+
+/* Create a client that sends the secret of the plugin instance with each request */
+func NewAuthPluginClient(sockFile string, secret string) (*PluginClient, error) {
+	return newPluginClient(&PluginClient{sockFile: sockFile, network: "unix", secret: secret})
+}
+
+/* Create a client to a plugin served on tcp. The connections use mutual TLS with the config */
+func NewTcpPluginClient(addr string, tlsConfig *tls.Config, secret string) (*PluginClient, error) {
+	if tlsConfig == nil {
+		return nil, fmt.Errorf("A TLS config is required for a tcp plugin")
+	}
+	return newPluginClient(&PluginClient{sockFile: addr, network: "tcp", tlsConfig: tlsConfig, secret: secret})
+}
 
-	conn, connErr := net.Dial("unix", sockFile)
+// Internal: check the plugin is reachable and create the http clients
+func newPluginClient(pluginConn *PluginClient) (*PluginClient, error) {
+
+	// Check the plugin is accepting connection
+	conn, connErr := pluginConn.dial(context.Background())
 	if connErr != nil {
 		fmt.Printf("Connection could not be initiated")
 		return nil, connErr
 	}
+	conn.Close()
 
-	/* Use default buffer */
-	clientConn := httputil.NewClientConn(conn, nil)
-	if clientConn == nil {
-		fmt.Printf("Connection Could not be Configured")
-		return nil, connErr
-	}
-	pluginConn := &PluginClient{clientConn}
+	pluginConn.ctx, pluginConn.cancel = context.WithCancel(context.Background())
+	pluginConn.Conn = &http.Client{Transport: pluginConn.transport(MaxIdleConns)}
+	pluginConn.PollConn = &http.Client{Transport: pluginConn.transport(0)}
 
 	return pluginConn, nil
 }
 
+// Internal: connect to the plugin, the TLS handshake is done for a tcp plugin
+func (pluginConn *PluginClient) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, pluginConn.network, pluginConn.sockFile)
+	if err != nil || pluginConn.tlsConfig == nil {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, pluginConn.tlsConfig)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	return tlsConn, nil
+}
+
+// Internal: create a transport that dials the plugin socket
+func (pluginConn *PluginClient) transport(maxIdle int) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return pluginConn.dial(ctx)
+		},
+		MaxIdleConns:        maxIdle,
+		MaxIdleConnsPerHost: maxIdle,
+		IdleConnTimeout:     IdleConnTimeout,
+		DisableCompression:  true,
+	}
+}
+
+/* Send a method call request to the plugin. It is safe to call concurrently */
 func (pluginConn *PluginClient) Request(request *PluginRequest) (*PluginResponse, error) {
+	return pluginConn.do(context.Background(), pluginConn.Conn, request)
+}
 
-	var url = request.Url
-	var req *http.Request
-	var newReqErr error
+/* Send a method call request to the plugin with a context. The context deadline is sent to the
+   plugin and the request is aborted when the context is done */
+func (pluginConn *PluginClient) RequestContext(ctx context.Context, request *PluginRequest) (*PluginResponse, error) {
+	return pluginConn.do(ctx, pluginConn.Conn, request)
+}
 
-	if request.Body != nil {
-		var jsonStr = request.Body
-		req, newReqErr = http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
-		if newReqErr != nil {
-			fmt.Printf("Request Could not be prepared")
-			return nil, newReqErr
-		}
-		req.Header.Set("Content-Type", "application/json")
-	} else {
-		req, newReqErr = http.NewRequest("POST", url, nil)
-		if newReqErr != nil {
-			fmt.Printf("Request Could not be prepared")
-			return nil, newReqErr
-		}
+/* Send a long poll request (callback) to the plugin. It doesn't block the method calls */
+func (pluginConn *PluginClient) LongPoll(request *PluginRequest) (*PluginResponse, error) {
+	return pluginConn.do(context.Background(), pluginConn.PollConn, request)
+}
+
+// Internal: send a request with a client and read the complete response
+func (pluginConn *PluginClient) do(ctx context.Context, client *http.Client, request *PluginRequest) (*PluginResponse, error) {
+
+	req, newReqErr := pluginConn.newRequest(request)
+	if newReqErr != nil {
+		fmt.Printf("Request Could not be prepared")
+		return nil, newReqErr
 	}
-	conn := pluginConn.Conn
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(DeadlineHeader, deadline.Format(time.RFC3339Nano))
+	}
+
+	// The request is aborted if either the caller gives up or the client is closed
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-pluginConn.ctx.Done():
+			cancel()
+		case <-reqCtx.Done():
+		}
+	}()
 
-	resp, reqErr := conn.Do(req)
+	resp, reqErr := client.Do(req.WithContext(reqCtx))
 	if reqErr != nil {
 		fmt.Printf("Request Could not be send")
 		return nil, reqErr
 	}
 	defer resp.Body.Close()
 
-	fmt.Println("response Status:", resp.Status)
-	fmt.Println("response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	if body != nil {
-		fmt.Println("response Body:", string(body))
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, readErr
 	}
 
 	response := &PluginResponse{}
 	response.Status = resp.Status
 	response.Body = body
+	response.Header = resp.Header
 
 	return response, nil
 }
 
+// Internal: prepare the http request, the plugin url (unix://plugin) is sent as http over the socket
+func (pluginConn *PluginClient) newRequest(request *PluginRequest) (*http.Request, error) {
+	requestUrl, parseErr := url.Parse(request.Url)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	requestUrl.Scheme = "http"
+
+	var req *http.Request
+	var newReqErr error
+	if request.Body != nil {
+		req, newReqErr = http.NewRequest("POST", requestUrl.String(), bytes.NewBuffer(request.Body))
+		if newReqErr != nil {
+			return nil, newReqErr
+		}
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req, newReqErr = http.NewRequest("POST", requestUrl.String(), nil)
+		if newReqErr != nil {
+			return nil, newReqErr
+		}
+	}
+	for name, values := range request.Header {
+		req.Header[name] = values
+	}
+	if pluginConn.secret != "" {
+		req.Header.Set(AuthHeader, pluginConn.secret)
+	}
+	return req, nil
+}
+
+/* Close the connections to the plugin. The in-flight requests are aborted */
 func (pluginConn *PluginClient) Close() error {
 
-	pluginConn.Conn.Close()
+	pluginConn.cancel()
+	pluginConn.Conn.CloseIdleConnections()
+	pluginConn.PollConn.CloseIdleConnections()
 	return nil
 }
@@ -1,8 +1,10 @@
 package pluginconn
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	common "github.com/swarvanusg/GoPlug/common"
 	"net"
 	"net/http"
 )
@@ -18,23 +20,45 @@ type PluginServer struct {
 	Mux      *http.ServeMux
 	Listener net.Listener
 	Addr     string
+	// The handler the requests are served with
+	handler http.Handler
+	// The secret the requests must carry
+	secret string
 }
 
 // configuration for the http server
 type ServerConfiguration struct {
 	Registrar HttpHandlerRegistrar
-	SockFile  string
-	Addr      string
+	// The handler of the server (optional). If nil the handlers the Registrar registers on
+	// http.DefaultServeMux are served, so a process runs a single such server
+	Handler  http.Handler
+	SockFile string
+	Addr     string
+	// The secret the requests must carry (not checked if empty)
+	Secret string
+	// The uids of the peers allowed to connect (not checked if empty)
+	PeerUids []int
+	// The network to serve on, "unix" (default) or "tcp". SockFile is the listen address for tcp
+	Network string
+	// The TLS config of a tcp server, required for tcp
+	Tls *tls.Config
 }
 
 // Create a new HTTP Server
 func NewPluginServer(config *ServerConfiguration) (*PluginServer, error) {
 
-	// Get listener for the Http server
-	listener, err := net.Listen("unix", config.SockFile)
+	// Get listener for the Http server, only the owner could connect to the socket
+	var listener net.Listener
+	var err error
+	if config.Network == "tcp" {
+		listener, err = listenTls(config.SockFile, config.Tls)
+	} else {
+		listener, err = ListenPrivate(config.SockFile)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Failed to set Listner: %s", err)
 	}
+	listener = PeerListener(listener, config.PeerUids...)
 
 	// Create the mux
 	//mux := http.NewServeMux()
@@ -44,19 +68,36 @@ func NewPluginServer(config *ServerConfiguration) (*PluginServer, error) {
 		Mux:      nil,
 		Listener: listener,
 		Addr:     config.Addr,
+		handler:  config.Handler,
+		secret:   config.Secret,
 	}
 
 	// register the http handlers
-	config.Registrar.Register()
+	if server.handler == nil {
+		server.handler = http.DefaultServeMux
+		config.Registrar.Register()
+	}
 
 	return server, nil
 }
 
+// Internal: listen on tcp, the clients must present a certificate trusted by the TLS config
+func listenTls(addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	if tlsConfig == nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("A TLS config requiring client certificates is needed for tcp")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
 // Start the http Server
 func (s *PluginServer) Start() {
 
-	/* Each request is served in a separate thread */
-	go http.Serve(s.Listener, nil)
+	/* Each request is served in a separate thread, the requests without the secret are rejected */
+	go http.Serve(s.Listener, AuthHandler(s.handler, s.secret))
 
 }
 
@@ -85,3 +126,10 @@ func WriteJsonResponse(v interface{}, code int, w http.ResponseWriter) error {
 	w.Write(js)
 	return nil
 }
+
+/* Write an error envelope response, the status is derived from the error code */
+func WriteErrorResponse(envelope *common.ErrorEnvelope, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", common.ErrorContentType)
+	w.WriteHeader(envelope.Status())
+	w.Write(envelope.Encode())
+}
@@ -0,0 +1,86 @@
+package pluginconn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	common "github.com/swarvanusg/GoPlug/common"
+	"io"
+	"net/http"
+	"time"
+)
+
+// The content type of a streamed method response (a json frame per line)
+const StreamContentType = "application/x-ndjson"
+
+/* A frame of a streamed method response. The plugin sends an item per frame, the last frame
+   is either an error or the end of the stream. An error frame has the message in Error and
+   the envelope in Fault */
+type StreamFrame struct {
+	Item  json.RawMessage       `json:"item,omitempty"`
+	Error string                `json:"error,omitempty"`
+	Fault *common.ErrorEnvelope `json:"fault,omitempty"`
+	End   bool                  `json:"end,omitempty"`
+}
+
+/* The streamed response of a method call, the frames are read from the body as they arrive */
+type PluginStream struct {
+	Status  string
+	Header  http.Header
+	Body    io.ReadCloser
+	decoder *json.Decoder
+	cancel  context.CancelFunc
+}
+
+/* Send a method call request and return the response as a stream. The request is aborted when
+   the context is done or the stream is closed */
+func (pluginConn *PluginClient) Stream(ctx context.Context, request *PluginRequest) (*PluginStream, error) {
+
+	req, newReqErr := pluginConn.newRequest(request)
+	if newReqErr != nil {
+		return nil, newReqErr
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(DeadlineHeader, deadline.Format(time.RFC3339Nano))
+	}
+	req.Header.Set("Accept", StreamContentType)
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-pluginConn.ctx.Done():
+			cancel()
+		case <-reqCtx.Done():
+		}
+	}()
+
+	// A stream holds its connection till it ends so it doesn't use the method call pool
+	resp, reqErr := pluginConn.PollConn.Do(req.WithContext(reqCtx))
+	if reqErr != nil {
+		cancel()
+		return nil, reqErr
+	}
+
+	stream := &PluginStream{Status: resp.Status, Header: resp.Header, Body: resp.Body, cancel: cancel}
+	stream.decoder = json.NewDecoder(resp.Body)
+	return stream, nil
+}
+
+/* Read the next frame of the stream. It blocks till the plugin sends a frame */
+func (stream *PluginStream) Next() (*StreamFrame, error) {
+	frame := &StreamFrame{}
+	err := stream.decoder.Decode(frame)
+	if err == io.EOF {
+		return nil, fmt.Errorf("Stream ended without end frame")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+/* Close the stream, the plugin gets the method context cancelled if it is still streaming */
+func (stream *PluginStream) Close() error {
+	stream.cancel()
+	return stream.Body.Close()
+}
@@ -0,0 +1,179 @@
+package pluginconn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// The name the generated plugin certificates are issued for
+	DefaultServerName = "goplug-plugin"
+	// The validity of the generated certificates
+	CertValidity = 365 * 24 * time.Hour
+	// The files the generated certificates are written to
+	CACertFile     = "ca.pem"
+	PluginCertFile = "plugin.pem"
+	PluginKeyFile  = "plugin-key.pem"
+	HostCertFile   = "host.pem"
+	HostKeyFile    = "host-key.pem"
+)
+
+/* Get the TLS config of a plugin server. Only the clients with a certificate signed by the CA
+   are accepted */
+func ServerTlsConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	cert, pool, err := loadTls(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+/* Get the TLS config of a client. The server certificate must be signed by the CA and issued
+   for the server name (DefaultServerName if empty) */
+func ClientTlsConfig(caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+	cert, pool, err := loadTls(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if serverName == "" {
+		serverName = DefaultServerName
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Internal: load a key pair and a CA
+func loadTls(caFile string, certFile string, keyFile string) (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, nil, fmt.Errorf("Failed to load the certificate %s: %v", certFile, err)
+	}
+	caData, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return cert, nil, fmt.Errorf("Failed to read the CA %s: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return cert, nil, fmt.Errorf("No certificate found in the CA %s", caFile)
+	}
+	return cert, pool, nil
+}
+
+/* Check if the certificates generated in a directory are usable for at least the given time */
+func CertsValid(dir string, remaining time.Duration) bool {
+	for _, pair := range [][2]string{{PluginCertFile, PluginKeyFile}, {HostCertFile, HostKeyFile}} {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, pair[0]), filepath.Join(dir, pair[1]))
+		if err != nil {
+			return false
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil || time.Now().Add(remaining).After(leaf.NotAfter) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Generate a CA and the certificates of a plugin (server) and its host (client) in a directory.
+   The plugin certificate is issued for DefaultServerName and the given hosts (names or IPs) */
+func GenerateCerts(dir string, hosts ...string) error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate := certTemplate("goplug-ca")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("Failed to create the CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDer)
+	err = writePem(filepath.Join(dir, CACertFile), "CERTIFICATE", caDer)
+	if err != nil {
+		return err
+	}
+
+	pluginTemplate := certTemplate(DefaultServerName)
+	pluginTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	pluginTemplate.DNSNames = []string{DefaultServerName}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			pluginTemplate.IPAddresses = append(pluginTemplate.IPAddresses, ip)
+		} else if host != "" {
+			pluginTemplate.DNSNames = append(pluginTemplate.DNSNames, host)
+		}
+	}
+	err = generateCert(dir, PluginCertFile, PluginKeyFile, pluginTemplate, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	hostTemplate := certTemplate("goplug-host")
+	hostTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return generateCert(dir, HostCertFile, HostKeyFile, hostTemplate, caCert, caKey)
+}
+
+// Internal: get a certificate template valid from now for CertValidity
+func certTemplate(name string) *x509.Certificate {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(CertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+// Internal: generate a key and a certificate signed by the CA
+func generateCert(dir string, certFile string, keyFile string, template *x509.Certificate, ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("Failed to create the certificate %s: %v", certFile, err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = writePem(filepath.Join(dir, keyFile), "EC PRIVATE KEY", keyDer)
+	if err != nil {
+		return err
+	}
+	return writePem(filepath.Join(dir, certFile), "CERTIFICATE", der)
+}
+
+// Internal: write a pem file readable by the owner only
+func writePem(fileName string, blockType string, der []byte) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	err := ioutil.WriteFile(fileName, data, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %v", fileName, err)
+	}
+	return nil
+}
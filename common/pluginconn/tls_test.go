@@ -0,0 +1,137 @@
+package pluginconn
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Internal: generate the certificates of a CA in a temporary directory
+func testCerts(t *testing.T) string {
+	dir := t.TempDir()
+	err := GenerateCerts(dir, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Failed to generate the certificates: %v", err)
+	}
+	return dir
+}
+
+// Internal: serve an echo handler over mutual TLS on a loopback port, it returns the address
+func serveTls(t *testing.T, dir string, secret string) string {
+	tlsConfig, err := ServerTlsConfig(filepath.Join(dir, CACertFile), filepath.Join(dir, PluginCertFile), filepath.Join(dir, PluginKeyFile))
+	if err != nil {
+		t.Fatalf("Failed to load the server TLS config: %v", err)
+	}
+	listener, err := listenTls("127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	echo := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		res.Write(body)
+	})
+	go http.Serve(listener, AuthHandler(echo, secret))
+	return listener.Addr().String()
+}
+
+// Internal: get the host TLS config of a certificates directory
+func hostTls(t *testing.T, dir string, serverName string) *tls.Config {
+	tlsConfig, err := ClientTlsConfig(filepath.Join(dir, CACertFile), filepath.Join(dir, HostCertFile), filepath.Join(dir, HostKeyFile), serverName)
+	if err != nil {
+		t.Fatalf("Failed to load the client TLS config: %v", err)
+	}
+	return tlsConfig
+}
+
+// Internal: send a request, an error is returned if the client can't connect or the request fails
+func tlsRequest(addr string, tlsConfig *tls.Config, secret string) (*PluginResponse, error) {
+	client, err := NewTcpPluginClient(addr, tlsConfig, secret)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.Request(&PluginRequest{Url: "tcp://plugin/Echo", Body: []byte(`"ping"`)})
+}
+
+func TestTlsLoopback(t *testing.T) {
+	dir := testCerts(t)
+	addr := serveTls(t, dir, "secret")
+
+	resp, err := tlsRequest(addr, hostTls(t, dir, ""), "secret")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.Status != "200 OK" || string(resp.Body) != `"ping"` {
+		t.Errorf("Got %s %q", resp.Status, resp.Body)
+	}
+
+	// The certificate is issued for the given hosts as well
+	resp, err = tlsRequest(addr, hostTls(t, dir, "127.0.0.1"), "secret")
+	if err != nil || resp.Status != "200 OK" {
+		t.Errorf("Request to the IP host failed: %v", err)
+	}
+
+	resp, err = tlsRequest(addr, hostTls(t, dir, ""), "wrong")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.Status != "401 Unauthorized" {
+		t.Errorf("Request with a wrong secret got %s", resp.Status)
+	}
+}
+
+func TestTlsRejected(t *testing.T) {
+	dir := testCerts(t)
+	otherDir := testCerts(t)
+	addr := serveTls(t, dir, "")
+
+	// A host certificate of another CA is rejected by the plugin
+	otherHost := hostTls(t, otherDir, "")
+	otherHost.RootCAs = hostTls(t, dir, "").RootCAs
+	// A plugin certificate of another CA is rejected by the host
+	otherPlugin := hostTls(t, dir, "")
+	otherPlugin.RootCAs = hostTls(t, otherDir, "").RootCAs
+	// A host without a certificate
+	anonymous := hostTls(t, dir, "")
+	anonymous.Certificates = nil
+
+	cases := map[string]*tls.Config{
+		"host of another CA":   otherHost,
+		"plugin of another CA": otherPlugin,
+		"wrong server name":    hostTls(t, dir, "other-plugin"),
+		"no host certificate":  anonymous,
+	}
+	for name, tlsConfig := range cases {
+		resp, err := tlsRequest(addr, tlsConfig, "")
+		if err == nil {
+			t.Errorf("%s: request accepted with %s", name, resp.Status)
+		}
+	}
+
+	_, err := NewTcpPluginClient(addr, nil, "")
+	if err == nil {
+		t.Errorf("A client without TLS config is created")
+	}
+	_, err = listenTls("127.0.0.1:0", &tls.Config{})
+	if err == nil {
+		t.Errorf("A listener not requiring client certificates is created")
+	}
+}
+
+func TestCertsValid(t *testing.T) {
+	dir := testCerts(t)
+	if !CertsValid(dir, time.Hour) {
+		t.Errorf("Generated certificates are not valid")
+	}
+	if CertsValid(dir, CertValidity+time.Hour) {
+		t.Errorf("Certificates are valid past their expiry")
+	}
+	if CertsValid(t.TempDir(), time.Hour) {
+		t.Errorf("Missing certificates are valid")
+	}
+}
@@ -0,0 +1,51 @@
+package common
+
+const (
+	// Pick the instances in turn
+	BalanceRoundRobin = "round-robin"
+	// Pick the instance with the least in-flight requests
+	BalanceLeastOutstanding = "least-outstanding"
+)
+
+/* The instance pool configuration of a plugin. Each instance is a separate
+ * plugin process with its own socket */
+type PoolConf struct {
+	// The minimum number of instances (started on load)
+	Min int `json:"min"`
+	// The maximum number of instances the pool could scale up to
+	Max int `json:"max"`
+	// The load balancing of the calls (BalanceRoundRobin or BalanceLeastOutstanding)
+	Balance string `json:"balance,omitempty"`
+	// The in-flight requests per instance that triggers a scale up. Default is 4
+	ScaleUpQueue int `json:"scaleupqueue,omitempty"`
+	// The seconds a pool must be idle before an instance is stopped. Default is 30
+	ScaleDownIdle int `json:"scaledownidle,omitempty"`
+}
+
+// Get the pool conf with the host conf taking precedence over the plugin conf
+func MergePoolConf(plugin *PoolConf, host *PoolConf) *PoolConf {
+	pool := plugin
+	if host != nil {
+		pool = host
+	}
+	if pool == nil {
+		return nil
+	}
+	merged := *pool
+	if merged.Min < 1 {
+		merged.Min = 1
+	}
+	if merged.Max < merged.Min {
+		merged.Max = merged.Min
+	}
+	if merged.Balance == "" {
+		merged.Balance = BalanceRoundRobin
+	}
+	if merged.ScaleUpQueue <= 0 {
+		merged.ScaleUpQueue = 4
+	}
+	if merged.ScaleDownIdle <= 0 {
+		merged.ScaleDownIdle = 30
+	}
+	return &merged
+}
@@ -0,0 +1,63 @@
+package common
+
+/* The resource limits applied to a plugin process (rlimits and optional cgroup v2 constraints).
+ * Zero value of a field means no limit is applied for that resource */
+type ResourceLimits struct {
+	// Max size of the process virtual memory in bytes (RLIMIT_AS)
+	AddressSpace uint64 `json:"addressspace,omitempty"`
+	// Max number of open file descriptors (RLIMIT_NOFILE)
+	OpenFiles uint64 `json:"openfiles,omitempty"`
+	// Max CPU time in seconds (RLIMIT_CPU)
+	CpuSeconds uint64 `json:"cpuseconds,omitempty"`
+	// Max size of a core dump in bytes (RLIMIT_CORE), nil keeps the host value
+	CoreDump *uint64 `json:"coredump,omitempty"`
+	// The cgroup v2 constraints
+	Cgroup *CgroupLimits `json:"cgroup,omitempty"`
+}
+
+// Struct to define the cgroup v2 constraints, values are written as it is to the cgroup files
+type CgroupLimits struct {
+	MemoryMax string `json:"memory.max,omitempty"`
+	CpuMax    string `json:"cpu.max,omitempty"`
+	PidsMax   string `json:"pids.max,omitempty"`
+}
+
+// Merge the plugin declared limits with the host limits, host limits takes precedence when set
+func MergeResourceLimits(plugin *ResourceLimits, host *ResourceLimits) *ResourceLimits {
+	if plugin == nil && host == nil {
+		return nil
+	}
+	limits := &ResourceLimits{}
+	for _, source := range []*ResourceLimits{plugin, host} {
+		if source == nil {
+			continue
+		}
+		if source.AddressSpace != 0 {
+			limits.AddressSpace = source.AddressSpace
+		}
+		if source.OpenFiles != 0 {
+			limits.OpenFiles = source.OpenFiles
+		}
+		if source.CpuSeconds != 0 {
+			limits.CpuSeconds = source.CpuSeconds
+		}
+		if source.CoreDump != nil {
+			limits.CoreDump = source.CoreDump
+		}
+		if source.Cgroup != nil {
+			if limits.Cgroup == nil {
+				limits.Cgroup = &CgroupLimits{}
+			}
+			if source.Cgroup.MemoryMax != "" {
+				limits.Cgroup.MemoryMax = source.Cgroup.MemoryMax
+			}
+			if source.Cgroup.CpuMax != "" {
+				limits.Cgroup.CpuMax = source.Cgroup.CpuMax
+			}
+			if source.Cgroup.PidsMax != "" {
+				limits.Cgroup.PidsMax = source.Cgroup.PidsMax
+			}
+		}
+	}
+	return limits
+}
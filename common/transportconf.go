@@ -0,0 +1,38 @@
+package common
+
+const (
+	// The plugin is served on a unix socket in the plugin folder
+	TransportUnix = "unix"
+	// The plugin is served on tcp with mutual TLS
+	TransportTcp = "tcp"
+)
+
+/* The transport configuration of a plugin. A tcp plugin could run in a separate
+ * container or VM, the host reaches it on Addr */
+type TransportConf struct {
+	// The network the plugin is served on (TransportUnix or TransportTcp). Default is TransportUnix
+	Network string `json:"network,omitempty"`
+	// The address the plugin listens on (i.e. 127.0.0.1:7001). A zero port on a loopback address is picked by the host
+	Listen string `json:"listen,omitempty"`
+	// The address the host connects to. Default is the listen address
+	Addr string `json:"addr,omitempty"`
+	// The TLS files of the plugin, the registry generates them if not set
+	Tls *TlsConf `json:"tls,omitempty"`
+}
+
+/* The TLS files of a tcp connection end. The peer certificate must be signed by the CA */
+type TlsConf struct {
+	// The CA certificate (pem) the peer certificate is verified with
+	CA string `json:"ca"`
+	// The certificate (pem) of this end
+	Cert string `json:"cert"`
+	// The private key (pem) of this end
+	Key string `json:"key"`
+	// The name the plugin certificate is verified for (client side only)
+	ServerName string `json:"servername,omitempty"`
+}
+
+// Check if a transport conf uses tcp
+func (transport *TransportConf) IsTcp() bool {
+	return transport != nil && transport.Network == TransportTcp
+}
@@ -0,0 +1,103 @@
+/* Method descriptors published by the plugins: the parameter and result
+ * schemas, the documentation and the properties of each method. The registry
+ * could validate the call arguments against them before sending
+ */
+
+package pluginmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+)
+
+/* Get the descriptors of the plugin methods. They are fetched from the plugin once per activation,
+   a plugin built with an older library doesn't publish descriptors and an error is returned */
+func (plugin *Plugin) DescribeMethods() ([]common.MethodDescriptor, error) {
+	descriptors, describeErr := plugin.cachedDescriptors()
+	if descriptors != nil || describeErr != nil {
+		return descriptors, describeErr
+	}
+	// The on-demand plugin is started before taking the lock, its activation resets the descriptors
+	if plugin.onDemand != nil {
+		startErr := plugin.onDemand.acquire(plugin)
+		if startErr != nil {
+			return nil, startErr
+		}
+		defer plugin.onDemand.release()
+	}
+
+	plugin.describeAccess.Lock()
+	defer plugin.describeAccess.Unlock()
+
+	if plugin.descriptors != nil || plugin.describeErr != nil {
+		return plugin.descriptors, plugin.describeErr
+	}
+	if !plugin.isConnected() {
+		return nil, fmt.Errorf("Plugin is not connected")
+	}
+
+	pluginConn, pluginUrl := plugin.connection()
+	requestUrl := pluginUrl + "/" + common.ControlDescribe
+	resp, err := pluginConn.Request(&PluginConn.PluginRequest{Url: requestUrl, Body: nil})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to communicate with plugin: %v", err)
+	}
+	if resp.Status != "200 OK" {
+		// Not asked again till the plugin is reactivated
+		plugin.describeErr = fmt.Errorf("Plugin %s doesn't publish method descriptors. Status: %s", plugin.key, resp.Status)
+		return nil, plugin.describeErr
+	}
+	descriptors = make([]common.MethodDescriptor, 0)
+	unmarshalError := json.Unmarshal(resp.Body, &descriptors)
+	if unmarshalError != nil {
+		return nil, fmt.Errorf("Json Unmarshal failed: %s", unmarshalError)
+	}
+	plugin.descriptors = descriptors
+	return descriptors, nil
+}
+
+// Internal: get the descriptors fetched on the current activation
+func (plugin *Plugin) cachedDescriptors() ([]common.MethodDescriptor, error) {
+	plugin.describeAccess.Lock()
+	defer plugin.describeAccess.Unlock()
+
+	return plugin.descriptors, plugin.describeErr
+}
+
+/* Get the descriptor of a plugin method */
+func (plugin *Plugin) DescribeMethod(funcName string) (*common.MethodDescriptor, error) {
+	descriptors, err := plugin.DescribeMethods()
+	if err != nil {
+		return nil, err
+	}
+	for i := range descriptors {
+		if descriptors[i].Name == funcName {
+			return &descriptors[i], nil
+		}
+	}
+	return nil, plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorMethodNotFound, "Method of name : %s is not registered", funcName))
+}
+
+// Internal: validate the arguments of a call if the registry is set to, the calls of a plugin not
+// publishing descriptors are not validated
+func (plugin *Plugin) validateArgs(funcName string, args []interface{}) error {
+	if plugin.registry == nil || !plugin.registry.validateArgs {
+		return nil
+	}
+	descriptor, err := plugin.DescribeMethod(funcName)
+	if err != nil {
+		if _, ok := err.(*PluginError); ok {
+			return err
+		}
+		log.DEBUG.Printf("Arguments of %s are not validated: %v", funcName, err)
+		return nil
+	}
+	validateErr := descriptor.ValidateArgs(args)
+	if validateErr != nil {
+		return plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorBadArguments, "%v", validateErr))
+	}
+	return nil
+}
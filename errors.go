@@ -0,0 +1,116 @@
+/* The errors of a method call. A failed call returns a *PluginError carrying the
+ * envelope sent by the plugin, it matches the error kinds below with errors.Is
+ * and is retrieved with errors.As
+ */
+
+package pluginmanager
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	// An error to indicate the method is not registered by the plugin
+	MethodNotFound = errors.New("Plugin method is not registered")
+
+	// An error to indicate the arguments don't match the plugin method
+	BadArguments = errors.New("Bad plugin method arguments")
+
+	// An error to indicate the plugin crashed or the connection to it is lost
+	PluginCrashed = errors.New("Plugin crashed")
+
+	// An error to indicate the plugin method panicked
+	PluginPanicked = errors.New("Plugin method panicked")
+
+	// An error to indicate the plugin method returned an error
+	PluginMethodError = errors.New("Plugin method returned an error")
+)
+
+/* The error of a method call */
+type PluginError struct {
+	// The plugin id
+	Plugin string
+	// The method name
+	Method string
+	// The error code (common.ErrorMethodNotFound ...)
+	Code string
+	// The error message
+	Message string
+	// Additional details sent by the plugin
+	Details map[string]interface{}
+	// The call could be retried
+	Retryable bool
+	// The plugin stack trace of a panic
+	Stack string
+}
+
+func (pluginErr *PluginError) Error() string {
+	return fmt.Sprintf("Plugin %s method %s failed: %s", pluginErr.Plugin, pluginErr.Method, pluginErr.Message)
+}
+
+/* Match the error kind of the code */
+func (pluginErr *PluginError) Is(target error) bool {
+	switch target {
+	case MethodNotFound:
+		return pluginErr.Code == common.ErrorMethodNotFound
+	case BadArguments:
+		return pluginErr.Code == common.ErrorBadArguments
+	case ExecuteTimeout:
+		return pluginErr.Code == common.ErrorTimeout
+	case PluginCrashed:
+		return pluginErr.Code == common.ErrorPluginCrashed
+	case PluginPanicked:
+		return pluginErr.Code == common.ErrorPanic
+	case PluginMethodError:
+		return pluginErr.Code == common.ErrorPlugin
+	}
+	return false
+}
+
+/* Get the envelope of the error */
+func (pluginErr *PluginError) Envelope() *common.ErrorEnvelope {
+	return &common.ErrorEnvelope{Code: pluginErr.Code, Message: pluginErr.Message, Details: pluginErr.Details,
+		Retryable: pluginErr.Retryable, Stack: pluginErr.Stack}
+}
+
+// Internal: create the error of a method call, the panics are counted in the instance stats
+func (plugin *Plugin) callError(method string, envelope *common.ErrorEnvelope) *PluginError {
+	if envelope.Code == common.ErrorPanic {
+		atomic.AddInt64(&plugin.panics, 1)
+		log.ERROR.Printf("Plugin %s method %s panicked: %s\n%s", plugin.instanceKey(), method, envelope.Message, envelope.Stack)
+	}
+	return &PluginError{Plugin: plugin.key, Method: method, Code: envelope.Code, Message: envelope.Message,
+		Details: envelope.Details, Retryable: envelope.Retryable, Stack: envelope.Stack}
+}
+
+// Internal: get the error of a failed response, a plugin not sending an envelope gets an internal error
+func (plugin *Plugin) responseError(method string, status string, header http.Header, body []byte) *PluginError {
+	envelope, ok := common.ParseErrorEnvelope(header.Get("Content-Type"), body)
+	if !ok {
+		envelope = common.NewErrorEnvelope(common.ErrorInternal, "request failed. Status: %s", status)
+	}
+	return plugin.callError(method, envelope)
+}
+
+// Internal: get the envelope of an error to send it on, errors of other kinds are internal errors
+func errorEnvelope(err error) *common.ErrorEnvelope {
+	var pluginErr *PluginError
+	if errors.As(err, &pluginErr) {
+		return pluginErr.Envelope()
+	}
+	if errors.Is(err, ExecuteTimeout) {
+		return &common.ErrorEnvelope{Code: common.ErrorTimeout, Message: err.Error(), Retryable: true}
+	}
+	return common.NewErrorEnvelope(common.ErrorInternal, "%v", err)
+}
+
+// Internal: write the error of a method call in a response
+func writeCallError(res http.ResponseWriter, err error) {
+	PluginConn.WriteErrorResponse(errorEnvelope(err), res)
+}
@@ -0,0 +1,83 @@
+/* PluginEvent is the notification published by the Plugin Registry
+ * on change of a plugin state
+ */
+
+package pluginmanager
+
+import (
+	"time"
+)
+
+// The type of a registry event
+type PluginEventType int
+
+const (
+	// Plugin is loaded and activated
+	PluginLoadedEvent PluginEventType = iota
+	// Plugin is unloaded by the registry
+	PluginUnloadedEvent
+	// Plugin process has terminated
+	PluginTerminatedEvent
+	// Plugin liveness or readiness has changed
+	PluginHealthEvent
+)
+
+// The reason of a plugin process termination
+type TerminationReason string
+
+const (
+	// Plugin process exited by itself
+	TerminationExited TerminationReason = "exited"
+	// Plugin process was killed by a signal
+	TerminationSignaled TerminationReason = "signaled"
+	// Plugin process was stopped by the registry
+	TerminationStopped TerminationReason = "stopped"
+	// Plugin process exceeded its CPU time limit
+	TerminationCpuLimit TerminationReason = "cpu-limit"
+	// Plugin process exceeded its memory limit (cgroup memory.max)
+	TerminationMemoryLimit TerminationReason = "memory-limit"
+	// Plugin process exceeded its file size limit
+	TerminationFileSizeLimit TerminationReason = "filesize-limit"
+)
+
+/* The event published by the plugin registry */
+type PluginEvent struct {
+	// The event type
+	Type PluginEventType
+	// The plugin id (namespace _ name _ version)
+	Key string
+	// The Plugin instance PId
+	Pid int
+	// The termination reason (only for PluginTerminatedEvent)
+	Reason TerminationReason
+	// The exit status or the signal number of the terminated process
+	Status int
+	// The health state (only for PluginHealthEvent)
+	Health *HealthState
+	// The time of the event
+	Time time.Time
+}
+
+/* Register a handler that will be called on each event published by the registry.
+   Handlers are called synchronously and should not block */
+func (pluginReg *PluginReg) Subscribe(handler func(PluginEvent)) {
+	pluginReg.eventAccess.Lock()
+	defer pluginReg.eventAccess.Unlock()
+
+	pluginReg.eventHandlers = append(pluginReg.eventHandlers, handler)
+}
+
+// Internal: publish an event to all the registered handlers
+func (pluginReg *PluginReg) publish(event PluginEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	pluginReg.eventAccess.Lock()
+	handlers := pluginReg.eventHandlers
+	pluginReg.eventAccess.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	GoPlug "github.com/swarvanusg/GoPlug"
 	"os"
@@ -58,7 +59,7 @@ func main() {
 		return
 	}
 
-	pluginReg.Stop()
+	pluginReg.Stop(context.Background())
 	fmt.Printf("Waiting for pluginReg to stop \n")
 	pluginReg.WaitForStop()
 }
@@ -0,0 +1,153 @@
+/* Large blob arguments are not copied in the request body. The host writes them
+ * in a sealed memfd and passes the descriptor to the plugin over its fd socket
+ * (SCM_RIGHTS), the request carries a reference to the descriptor instead.
+ *
+ * Open files, sockets and listeners are passed the same way. The caller keeps the
+ * ownership of what it passes and could close it once the call returns, the plugin
+ * gets its own descriptor that it owns and must close
+ */
+
+package pluginmanager
+
+import (
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"os"
+)
+
+var (
+	// The socket the plugin receives the file descriptors on (in the discovered plugin folder)
+	PluginFdSockFile = "pluginfd.sock"
+)
+
+// The sockets and listeners that could be passed to a plugin (net.TCPConn, net.UnixListener ...)
+type fileConn interface {
+	File() (*os.File, error)
+}
+
+// Internal: replace the blob and the file arguments with their references
+func (plugin *Plugin) passArgs(args []interface{}) ([]interface{}, error) {
+	converted := args
+	copied := false
+	for i, arg := range args {
+		var ref interface{}
+		var err error
+		switch typed := arg.(type) {
+		case *common.Blob:
+			ref, err = plugin.blobRef(typed)
+		case common.Blob:
+			ref, err = plugin.blobRef(&typed)
+		case *os.File:
+			ref, err = plugin.fileRef(typed)
+		case fileConn:
+			// File returns a duplicate the host closes once it is sent
+			file, fileErr := typed.File()
+			if fileErr != nil {
+				return nil, fmt.Errorf("Failed to get the file of argument %d: %v", i, fileErr)
+			}
+			ref, err = plugin.fileRef(file)
+			file.Close()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !copied {
+			// Don't modify the caller arguments
+			converted = append([]interface{}{}, args...)
+			copied = true
+		}
+		converted[i] = ref
+	}
+	return converted, nil
+}
+
+// Internal: pass an open file to the plugin and get its reference
+func (plugin *Plugin) fileRef(file *os.File) (interface{}, error) {
+	if file == nil {
+		return nil, nil
+	}
+	if plugin.fdSock == "" {
+		return nil, fmt.Errorf("File descriptor passing is not available for plugin %s", plugin.key)
+	}
+	// Use the raw descriptor so that the file is not switched to blocking mode
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	id := newInstanceId()
+	var sendErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sendErr = plugin.sendFd(id, int(fd))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sendErr != nil {
+		return nil, sendErr
+	}
+	return common.FdRef(id, common.FdKindFile), nil
+}
+
+// Internal: get the reference a blob is sent as
+func (plugin *Plugin) blobRef(blob *common.Blob) (interface{}, error) {
+	if blob == nil {
+		return nil, nil
+	}
+	if len(blob.Data) <= common.BlobInlineThreshold || plugin.fdSock == "" || !common.MemfdSupported() {
+		return map[string]interface{}{common.BlobInlineKey: blob.Data}, nil
+	}
+
+	id := newInstanceId()
+	file, err := common.BlobMemfd("goplug-blob", blob.Data)
+	if err != nil {
+		return nil, err
+	}
+	// The plugin gets its own descriptor, the host copy is closed once sent
+	defer file.Close()
+	err = plugin.sendFd(id, int(file.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	return common.FdRef(id, common.FdKindBlob), nil
+}
+
+// Internal: send a file descriptor to the plugin, the connection is created on the first send
+func (plugin *Plugin) sendFd(id string, fd int) error {
+	plugin.fdAccess.Lock()
+	if plugin.fdConn == nil {
+		fdConn, err := PluginConn.DialFdConn(plugin.fdSock, plugin.authSecret())
+		if err != nil {
+			plugin.fdAccess.Unlock()
+			return err
+		}
+		plugin.fdConn = fdConn
+	}
+	fdConn := plugin.fdConn
+	plugin.fdAccess.Unlock()
+
+	err := fdConn.SendFds(id, fd)
+	if err != nil {
+		// Reconnect on the next send
+		plugin.closeFdConn()
+		return fmt.Errorf("Failed to pass fd to plugin %s: %v", plugin.key, err)
+	}
+	return nil
+}
+
+// Internal: close the fd connection of the instance
+func (plugin *Plugin) closeFdConn() {
+	plugin.fdAccess.Lock()
+	defer plugin.fdAccess.Unlock()
+
+	if plugin.fdConn != nil {
+		closeErr := plugin.fdConn.Close()
+		if closeErr != nil {
+			log.DEBUG.Printf("Failed to close the fd connection of %s: %v", plugin.key, closeErr)
+		}
+		plugin.fdConn = nil
+	}
+}
@@ -0,0 +1,193 @@
+/* Health monitor periodically checks the liveness and the readiness of
+ * each plugin instance and publishes the state changes as registry events
+ */
+
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"time"
+)
+
+/* The health check configuration of the registry */
+type HealthConf struct {
+	// The interval between two checks. Default is 5 seconds
+	Interval time.Duration
+	// The time to wait for a check response. Default is 2 seconds
+	Timeout time.Duration
+	// The consecutive failures to mark a plugin not live/not ready. Default is 3
+	FailureThreshold int
+	// The consecutive successes to mark a plugin live/ready again. Default is 1
+	SuccessThreshold int
+}
+
+/* The health state of a plugin instance */
+type HealthState struct {
+	// Plugin process is serving requests
+	Live bool
+	// Plugin reported it is ready to serve requests
+	Ready bool
+	// The custom health details reported by the plugin
+	Details map[string]interface{}
+	// The time of the last check
+	LastCheck time.Time
+	// The error of the last failed check
+	LastError string
+}
+
+// The readiness report sent by the plugin
+type healthReport struct {
+	Ready   bool                   `json:"ready"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Internal: the per instance health monitor state
+type healthMonitor struct {
+	conf          HealthConf
+	liveFailures  int
+	liveSuccess   int
+	readyFailures int
+	readySuccess  int
+	stopchan      chan int
+}
+
+// Internal: get the health conf with defaults applied
+func healthConfDefaults(conf *HealthConf) HealthConf {
+	health := HealthConf{}
+	if conf != nil {
+		health = *conf
+	}
+	if health.Interval <= 0 {
+		health.Interval = 5 * time.Second
+	}
+	if health.Timeout <= 0 {
+		health.Timeout = 2 * time.Second
+	}
+	if health.FailureThreshold <= 0 {
+		health.FailureThreshold = 3
+	}
+	if health.SuccessThreshold <= 0 {
+		health.SuccessThreshold = 1
+	}
+	return health
+}
+
+/* Get the current health state of a plugin */
+func (plugin *Plugin) Health() HealthState {
+	plugin.healthAccess.Lock()
+	defer plugin.healthAccess.Unlock()
+
+	return plugin.health
+}
+
+// Internal: start the health monitor of a plugin instance
+func (pluginReg *PluginReg) startHealthMonitor(plugin *Plugin) {
+	if pluginReg.health == nil {
+		return
+	}
+	monitor := &healthMonitor{conf: healthConfDefaults(pluginReg.health), stopchan: make(chan int)}
+	plugin.healthAccess.Lock()
+	plugin.healthMonitor = monitor
+	// The plugin is live and ready once activated
+	plugin.health = HealthState{Live: true, Ready: true, LastCheck: time.Now()}
+	plugin.healthAccess.Unlock()
+
+	go pluginReg.monitorHealth(plugin, monitor)
+}
+
+// Internal: stop the health monitor of a plugin instance
+func (plugin *Plugin) stopHealthMonitor() {
+	plugin.healthAccess.Lock()
+	defer plugin.healthAccess.Unlock()
+
+	if plugin.healthMonitor != nil {
+		close(plugin.healthMonitor.stopchan)
+		plugin.healthMonitor = nil
+	}
+}
+
+// Internal: the health monitor routine
+func (pluginReg *PluginReg) monitorHealth(plugin *Plugin, monitor *healthMonitor) {
+	ticker := time.NewTicker(monitor.conf.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-monitor.stopchan:
+			return
+		}
+
+		liveErr := plugin.checkRequest("Live", monitor.conf.Timeout, nil)
+		report := &healthReport{}
+		readyErr := liveErr
+		if liveErr == nil {
+			readyErr = plugin.checkRequest("Ready", monitor.conf.Timeout, report)
+		}
+
+		plugin.healthAccess.Lock()
+		previous := plugin.health
+		state := previous
+		state.LastCheck = time.Now()
+		state.LastError = ""
+		state.Live = monitor.threshold(liveErr == nil, previous.Live, &monitor.liveSuccess, &monitor.liveFailures)
+		state.Ready = state.Live && monitor.threshold(readyErr == nil && report.Ready, previous.Ready, &monitor.readySuccess, &monitor.readyFailures)
+		if readyErr == nil {
+			state.Details = report.Details
+		} else {
+			state.LastError = readyErr.Error()
+		}
+		plugin.health = state
+		plugin.setConnected(state.Live)
+		plugin.healthAccess.Unlock()
+
+		if state.Live != previous.Live || state.Ready != previous.Ready {
+			log.INFO.Printf("Plugin %s health changed: live %v, ready %v", plugin.instanceKey(), state.Live, state.Ready)
+			pluginReg.publish(PluginEvent{Type: PluginHealthEvent, Key: plugin.key, Pid: plugin.processId(), Health: &state})
+		}
+	}
+}
+
+// Internal: apply the success/failure thresholds to a check result
+func (monitor *healthMonitor) threshold(ok bool, current bool, success *int, failures *int) bool {
+	if ok {
+		*success++
+		*failures = 0
+		return current || *success >= monitor.conf.SuccessThreshold
+	}
+	*failures++
+	*success = 0
+	return current && *failures < monitor.conf.FailureThreshold
+}
+
+// Internal: send a health check request with a timeout and decode the response in result
+func (plugin *Plugin) checkRequest(check string, timeout time.Duration, result interface{}) error {
+	pluginConn, pluginUrl := plugin.connection()
+	requestUrl := pluginUrl + "/" + common.ControlPrefix + check
+	request := &PluginConn.PluginRequest{Url: requestUrl, Body: nil}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := pluginConn.RequestContext(ctx, request)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s check timed out after %v", check, timeout)
+		}
+		return err
+	}
+	if resp.Status != "200 OK" {
+		return fmt.Errorf("%s check failed. Status: %s", check, resp.Status)
+	}
+	if result != nil {
+		unmarshalError := json.Unmarshal(resp.Body, result)
+		if unmarshalError != nil {
+			return fmt.Errorf("Json Unmarshal failed: %s", unmarshalError)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/* Host functions are registered on the registry and called by the plugins.
+ * Each plugin instance gets its own host socket, so the host knows the
+ * calling plugin and applies the access control of the function
+ */
+
+package pluginmanager
+
+import (
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// The socket the host functions are served on (in the discovered plugin folder)
+	HostSockFile = "host.sock"
+)
+
+/* A function exposed by the host to the plugins. It gets the id of the calling plugin
+   (namespace _ name _ version) and the arguments sent by the plugin */
+type HostFunc func(caller string, args []interface{}) (interface{}, error)
+
+// Internal: a registered host function with the plugins allowed to call it
+type hostFunc struct {
+	fn      HostFunc
+	allowed []string
+}
+
+// The response of a host function call
+type hostFuncResponse struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+/* Register a function the plugins could call by name. If plugin ids are given only those
+   plugins are allowed to call the function, otherwise every plugin is allowed */
+func (pluginReg *PluginReg) RegisterHostFunc(name string, fn HostFunc, plugins ...string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid host function name: %q", name)
+	}
+
+	pluginReg.regAccess.Lock()
+	defer pluginReg.regAccess.Unlock()
+
+	if _, ok := pluginReg.hostFuncs[name]; ok {
+		return fmt.Errorf("The host function %s is already registered", name)
+	}
+	pluginReg.hostFuncs[name] = &hostFunc{fn: fn, allowed: plugins}
+	return nil
+}
+
+/* Remove a registered host function */
+func (pluginReg *PluginReg) UnregisterHostFunc(name string) {
+	pluginReg.regAccess.Lock()
+	defer pluginReg.regAccess.Unlock()
+
+	delete(pluginReg.hostFuncs, name)
+}
+
+// Internal: check if a plugin is allowed to call the function
+func (function *hostFunc) isAllowed(key string) bool {
+	if len(function.allowed) == 0 {
+		return true
+	}
+	for _, allowed := range function.allowed {
+		if allowed == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Internal: serve the host functions to a plugin instance on its host socket
+func (pluginReg *PluginReg) startHostServer(plugin *Plugin, sockFile string) error {
+	// Only the plugin could connect, a stale socket left by a previous instance is removed
+	listener, err := PluginConn.ListenPrivate(sockFile)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on host socket %s: %v", sockFile, err)
+	}
+	pluginUid := os.Getuid()
+	if pluginReg.sandbox != nil && (pluginReg.sandbox.Uid != 0 || pluginReg.sandbox.Gid != 0) {
+		os.Chown(sockFile, int(pluginReg.sandbox.Uid), int(pluginReg.sandbox.Gid))
+		pluginUid = int(pluginReg.sandbox.Uid)
+	}
+
+	plugin.hostListener = listener
+	key := plugin.key
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		pluginReg.serveHostFunc(key, res, req)
+	})
+	go http.Serve(PluginConn.PeerListener(listener, pluginUid), PluginConn.AuthHandler(handler, plugin.authSecret()))
+	return nil
+}
+
+// Internal: stop serving the host functions to a plugin instance
+func (plugin *Plugin) stopHostServer() {
+	if plugin.hostListener == nil {
+		return
+	}
+	sockFile := plugin.hostListener.Addr().String()
+	plugin.hostListener.Close()
+	plugin.hostListener = nil
+	os.Remove(sockFile)
+}
+
+// Internal: execute a host function called by a plugin
+func (pluginReg *PluginReg) serveHostFunc(key string, res http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/")
+
+	pluginReg.regAccess.Lock()
+	function, ok := pluginReg.hostFuncs[name]
+	pluginReg.regAccess.Unlock()
+	if !ok {
+		PluginConn.WriteJsonResponse(hostFuncResponse{Error: fmt.Sprintf("Host function %s is not registered", name)}, 404, res)
+		return
+	}
+	if !function.isAllowed(key) {
+		log.ERROR.Printf("Plugin %s is not allowed to call host function %s", key, name)
+		PluginConn.WriteJsonResponse(hostFuncResponse{Error: fmt.Sprintf("Plugin is not allowed to call %s", name)}, 403, res)
+		return
+	}
+
+	defer req.Body.Close()
+	input, _ := ioutil.ReadAll(req.Body)
+	result, err := function.fn(key, common.ReadJson(input))
+	if err != nil {
+		PluginConn.WriteJsonResponse(hostFuncResponse{Error: err.Error()}, 500, res)
+		return
+	}
+	writeErr := PluginConn.WriteJsonResponse(hostFuncResponse{Result: result}, 200, res)
+	if writeErr != nil {
+		log.ERROR.Printf("Failed to send host function %s result to plugin %s: %v", name, key, writeErr)
+	}
+}
@@ -0,0 +1,128 @@
+/* LaunchSpec is the effective command line, environment and working
+ * directory a plugin process is started with
+ */
+
+package pluginmanager
+
+import (
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// The host environment variables passed to a plugin when no allowlist is configured
+	DefaultEnvAllowlist = []string{"PATH", "HOME", "USER", "LANG", "LC_*", "TZ", "TMPDIR"}
+)
+
+/* The effective launch spec of a plugin process */
+type LaunchSpec struct {
+	// The absolute path of the plugin binary
+	Path string
+	// The argv (including the binary name as argv[0])
+	Args []string
+	// The environment in the form key=value
+	Env []string
+	// The working directory
+	Dir string
+}
+
+/* Get the effective launch spec of a discovered plugin, useful to debug how a plugin is started */
+func (pluginReg *PluginReg) GetLaunchSpec(namespace string, name string, version string) (*LaunchSpec, error) {
+	key := getKey(name, namespace, version)
+	pluginLoc := filepath.Join(pluginReg.discoveredPluginLoc, key)
+
+	pluginConfFile := filepath.Join(pluginLoc, DefaultPluginConfFile)
+	pluginConfig, confLoadErr := common.LoadPluginConfigs(pluginConfFile)
+	if confLoadErr != nil {
+		return nil, ConfigLoadFailed
+	}
+
+	return pluginReg.launchSpec(key, pluginLoc, pluginConfig.Launch), nil
+}
+
+/* Get the launch spec the plugin instance has been started with. It returns false if the instance
+   is not started by this host (an on-demand plugin not started yet, a reattached or a remote plugin) */
+func (plugin *Plugin) LaunchSpec() (LaunchSpec, bool) {
+	launchSpec := plugin.launchSpec
+	if launchSpec == nil {
+		return LaunchSpec{}, false
+	}
+	spec := *launchSpec
+	spec.Args = append([]string{}, spec.Args...)
+	spec.Env = append([]string{}, spec.Env...)
+	return spec, true
+}
+
+// Internal: build the launch spec from the plugin conf and the host confs
+func (pluginReg *PluginReg) launchSpec(key string, pluginLoc string, pluginLaunch *common.LaunchConf) *LaunchSpec {
+	launch := common.MergeLaunchConf(restrictPluginLaunch(key, pluginLaunch), pluginReg.launch, pluginReg.pluginLaunch[key])
+
+	pluginFolder, _ := filepath.Abs(pluginLoc)
+	spec := &LaunchSpec{}
+	spec.Path = filepath.Join(pluginFolder, PluginBinary)
+	spec.Args = append([]string{PluginBinary}, launch.Args...)
+
+	spec.Dir = pluginFolder
+	if launch.WorkDir != "" {
+		spec.Dir = launch.WorkDir
+		if !filepath.IsAbs(spec.Dir) {
+			spec.Dir = filepath.Join(pluginFolder, spec.Dir)
+		}
+	}
+
+	allowlist := launch.EnvAllowlist
+	if allowlist == nil {
+		allowlist = DefaultEnvAllowlist
+	}
+	for _, env := range os.Environ() {
+		envKey := strings.SplitN(env, "=", 2)[0]
+		if _, override := launch.Env[envKey]; override {
+			continue
+		}
+		if envAllowed(envKey, allowlist) {
+			spec.Env = append(spec.Env, env)
+		}
+	}
+	extraKeys := make([]string, 0, len(launch.Env))
+	for envKey := range launch.Env {
+		extraKeys = append(extraKeys, envKey)
+	}
+	sort.Strings(extraKeys)
+	for _, envKey := range extraKeys {
+		spec.Env = append(spec.Env, fmt.Sprintf("%s=%s", envKey, launch.Env[envKey]))
+	}
+
+	return spec
+}
+
+// Internal: drop the env allowlist and the working dir from the plugin conf, only the host could set
+// them so that a plugin can't read the host environment or run outside its folder
+func restrictPluginLaunch(key string, launch *common.LaunchConf) *common.LaunchConf {
+	if launch == nil || (launch.EnvAllowlist == nil && launch.WorkDir == "") {
+		return launch
+	}
+	log.ERROR.Printf("Plugin %s conf sets envallowlist or workdir, they are ignored as only the host could set them", key)
+	restricted := *launch
+	restricted.EnvAllowlist = nil
+	restricted.WorkDir = ""
+	return &restricted
+}
+
+// Internal: check if an environment variable is in the allowlist
+func envAllowed(envKey string, allowlist []string) bool {
+	for _, allowed := range allowlist {
+		if strings.HasSuffix(allowed, "*") {
+			if strings.HasPrefix(envKey, strings.TrimSuffix(allowed, "*")) {
+				return true
+			}
+		} else if envKey == allowed {
+			return true
+		}
+	}
+	return false
+}
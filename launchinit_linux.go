@@ -0,0 +1,159 @@
+//go:build linux
+// +build linux
+
+/* The init stage is the host binary re-executed to prepare the plugin process
+ * before the plugin binary is executed. It applies the rlimits and the sandbox
+ * (mounts, uid/gid and the seccomp filter) in the child so that the plugin
+ * never runs without them. A failure is reported to the host on a status pipe
+ * that is closed by the exec of the plugin binary
+ */
+
+package pluginmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+const (
+	// The fd of the status pipe in the init stage
+	initStatusFd = 3
+)
+
+var (
+	// The argv[0] used to run the init stage
+	initArg = "goplug-init"
+	// The environment variable holding the init spec
+	initSpecEnv = "GOPLUG_INIT_SPEC"
+)
+
+// The spec handed over to the init stage
+type initSpec struct {
+	File      string         `json:"file"`
+	Args      []string       `json:"args"`
+	Env       []string       `json:"env"`
+	Dir       string         `json:"dir"`
+	Rlimits   map[int]uint64 `json:"rlimits"`
+	Pdeathsig int            `json:"pdeathsig"`
+	// The sandbox steps
+	Uid       uint32   `json:"uid"`
+	Gid       uint32   `json:"gid"`
+	SetId     bool     `json:"setid"`
+	Mount     bool     `json:"mount"`
+	MountProc bool     `json:"mountproc"`
+	PluginLoc string   `json:"pluginloc"`
+	DataDir   string   `json:"datadir"`
+	Seccomp   []string `json:"seccomp"`
+}
+
+func init() {
+	// Check if the process is started as the init stage
+	if len(os.Args) == 0 || os.Args[0] != initArg {
+		return
+	}
+	var spec initSpec
+	err := json.Unmarshal([]byte(os.Getenv(initSpecEnv)), &spec)
+	if err != nil {
+		err = fmt.Errorf("Failed to decode init spec: %v", err)
+	} else {
+		err = launchInit(&spec)
+	}
+	// The host reads the failure from the status pipe
+	status := os.NewFile(initStatusFd, "status")
+	fmt.Fprintf(status, "%v", err)
+	os.Exit(127)
+}
+
+// Internal: start the init stage that executes the plugin binary. It returns once the plugin binary
+// is executed or with the error reported by the init stage
+func forkInit(spec *initSpec, attr *syscall.ProcAttr) (int, error) {
+	encodedSpec, marshalErr := json.Marshal(spec)
+	if marshalErr != nil {
+		return 0, fmt.Errorf("Failed to encode init spec: %v", marshalErr)
+	}
+	statusRead, statusWrite, pipeErr := os.Pipe()
+	if pipeErr != nil {
+		return 0, fmt.Errorf("Failed to create the init status pipe: %v", pipeErr)
+	}
+	defer statusRead.Close()
+
+	attr.Env = []string{initSpecEnv + "=" + string(encodedSpec)}
+	// The standard fds are closed as for a plugin executed directly
+	closed := ^uintptr(0)
+	attr.Files = []uintptr{closed, closed, closed, statusWrite.Fd()}
+	pid, forkErr := syscall.ForkExec("/proc/self/exe", []string{initArg}, attr)
+	statusWrite.Close()
+	if forkErr != nil {
+		return 0, forkErr
+	}
+
+	status, _ := ioutil.ReadAll(statusRead)
+	if len(status) > 0 {
+		waitProcess(pid)
+		return 0, fmt.Errorf("%s", status)
+	}
+	return pid, nil
+}
+
+// Internal: the init stage, it runs in the namespaces of the plugin process.
+// On success it never returns
+func launchInit(spec *initSpec) error {
+	// seccomp filter is per thread, the exec must happen from the same thread
+	runtime.LockOSThread()
+
+	if spec.Mount {
+		err := sandboxMount(spec)
+		if err != nil {
+			return err
+		}
+		// Enter the working dir again to get the sandbox mounts view of it
+		err = syscall.Chdir(spec.Dir)
+		if err != nil {
+			return fmt.Errorf("Failed to change dir to %s: %v", spec.Dir, err)
+		}
+	}
+
+	if spec.SetId {
+		err := syscall.Setgroups([]int{int(spec.Gid)})
+		if err != nil {
+			return fmt.Errorf("Failed to set groups: %v", err)
+		}
+		err = syscall.Setresgid(int(spec.Gid), int(spec.Gid), int(spec.Gid))
+		if err != nil {
+			return fmt.Errorf("Failed to set gid %d: %v", spec.Gid, err)
+		}
+		err = syscall.Setresuid(int(spec.Uid), int(spec.Uid), int(spec.Uid))
+		if err != nil {
+			return fmt.Errorf("Failed to set uid %d: %v", spec.Uid, err)
+		}
+	}
+
+	// The parent death signal is cleared on credential change
+	if spec.Pdeathsig != 0 {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(spec.Pdeathsig), 0)
+		if errno != 0 {
+			return fmt.Errorf("Failed to set parent death signal: %v", errno)
+		}
+	}
+
+	err := setRlimits(spec.Rlimits)
+	if err != nil {
+		return err
+	}
+
+	if spec.Seccomp != nil {
+		err = installSeccomp(spec.Seccomp)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The status pipe is closed by the exec, the host then knows the plugin binary runs
+	syscall.CloseOnExec(initStatusFd)
+	err = syscall.Exec(spec.File, spec.Args, spec.Env)
+	return fmt.Errorf("Failed to execute %s: %v", spec.File, err)
+}
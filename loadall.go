@@ -0,0 +1,196 @@
+/* LoadAll loads every discovered plugin at startup. Independent plugins are
+ * loaded concurrently with a worker limit, a plugin is loaded only after
+ * the plugins it depends on are loaded
+ */
+
+package pluginmanager
+
+import (
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	// Default number of plugins loaded concurrently by LoadAll
+	DefaultLoadWorkers = 8
+)
+
+/* The load result of a single plugin */
+type LoadResult struct {
+	// The plugin id (namespace _ name _ version)
+	Key string
+	// The loaded plugin (nil if loading failed)
+	Plugin *Plugin
+	// The load error (nil if the plugin is loaded)
+	Err error
+	// The time taken to load the plugin
+	Duration time.Duration
+}
+
+/* The aggregated report of LoadAll */
+type LoadReport struct {
+	// The result of each plugin sorted by the plugin id
+	Results []LoadResult
+	// The number of plugins loaded and failed
+	Loaded int
+	Failed int
+	// The time taken to load all the plugins
+	Duration time.Duration
+}
+
+// Internal: a plugin to be loaded by LoadAll
+type loadTask struct {
+	key       string
+	pluginLoc string
+	depends   []string
+}
+
+// Internal: get the plugin ids a plugin depends on from its plugin conf
+func pluginDepends(pluginLoc string) ([]string, error) {
+	pluginConfig, err := common.LoadPluginConfigs(filepath.Join(pluginLoc, DefaultPluginConfFile))
+	if err != nil {
+		return nil, err
+	}
+	return pluginConfig.Depends, nil
+}
+
+/* Load all the discovered plugins that are not loaded yet. At most workers plugins are loaded
+   concurrently (DefaultLoadWorkers if workers <= 0). A plugin is loaded after its dependencies,
+   if a dependency fails or is not found the plugin is not loaded */
+func (pluginReg *PluginReg) LoadAll(workers int) *LoadReport {
+	if workers <= 0 {
+		workers = DefaultLoadWorkers
+	}
+	started := time.Now()
+	report := &LoadReport{}
+	if pluginReg.isStopped() {
+		log.ERROR.Printf("Failed to load the plugins: %v", RegistryStopped)
+		return report
+	}
+
+	folders, err := ioutil.ReadDir(pluginReg.discoveredPluginLoc)
+	if err != nil {
+		log.ERROR.Printf("Failed to read discovered plugin location: %v", err)
+		return report
+	}
+
+	// Collect the plugins to load
+	pending := make(map[string]*loadTask)
+	done := make(map[string]error)
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		key := folder.Name()
+		pluginLoc := filepath.Join(pluginReg.discoveredPluginLoc, key)
+		depends, confErr := pluginDepends(pluginLoc)
+		if confErr != nil {
+			// Not a plugin folder
+			continue
+		}
+		pluginReg.regAccess.Lock()
+		_, loaded := pluginReg.plugins[key]
+		pluginReg.regAccess.Unlock()
+		if loaded {
+			done[key] = nil
+			continue
+		}
+		pending[key] = &loadTask{key: key, pluginLoc: pluginLoc, depends: depends}
+	}
+
+	results := make(chan LoadResult)
+	loading := make(map[string]bool)
+	addResult := func(result LoadResult) {
+		done[result.Key] = result.Err
+		report.Results = append(report.Results, result)
+		if result.Err != nil {
+			report.Failed++
+			log.ERROR.Printf("Failed to load plugin %s: %v", result.Key, result.Err)
+		} else {
+			report.Loaded++
+		}
+	}
+
+	for len(pending) > 0 || len(loading) > 0 {
+		// Start the plugins whose dependencies are loaded
+		progress := false
+		for _, key := range sortedTasks(pending) {
+			if len(loading) >= workers {
+				break
+			}
+			task := pending[key]
+			ready, depErr := task.ready(pending, loading, done)
+			if depErr != nil {
+				delete(pending, key)
+				addResult(LoadResult{Key: key, Err: depErr})
+				progress = true
+				continue
+			}
+			if !ready {
+				continue
+			}
+			delete(pending, key)
+			loading[key] = true
+			progress = true
+			go func(task *loadTask) {
+				taskStart := time.Now()
+				plugin, loadErr := pluginReg.LoadPluginInstance(task.pluginLoc)
+				results <- LoadResult{Key: task.key, Plugin: plugin, Err: loadErr, Duration: time.Since(taskStart)}
+			}(task)
+		}
+
+		if len(loading) == 0 {
+			if progress {
+				continue
+			}
+			// Nothing is running and nothing could be started: the remaining plugins depend on each other
+			for _, key := range sortedTasks(pending) {
+				addResult(LoadResult{Key: key, Err: fmt.Errorf("Dependency cycle with %v", pending[key].depends)})
+			}
+			break
+		}
+
+		result := <-results
+		delete(loading, result.Key)
+		addResult(result)
+	}
+
+	sort.Slice(report.Results, func(i, j int) bool { return report.Results[i].Key < report.Results[j].Key })
+	report.Duration = time.Since(started)
+	log.INFO.Printf("Loaded %d plugins (%d failed) in %v", report.Loaded, report.Failed, report.Duration)
+	return report
+}
+
+// Internal: get the pending plugin ids in a stable order
+func sortedTasks(pending map[string]*loadTask) []string {
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Internal: check if all the dependencies of a plugin are loaded. It returns an error if a dependency failed or is unknown
+func (task *loadTask) ready(pending map[string]*loadTask, loading map[string]bool, done map[string]error) (bool, error) {
+	ready := true
+	for _, depend := range task.depends {
+		depErr, finished := done[depend]
+		if finished {
+			if depErr != nil {
+				return false, fmt.Errorf("Dependency %s failed to load", depend)
+			}
+			continue
+		}
+		if _, waiting := pending[depend]; !waiting && !loading[depend] {
+			return false, fmt.Errorf("Dependency %s is not discovered", depend)
+		}
+		ready = false
+	}
+	return ready, nil
+}
@@ -0,0 +1,265 @@
+/* On-demand plugins get a handle on load while the process is started
+ * transparently on the first call. The registry stops the process after
+ * it has been idle for the idle timeout and starts it again on the next call
+ */
+
+package pluginmanager
+
+import (
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// Default idle time after which an on-demand plugin is stopped
+	DefaultIdleTimeout = 5 * time.Minute
+)
+
+// Internal: the on-demand state of a plugin handle
+type onDemand struct {
+	pluginReg   *PluginReg
+	idleTimeout time.Duration
+	// Set while the plugin process is running
+	running bool
+	// Closed once the start or the stop in progress completes (nil if none is in progress) and the start error
+	starting chan int
+	startErr error
+	// The in-flight calls and the time of the last call
+	inFlight int
+	lastUsed time.Time
+	// The callbacks registered again on each start
+	callbacks map[string]func([]byte)
+	access    *sync.Mutex
+	stopchan  chan int
+}
+
+// Internal: get an unstarted handle if the plugin is configured on-demand, nil otherwise
+func (pluginReg *PluginReg) onDemandPlugin(pluginLoc string) *Plugin {
+	pluginConfig, confLoadErr := common.LoadPluginConfigs(filepath.Join(pluginLoc, DefaultPluginConfFile))
+	if confLoadErr != nil {
+		// The error is reported by the regular load
+		return nil
+	}
+	if !pluginReg.onDemand && !pluginConfig.OnDemand {
+		return nil
+	}
+
+	idleTimeout := pluginReg.idleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = time.Duration(pluginConfig.IdleTimeout) * time.Second
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
+	plugin := &Plugin{}
+	plugin.key = filepath.Base(pluginLoc)
+	plugin.pluginloc = pluginLoc
+	plugin.registry = pluginReg
+	plugin.callbacks = make(map[string]bool)
+	plugin.onDemand = &onDemand{
+		pluginReg:   pluginReg,
+		idleTimeout: idleTimeout,
+		callbacks:   make(map[string]func([]byte)),
+		access:      &sync.Mutex{},
+	}
+	log.INFO.Printf("Plugin %s is loaded on-demand (idle timeout %v)", plugin.key, idleTimeout)
+	return plugin
+}
+
+// Internal: start the plugin if it is not running and account a call. A single call starts
+// the plugin without holding the access lock, the concurrent calls wait for it
+func (state *onDemand) acquire(plugin *Plugin) error {
+	state.access.Lock()
+	defer state.access.Unlock()
+
+	if state.pluginReg.isStopped() {
+		return RegistryStopped
+	}
+	for !state.running {
+		if state.starting != nil {
+			// Another call is starting the plugin
+			state.waitStart()
+			if !state.running && state.startErr != nil {
+				return state.startErr
+			}
+			continue
+		}
+
+		starting := make(chan int)
+		state.starting = starting
+		state.access.Unlock()
+		err := state.start(plugin)
+		state.access.Lock()
+		if err == nil {
+			state.started(plugin)
+		}
+		state.starting = nil
+		state.startErr = err
+		close(starting)
+		if err != nil {
+			return err
+		}
+	}
+	state.inFlight++
+	state.lastUsed = time.Now()
+	return nil
+}
+
+// Internal: wait for the start or the stop in progress to complete (called with the access lock held)
+func (state *onDemand) waitStart() {
+	for state.starting != nil {
+		starting := state.starting
+		state.access.Unlock()
+		<-starting
+		state.access.Lock()
+	}
+}
+
+// Internal: account the end of a call
+func (state *onDemand) release() {
+	state.access.Lock()
+	defer state.access.Unlock()
+
+	state.inFlight--
+	state.lastUsed = time.Now()
+}
+
+// Internal: start the plugin process and its pool (called without the access lock)
+func (state *onDemand) start(plugin *Plugin) error {
+	log.INFO.Printf("Starting on-demand plugin %s", plugin.key)
+	err := state.pluginReg.startInstance(plugin)
+	if err != nil {
+		return fmt.Errorf("Failed to start on-demand plugin %s: %v", plugin.key, err)
+	}
+	poolErr := state.pluginReg.startPool(plugin)
+	if poolErr != nil {
+		plugin.unloadInstance()
+		return poolErr
+	}
+	return nil
+}
+
+// Internal: register the callbacks on the started plugin and monitor it (called with the access lock held)
+func (state *onDemand) started(plugin *Plugin) {
+	for funcName, function := range state.callbacks {
+		callbackErr := plugin.registerCallback(funcName, function)
+		if callbackErr != nil {
+			log.ERROR.Printf("Failed to register callback %s of plugin %s: %v", funcName, plugin.key, callbackErr)
+		}
+	}
+
+	state.running = true
+	state.lastUsed = time.Now()
+	state.stopchan = make(chan int)
+	go state.idleMonitor(plugin, state.stopchan)
+	plugin.publishLoaded()
+}
+
+// Internal: stop the plugin process and its pool if it is running
+func (state *onDemand) stop(plugin *Plugin) {
+	state.access.Lock()
+	// A start in progress is completed first so that its process is stopped too
+	state.waitStart()
+	running, pool := state.detach(plugin)
+	state.access.Unlock()
+
+	if running {
+		state.shutdown(plugin, pool)
+	}
+}
+
+// Internal: stop the plugin process and its pool and start them again
+func (state *onDemand) reload(plugin *Plugin) error {
+	state.stop(plugin)
+	err := state.acquire(plugin)
+	if err != nil {
+		return fmt.Errorf("Failed to reload plugin: %v", err)
+	}
+	state.release()
+	return nil
+}
+
+// Internal: mark the running plugin stopped and detach its pool (called with the access lock held). The calls
+// wait for the stop in progress to complete before starting the plugin again. It returns false if not running
+func (state *onDemand) detach(plugin *Plugin) (bool, *pluginPool) {
+	if !state.running {
+		return false, nil
+	}
+	close(state.stopchan)
+	state.running = false
+	state.starting = make(chan int)
+	return true, plugin.setPool(nil)
+}
+
+// Internal: stop the detached plugin and its pool (called without the access lock)
+func (state *onDemand) shutdown(plugin *Plugin, pool *pluginPool) {
+	if pool != nil {
+		pool.stop()
+	}
+	plugin.unloadInstance()
+
+	state.access.Lock()
+	stopping := state.starting
+	state.starting = nil
+	state.startErr = nil
+	state.access.Unlock()
+	close(stopping)
+}
+
+// Internal: the routine that stops the plugin once it has been idle for the idle timeout
+func (state *onDemand) idleMonitor(plugin *Plugin, stopchan chan int) {
+	ticker := time.NewTicker(DefaultInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopchan:
+			return
+		}
+
+		state.access.Lock()
+		if state.inFlight == 0 && time.Since(state.lastUsed) > state.idleTimeout {
+			// The plugin could be stopped already since the tick
+			running, pool := state.detach(plugin)
+			state.access.Unlock()
+			if running {
+				log.INFO.Printf("Stopping idle on-demand plugin %s", plugin.key)
+				state.shutdown(plugin, pool)
+			}
+			return
+		}
+		state.access.Unlock()
+	}
+}
+
+// Internal: keep a callback to register on each start, it is registered now if the plugin is running
+func (state *onDemand) registerCallback(plugin *Plugin, funcName string, function func([]byte)) error {
+	state.access.Lock()
+	defer state.access.Unlock()
+
+	_, ok := state.callbacks[funcName]
+	if ok {
+		return fmt.Errorf("The callback is already Registerd")
+	}
+	state.callbacks[funcName] = function
+	if state.running {
+		return plugin.registerCallback(funcName, function)
+	}
+	return nil
+}
+
+/* Check if the process of an on-demand plugin is running. A plugin loaded otherwise is always running */
+func (plugin *Plugin) IsRunning() bool {
+	if plugin.onDemand == nil {
+		return true
+	}
+	plugin.onDemand.access.Lock()
+	defer plugin.onDemand.access.Unlock()
+	return plugin.onDemand.running
+}
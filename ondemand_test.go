@@ -0,0 +1,81 @@
+package pluginmanager
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Internal: get a running on-demand handle without a process, its unload events are counted
+func runningOnDemand(t *testing.T) (*Plugin, *int64) {
+	registry := &PluginReg{eventAccess: &sync.Mutex{}}
+	unloaded := new(int64)
+	registry.Subscribe(func(event PluginEvent) {
+		if event.Type == PluginUnloadedEvent {
+			atomic.AddInt64(unloaded, 1)
+		}
+	})
+	plugin := &Plugin{key: "ns_calc_1", registry: registry, loaded: true, callbacks: make(map[string]bool)}
+	plugin.onDemand = &onDemand{
+		pluginReg:   registry,
+		idleTimeout: time.Hour,
+		running:     true,
+		lastUsed:    time.Now(),
+		callbacks:   make(map[string]func([]byte)),
+		access:      &sync.Mutex{},
+		stopchan:    make(chan int),
+	}
+	return plugin, unloaded
+}
+
+func TestOnDemandStop(t *testing.T) {
+	plugin, unloaded := runningOnDemand(t)
+	state := plugin.onDemand
+
+	// Concurrent stops unload the plugin once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state.stop(plugin)
+		}()
+	}
+	wg.Wait()
+	if count := atomic.LoadInt64(unloaded); count != 1 {
+		t.Errorf("The plugin is unloaded %d times", count)
+	}
+	if plugin.IsRunning() || state.starting != nil {
+		t.Errorf("The stopped plugin is left running %v, stopping %v", state.running, state.starting != nil)
+	}
+}
+
+func TestOnDemandStopUnlocked(t *testing.T) {
+	plugin, _ := runningOnDemand(t)
+	state := plugin.onDemand
+
+	// The state is not locked while the plugin is unloaded
+	state.access.Lock()
+	running, pool := state.detach(plugin)
+	state.access.Unlock()
+	if !running || pool != nil {
+		t.Fatalf("Detached running %v, pool %v", running, pool)
+	}
+	if plugin.IsRunning() {
+		t.Errorf("The detached plugin is reported running")
+	}
+
+	// A call waits for the stop in progress before starting the plugin again
+	waited := make(chan error)
+	go func() { waited <- state.acquire(plugin) }()
+	select {
+	case err := <-waited:
+		t.Fatalf("The call didn't wait for the stop: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	state.shutdown(plugin, pool)
+	if err := <-waited; err == nil {
+		t.Errorf("A plugin without conf is started")
+	}
+}
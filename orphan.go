@@ -0,0 +1,472 @@
+/* Orphan handling: each running plugin instance has a pidfile in the host
+ * state dir of its plugin. On registry init the leftover instances of a crashed
+ * host are either reattached (after verifying their identity) or terminated
+ */
+
+package pluginmanager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The policy for plugin instances left over by a previous host
+type OrphanPolicy int
+
+const (
+	// Terminate the leftover instances and remove the stale sockets
+	OrphanTerminate OrphanPolicy = iota
+	// Reattach to the leftover instances whose identity could be verified
+	OrphanReattach
+)
+
+var (
+	// The pidfile of a running plugin instance (in the host state dir of the plugin)
+	PluginPidFile = "plugin.pid"
+	// The host-private dir of the pidfiles (in the plugin location). The pidfile holds the instance secret,
+	// so it is kept out of the plugin folder the plugin process reads
+	PluginStateDir = ".goplug"
+	// The time to wait for an orphan to exit before it is killed
+	OrphanKillTimeout = 2 * time.Second
+)
+
+// The pidfile content of a running plugin instance
+type pidFile struct {
+	Pid        int    `json:"pid"`
+	Instance   int    `json:"instance"`
+	HostPid    int    `json:"hostpid"`
+	InstanceId string `json:"instanceid"`
+	Sock       string `json:"sock"`
+	Url        string `json:"url"`
+	// The instance secret, the pidfile is readable by the host only and out of the plugin sandbox
+	Secret string `json:"secret,omitempty"`
+	// The transport of a tcp instance, Sock is its address
+	Network string          `json:"network,omitempty"`
+	HostTls *common.TlsConf `json:"hosttls,omitempty"`
+	// The start time and the binary of the process, they tell a reused pid apart
+	StartTime uint64 `json:"starttime,omitempty"`
+	Exe       string `json:"exe,omitempty"`
+}
+
+// A process identified by its pid and its start time and binary (if they could be read from /proc),
+// the pid could be reused by an unrelated process once the process exits
+type processRef struct {
+	pid       int
+	startTime uint64
+	exe       string
+}
+
+// The identity returned by a plugin on handshake (the pid is the one the plugin sees in its pid namespace)
+type pluginIdentity struct {
+	InstanceId string `json:"instanceid"`
+	Pid        int    `json:"pid"`
+}
+
+// Internal: generate a random id for a plugin instance
+func newInstanceId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Internal: generate the secret of a plugin instance
+func newSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+// Internal: get a reference to a running process
+func newProcessRef(pid int) processRef {
+	ref := processRef{pid: pid}
+	ref.startTime, ref.exe, _ = processIdentity(pid)
+	return ref
+}
+
+// Internal: read the start time and the binary of a process from /proc
+func processIdentity(pid int) (uint64, string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, "", fmt.Errorf("Failed to read stat of process %d: %v", pid, err)
+	}
+	// The fields after the command name, starting from the state (field 3)
+	content := string(data)
+	fields := strings.Fields(content[strings.LastIndex(content, ")")+1:])
+	if len(fields) < 20 {
+		return 0, "", fmt.Errorf("Unexpected stat format of process %d", pid)
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("Unexpected start time of process %d: %v", pid, err)
+	}
+	// The binary is not readable for the processes of another user
+	exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	return startTime, strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+// Internal: check if the referenced process is running, false if its pid runs another process
+func (ref processRef) alive() bool {
+	if !processAlive(ref.pid) {
+		return false
+	}
+	if ref.startTime == 0 {
+		return true
+	}
+	startTime, exe, err := processIdentity(ref.pid)
+	if err != nil {
+		// The process has exited in between
+		return false
+	}
+	return startTime == ref.startTime && (ref.exe == "" || exe == "" || exe == ref.exe)
+}
+
+// Internal: send a signal to the referenced process if it is still running
+func (ref processRef) signal(signal syscall.Signal) error {
+	if !ref.alive() {
+		return fmt.Errorf("Process %d is not running", ref.pid)
+	}
+	return signalProcess(ref.pid, signal)
+}
+
+// Internal: write the pidfile of a started plugin instance
+func writePidFile(plugin *Plugin) error {
+	pid := plugin.processId()
+	_, pluginUrl := plugin.connection()
+	ref := newProcessRef(pid)
+	content := pidFile{
+		Pid:        pid,
+		Instance:   plugin.instance,
+		HostPid:    os.Getpid(),
+		InstanceId: plugin.instanceId,
+		Sock:       plugin.PluginSock,
+		Url:        pluginUrl,
+		Secret:     plugin.authSecret(),
+		Network:    plugin.network,
+		HostTls:    plugin.hostTls,
+		StartTime:  ref.startTime,
+		Exe:        ref.exe,
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	stateDir, err := prepareStateDir(plugin.pluginloc)
+	if err != nil {
+		return err
+	}
+	pidFileName := instanceFile(PluginPidFile, plugin.instance)
+	return ioutil.WriteFile(filepath.Join(stateDir, pidFileName), data, 0600)
+}
+
+// Internal: get the host state dir of a discovered plugin folder, it is PluginStateDir/<plugin id>
+// in the plugin location (the parent of the discovered plugin location)
+func stateDir(pluginLoc string) string {
+	pluginLocation := filepath.Dir(filepath.Dir(pluginLoc))
+	return filepath.Join(pluginLocation, PluginStateDir, filepath.Base(pluginLoc))
+}
+
+// Internal: create the host state dir of a plugin, it is readable by the host user only
+func prepareStateDir(pluginLoc string) (string, error) {
+	dir := stateDir(pluginLoc)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create state dir %s: %v", dir, err)
+	}
+	err = os.Chmod(filepath.Dir(dir), 0700)
+	if err != nil {
+		return "", fmt.Errorf("Failed to change mode of state dir %s: %v", filepath.Dir(dir), err)
+	}
+	return dir, nil
+}
+
+// Internal: remove the pidfile of a plugin instance
+func removePidFile(pluginLoc string, instance int) {
+	err := os.Remove(filepath.Join(stateDir(pluginLoc), instanceFile(PluginPidFile, instance)))
+	if err != nil && !os.IsNotExist(err) {
+		log.DEBUG.Printf("Failed to remove pidfile of %s: %v", pluginLoc, err)
+	}
+}
+
+// Internal: read the pidfiles of all the instances of a plugin (sorted by instance, last first). The pidfiles
+// left in the plugin folder by an earlier version are read and removed, as they hold the instance secret
+func readPidFiles(pluginLoc string) []pidFile {
+	ext := filepath.Ext(PluginPidFile)
+	pattern := strings.TrimSuffix(PluginPidFile, ext) + "*" + ext
+	files, _ := filepath.Glob(filepath.Join(stateDir(pluginLoc), pattern))
+	legacyFiles, _ := filepath.Glob(filepath.Join(pluginLoc, pattern))
+
+	orphans := make([]pidFile, 0, len(files)+len(legacyFiles))
+	for _, file := range append(files, legacyFiles...) {
+		data, readErr := ioutil.ReadFile(file)
+		if readErr != nil {
+			continue
+		}
+		var orphan pidFile
+		unmarshalErr := json.Unmarshal(data, &orphan)
+		if unmarshalErr != nil || filepath.Dir(file) == filepath.Clean(pluginLoc) {
+			os.Remove(file)
+		}
+		if unmarshalErr != nil {
+			continue
+		}
+		orphans = append(orphans, orphan)
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Instance > orphans[j].Instance })
+	return orphans
+}
+
+/* Internal: find the plugin instances left over by a previous host in the discovered plugin location
+   and reattach or terminate them as per the orphan policy. Only the primary instance of a pool is
+   reattached, the other instances are terminated and the pool is started again */
+func (pluginReg *PluginReg) recoverOrphans() {
+	folders, err := ioutil.ReadDir(pluginReg.discoveredPluginLoc)
+	if err != nil {
+		log.ERROR.Printf("Failed to read discovered plugin location: %v", err)
+		return
+	}
+
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		pluginLoc := filepath.Join(pluginReg.discoveredPluginLoc, folder.Name())
+		for _, orphan := range readPidFiles(pluginLoc) {
+			pluginReg.recoverOrphan(pluginLoc, orphan)
+		}
+	}
+}
+
+// Internal: reattach or terminate a single leftover plugin instance
+func (pluginReg *PluginReg) recoverOrphan(pluginLoc string, orphan pidFile) {
+	folder := filepath.Base(pluginLoc)
+	// The instance is managed by another running host
+	if orphan.HostPid != os.Getpid() && processAlive(orphan.HostPid) {
+		log.INFO.Printf("Plugin %s is managed by the running host %d", folder, orphan.HostPid)
+		return
+	}
+
+	if !processAlive(orphan.Pid) {
+		log.INFO.Printf("Removing stale plugin instance files of %s", folder)
+		cleanupOrphan(pluginLoc, orphan)
+		return
+	}
+
+	if pluginReg.orphanPolicy == OrphanReattach && orphan.Instance == 0 {
+		plugin, reattachErr := pluginReg.reattachPlugin(pluginLoc, orphan)
+		if reattachErr == nil {
+			log.INFO.Printf("Reattached plugin %s (pid %d)", plugin.key, plugin.pid)
+			return
+		}
+		log.ERROR.Printf("Failed to reattach plugin %s: %v", folder, reattachErr)
+	}
+
+	// The pid of a stale pidfile could be reused by an unrelated process
+	if !pluginReg.verifyOrphan(pluginLoc, orphan) {
+		log.INFO.Printf("Process %d is not the plugin %s instance %d, removing stale plugin instance files", orphan.Pid, folder, orphan.Instance)
+		cleanupOrphan(pluginLoc, orphan)
+		return
+	}
+
+	log.INFO.Printf("Terminating orphan plugin %s instance %d (pid %d)", folder, orphan.Instance, orphan.Pid)
+	terminateOrphan(orphan.process())
+	cleanupOrphan(pluginLoc, orphan)
+}
+
+// Internal: get the reference of the orphan process as recorded in the pidfile
+func (orphan pidFile) process() processRef {
+	return processRef{pid: orphan.Pid, startTime: orphan.StartTime, exe: orphan.Exe}
+}
+
+// Internal: check that the orphan pid still runs the plugin instance of the pidfile. The process start
+// time is compared if recorded, else the instance is asked for its identity
+func (pluginReg *PluginReg) verifyOrphan(pluginLoc string, orphan pidFile) bool {
+	if orphan.StartTime != 0 {
+		if _, _, err := processIdentity(orphan.Pid); err == nil {
+			return orphan.process().alive()
+		}
+	}
+	plugin, connectErr := pluginReg.connectOrphan(pluginLoc, orphan)
+	if connectErr != nil {
+		log.DEBUG.Printf("Failed to verify the identity of process %d: %v", orphan.Pid, connectErr)
+		return false
+	}
+	plugin.pluginConn.Close()
+	return true
+}
+
+// Internal: connect to an orphan plugin instance and verify its identity
+func (pluginReg *PluginReg) connectOrphan(pluginLoc string, orphan pidFile) (*Plugin, error) {
+	plugin := &Plugin{}
+	plugin.key = filepath.Base(pluginLoc)
+	plugin.pluginloc = pluginLoc
+	plugin.registry = pluginReg
+	plugin.PluginSock = orphan.Sock
+	plugin.PluginUrl = orphan.Url
+	plugin.callbacks = make(map[string]bool)
+	plugin.pid = orphan.Pid
+	plugin.instanceId = orphan.InstanceId
+	plugin.secret = orphan.Secret
+	plugin.network = common.TransportUnix
+	if orphan.Network == common.TransportTcp && orphan.HostTls != nil {
+		tlsConfig, tlsErr := hostTlsConfig(orphan.HostTls)
+		if tlsErr != nil {
+			return nil, tlsErr
+		}
+		plugin.network = orphan.Network
+		plugin.hostTls = orphan.HostTls
+		plugin.tlsConfig = tlsConfig
+	}
+
+	pluginConn, connErr := plugin.newClient()
+	if connErr != nil {
+		return nil, PluginConnFailed
+	}
+	plugin.pluginConn = pluginConn
+	plugin.setConnected(true)
+
+	identity, identityErr := plugin.identity()
+	if identityErr != nil {
+		pluginConn.Close()
+		return nil, identityErr
+	}
+	if identity.InstanceId != orphan.InstanceId {
+		pluginConn.Close()
+		return nil, fmt.Errorf("Plugin identity mismatch: instance %s", identity.InstanceId)
+	}
+	// The plugin reports its pid in its own pid namespace (1 in a sandbox), the pid is verified on the host
+	if !orphan.process().alive() {
+		pluginConn.Close()
+		return nil, fmt.Errorf("Process %d is not the plugin instance %s", orphan.Pid, orphan.InstanceId)
+	}
+	return plugin, nil
+}
+
+// Internal: reattach to an orphan plugin instance once its identity is verified
+func (pluginReg *PluginReg) reattachPlugin(pluginLoc string, orphan pidFile) (*Plugin, error) {
+	plugin, connectErr := pluginReg.connectOrphan(pluginLoc, orphan)
+	if connectErr != nil {
+		return nil, connectErr
+	}
+	pluginConn := plugin.pluginConn
+
+	activateErr := plugin.activate()
+	if activateErr != nil {
+		pluginConn.Close()
+		return nil, activateErr
+	}
+
+	// Serve the host functions again on the socket the plugin knows
+	hostSockFile := filepath.Join(pluginLoc, PluginRunDir, HostSockFile)
+	fdSockFile := filepath.Join(pluginLoc, PluginRunDir, PluginFdSockFile)
+	if pluginReg.sandbox != nil {
+		dataDir, dataErr := pluginReg.prepareSandboxData(plugin)
+		if dataErr == nil {
+			plugin.dataDir = dataDir
+			hostSockFile = filepath.Join(dataDir, HostSockFile)
+			fdSockFile = filepath.Join(dataDir, PluginFdSockFile)
+		}
+	}
+	if plugin.network == common.TransportUnix {
+		plugin.fdSock, _ = filepath.Abs(fdSockFile)
+	}
+	hostErr := pluginReg.startHostServer(plugin, hostSockFile)
+	if hostErr != nil {
+		log.ERROR.Printf("Failed to serve the host functions to reattached plugin %s: %v", plugin.key, hostErr)
+	}
+
+	// The pidfile now belongs to this host
+	writePidFile(plugin)
+	go pluginReg.watchOrphan(plugin)
+	pluginReg.startHealthMonitor(plugin)
+
+	// Start the pool instances again
+	pluginConfig, confLoadErr := common.LoadPluginConfigs(filepath.Join(pluginLoc, DefaultPluginConfFile))
+	if confLoadErr == nil {
+		plugin.poolConf = common.MergePoolConf(pluginConfig.Pool, pluginReg.pool)
+	}
+	poolErr := pluginReg.startPool(plugin)
+	if poolErr != nil {
+		log.ERROR.Printf("Failed to start the pool of reattached plugin %s: %v", plugin.key, poolErr)
+	}
+	addErr := pluginReg.addPlugin(plugin)
+	if addErr != nil {
+		plugin.UnloadPlugin()
+		return nil, addErr
+	}
+	plugin.publishLoaded()
+
+	return plugin, nil
+}
+
+// Internal: reattached instance is not a child of the host, so it is polled till it terminates
+func (pluginReg *PluginReg) watchOrphan(plugin *Plugin) {
+	pid := plugin.processId()
+	process := newProcessRef(pid)
+	for process.alive() {
+		time.Sleep(DefaultInterval)
+	}
+
+	reason := TerminationExited
+	if plugin.isStopping() {
+		reason = TerminationStopped
+	}
+	log.INFO.Printf("Plugin %s process %d terminated: %s", plugin.key, pid, reason)
+	removePidFile(plugin.pluginloc, plugin.instance)
+
+	pluginReg.publish(PluginEvent{Type: PluginTerminatedEvent, Key: plugin.key, Pid: pid, Reason: reason})
+}
+
+// Internal: terminate an orphan process, it is killed if it doesn't exit in time
+func terminateOrphan(process processRef) {
+	process.signal(syscall.SIGTERM)
+	deadline := time.Now().Add(OrphanKillTimeout)
+	for process.alive() && time.Now().Before(deadline) {
+		time.Sleep(DefaultInterval / 5)
+	}
+	if process.alive() {
+		process.signal(syscall.SIGKILL)
+	}
+}
+
+// Internal: remove the stale socket and the pidfile of an orphan
+func cleanupOrphan(pluginLoc string, orphan pidFile) {
+	if orphan.Sock != "" && orphan.Network != common.TransportTcp {
+		os.Remove(orphan.Sock)
+	}
+	removePidFile(pluginLoc, orphan.Instance)
+}
+
+// Internal: get the identity of a running plugin instance
+func (plugin *Plugin) identity() (*pluginIdentity, error) {
+	pluginConn, pluginUrl := plugin.connection()
+	requestUrl := pluginUrl + "/" + common.ControlIdentity
+	request := &PluginConn.PluginRequest{Url: requestUrl, Body: nil}
+
+	resp, err := pluginConn.Request(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != "200 OK" {
+		return nil, fmt.Errorf("request failed. Status: %s", resp.Status)
+	}
+
+	identity := &pluginIdentity{}
+	unmarshalError := json.Unmarshal(resp.Body, identity)
+	if unmarshalError != nil {
+		return nil, fmt.Errorf("Json Unmarshal failed: %s", unmarshalError)
+	}
+	return identity, nil
+}
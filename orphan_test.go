@@ -0,0 +1,56 @@
+package pluginmanager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPidFileState(t *testing.T) {
+	pluginLocation := t.TempDir()
+	pluginLoc := filepath.Join(pluginLocation, DefaultDiscoveredPlugin, "ns_calc_1")
+	err := os.MkdirAll(pluginLoc, 0700)
+	if err != nil {
+		t.Fatalf("Failed to create the plugin folder: %v", err)
+	}
+	plugin := &Plugin{key: "ns_calc_1", pluginloc: pluginLoc, instance: 1, instanceId: "id", secret: "secret"}
+	err = writePidFile(plugin)
+	if err != nil {
+		t.Fatalf("Failed to write the pidfile: %v", err)
+	}
+
+	// The secret is kept out of the plugin folder
+	filepath.Walk(pluginLoc, func(path string, info os.FileInfo, err error) error {
+		data, _ := ioutil.ReadFile(path)
+		if strings.Contains(string(data), "secret") {
+			t.Errorf("The secret is stored in %s", path)
+		}
+		return nil
+	})
+	info, err := os.Stat(filepath.Join(pluginLocation, PluginStateDir))
+	if err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("State dir is %v, %v", info, err)
+	}
+
+	orphans := readPidFiles(pluginLoc)
+	if len(orphans) != 1 || orphans[0].InstanceId != "id" || orphans[0].Secret != "secret" {
+		t.Errorf("Read the pidfiles %v", orphans)
+	}
+	removePidFile(pluginLoc, 1)
+	if orphans = readPidFiles(pluginLoc); len(orphans) != 0 {
+		t.Errorf("The removed pidfile is read as %v", orphans)
+	}
+
+	// A pidfile left in the plugin folder by an earlier version is read once
+	legacy := filepath.Join(pluginLoc, PluginPidFile)
+	ioutil.WriteFile(legacy, []byte(`{"instanceid": "old", "secret": "secret"}`), 0600)
+	orphans = readPidFiles(pluginLoc)
+	if len(orphans) != 1 || orphans[0].InstanceId != "old" {
+		t.Errorf("Read the legacy pidfiles %v", orphans)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("The legacy pidfile is left in the plugin folder")
+	}
+}
@@ -0,0 +1,313 @@
+/* The arguments of a call are decoded into the parameter types of the method.
+ * The codecs decode generic values (int64, float64, string, []byte,
+ * []interface{}, map[string]interface{}), they are converted to the numbers,
+ * structs, slices, maps, times and byte slices the method takes. A missing,
+ * extra or mismatching argument fails the call with a bad arguments error
+ */
+
+package pluginlib
+
+import (
+	"context"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+)
+
+var (
+	// The type of context.Context, a method taking it as first argument gets the request context
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	// The types decoded from their text form (i.e. time.Time)
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+/* Internal Method: Decode the arguments of a method call. The request context and the stream writer
+   are passed to the method if it takes them. On failure the passed files are closed */
+func methodArgs(ctx context.Context, method reflect.Value, args []interface{}, writer *StreamWriter) ([]reflect.Value, error) {
+	methodType := method.Type()
+	argsspace := make([]reflect.Value, 0)
+	if methodType.NumIn() > len(argsspace) && methodType.In(len(argsspace)) == contextType {
+		argsspace = append(argsspace, reflect.ValueOf(ctx))
+	}
+	if writer != nil && methodType.NumIn() > len(argsspace) && methodType.In(len(argsspace)) == streamWriterType {
+		argsspace = append(argsspace, reflect.ValueOf(writer))
+	}
+
+	first := len(argsspace)
+	params := methodType.NumIn() - first
+	var err error
+	if methodType.IsVariadic() && len(args) < params-1 {
+		err = fmt.Errorf("takes at least %d arguments, %d given", params-1, len(args))
+	} else if !methodType.IsVariadic() && len(args) != params {
+		err = fmt.Errorf("takes %d arguments, %d given", params, len(args))
+	}
+	for i := 0; err == nil && i < len(args); i++ {
+		var value reflect.Value
+		value, err = decodeArg(args[i], paramType(methodType, first+i))
+		if err != nil {
+			err = fmt.Errorf("argument %d: %v", i+1, err)
+			break
+		}
+		argsspace = append(argsspace, value)
+	}
+	if err != nil {
+		closeFiles(args)
+		return nil, err
+	}
+
+	// The files are converted once all the arguments are decoded
+	for i := first; i < len(argsspace); i++ {
+		if argsspace[i].Type() == fileType {
+			value, convertErr := fileArg(argsspace[i].Interface().(*os.File), paramType(methodType, i))
+			if convertErr != nil {
+				closeFileArgs(argsspace[first:])
+				return nil, fmt.Errorf("argument %d: %v", i-first+1, convertErr)
+			}
+			argsspace[i] = value
+		}
+	}
+	return argsspace, nil
+}
+
+// Internal: get the type of a parameter, the extra arguments of a variadic method take the element type
+func paramType(methodType reflect.Type, i int) reflect.Type {
+	if methodType.IsVariadic() && i >= methodType.NumIn()-1 {
+		return methodType.In(methodType.NumIn() - 1).Elem()
+	}
+	return methodType.In(i)
+}
+
+// Internal: close the passed files of a failed call
+func closeFiles(args []interface{}) {
+	for _, arg := range args {
+		if file, ok := arg.(*os.File); ok {
+			file.Close()
+		}
+	}
+}
+
+// Internal: decode a value into a parameter type
+func decodeArg(arg interface{}, paramType reflect.Type) (reflect.Value, error) {
+	if arg == nil {
+		switch paramType.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			return reflect.Zero(paramType), nil
+		}
+		return reflect.Value{}, fmt.Errorf("nil can't be used as %s", paramType)
+	}
+
+	value := reflect.ValueOf(arg)
+	if value.Type() == fileType {
+		// A passed file is taken as a file, a connection or a listener
+		if paramType == fileType || paramType == connType || paramType == listenerType || fileType.AssignableTo(paramType) {
+			return value, nil
+		}
+		return reflect.Value{}, fmt.Errorf("a passed file can't be used as %s", paramType)
+	}
+	if value.Type().AssignableTo(paramType) {
+		return value, nil
+	}
+	if value.Kind() == reflect.Ptr && !value.IsNil() && value.Elem().Type().AssignableTo(paramType) {
+		// A blob could be taken by value
+		return value.Elem(), nil
+	}
+	if text, ok := arg.(string); ok && reflect.PtrTo(paramType).Implements(textUnmarshalerType) {
+		decoded := reflect.New(paramType)
+		err := decoded.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid %s: %v", paramType, err)
+		}
+		return decoded.Elem(), nil
+	}
+
+	switch paramType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return decodeInt(value, paramType)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return decodeUint(value, paramType)
+	case reflect.Float32, reflect.Float64:
+		switch value.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return value.Convert(paramType), nil
+		}
+	case reflect.String, reflect.Bool:
+		if value.Kind() == paramType.Kind() {
+			return value.Convert(paramType), nil
+		}
+	case reflect.Slice:
+		if paramType.Elem().Kind() == reflect.Uint8 {
+			return decodeBytes(value, paramType)
+		}
+		if items, ok := arg.([]interface{}); ok {
+			decoded := reflect.MakeSlice(paramType, len(items), len(items))
+			return decoded, decodeItems(decoded, items)
+		}
+	case reflect.Array:
+		if items, ok := arg.([]interface{}); ok {
+			if len(items) != paramType.Len() {
+				return reflect.Value{}, fmt.Errorf("%d items can't be used as %s", len(items), paramType)
+			}
+			decoded := reflect.New(paramType).Elem()
+			return decoded, decodeItems(decoded, items)
+		}
+	case reflect.Map:
+		if entries, ok := arg.(map[string]interface{}); ok {
+			return decodeMap(entries, paramType)
+		}
+	case reflect.Struct:
+		if _, ok := arg.(map[string]interface{}); ok {
+			return decodeStruct(arg, paramType)
+		}
+	case reflect.Ptr:
+		elem, err := decodeArg(arg, paramType.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		decoded := reflect.New(paramType.Elem())
+		decoded.Elem().Set(elem)
+		return decoded, nil
+	}
+	return reflect.Value{}, fmt.Errorf("%s can't be used as %s", value.Type(), paramType)
+}
+
+// Internal: decode a signed integer, the value must be integral and fit in the type (gob keeps
+// the sent integer types, the other codecs decode int64)
+func decodeInt(value reflect.Value, paramType reflect.Type) (reflect.Value, error) {
+	var integer int64
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		integer = value.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if value.Uint() > 1<<63-1 {
+			return reflect.Value{}, fmt.Errorf("%d overflows %s", value.Uint(), paramType)
+		}
+		integer = int64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		float := value.Float()
+		if float != float64(int64(float)) {
+			return reflect.Value{}, fmt.Errorf("%g is not an integer", float)
+		}
+		integer = int64(float)
+	default:
+		return reflect.Value{}, fmt.Errorf("%s can't be used as %s", value.Type(), paramType)
+	}
+	decoded := reflect.New(paramType).Elem()
+	if decoded.OverflowInt(integer) {
+		return reflect.Value{}, fmt.Errorf("%d overflows %s", integer, paramType)
+	}
+	decoded.SetInt(integer)
+	return decoded, nil
+}
+
+// Internal: decode an unsigned integer, the value must be integral, positive and fit in the type
+func decodeUint(value reflect.Value, paramType reflect.Type) (reflect.Value, error) {
+	var integer uint64
+	switch value.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		integer = value.Uint()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Int() < 0 {
+			return reflect.Value{}, fmt.Errorf("%d is negative for %s", value.Int(), paramType)
+		}
+		integer = uint64(value.Int())
+	case reflect.Float32, reflect.Float64:
+		float := value.Float()
+		if float < 0 || float != float64(uint64(float)) {
+			return reflect.Value{}, fmt.Errorf("%g is not a positive integer", float)
+		}
+		integer = uint64(float)
+	default:
+		return reflect.Value{}, fmt.Errorf("%s can't be used as %s", value.Type(), paramType)
+	}
+	decoded := reflect.New(paramType).Elem()
+	if decoded.OverflowUint(integer) {
+		return reflect.Value{}, fmt.Errorf("%d overflows %s", integer, paramType)
+	}
+	decoded.SetUint(integer)
+	return decoded, nil
+}
+
+// Internal: decode a byte slice, json sends the bytes as base64
+func decodeBytes(value reflect.Value, paramType reflect.Type) (reflect.Value, error) {
+	switch data := value.Interface().(type) {
+	case []byte:
+		return reflect.ValueOf(data).Convert(paramType), nil
+	case string:
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid base64 bytes: %v", err)
+		}
+		return reflect.ValueOf(decoded).Convert(paramType), nil
+	}
+	return reflect.Value{}, fmt.Errorf("%s can't be used as %s", value.Type(), paramType)
+}
+
+// Internal: decode the items of a slice or an array
+func decodeItems(decoded reflect.Value, items []interface{}) error {
+	for i, item := range items {
+		value, err := decodeArg(item, decoded.Type().Elem())
+		if err != nil {
+			return fmt.Errorf("item %d: %v", i, err)
+		}
+		decoded.Index(i).Set(value)
+	}
+	return nil
+}
+
+// Internal: decode a map, the keys are sent as strings
+func decodeMap(entries map[string]interface{}, paramType reflect.Type) (reflect.Value, error) {
+	decoded := reflect.MakeMapWithSize(paramType, len(entries))
+	for key, entry := range entries {
+		keyValue, err := decodeKey(key, paramType.Key())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		value, err := decodeArg(entry, paramType.Elem())
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("key %q: %v", key, err)
+		}
+		decoded.SetMapIndex(keyValue, value)
+	}
+	return decoded, nil
+}
+
+// Internal: decode a map key, integer keys are parsed from the string
+func decodeKey(key string, keyType reflect.Type) (reflect.Value, error) {
+	switch keyType.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(key).Convert(keyType), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		integer, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("key %q can't be used as %s", key, keyType)
+		}
+		return decodeInt(reflect.ValueOf(integer), keyType)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		integer, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("key %q can't be used as %s", key, keyType)
+		}
+		return decodeUint(reflect.ValueOf(integer), keyType)
+	}
+	return reflect.Value{}, fmt.Errorf("map key type %s is not supported", keyType)
+}
+
+// Internal: decode a struct from its fields, the fields are matched as in encoding/json (json tags)
+func decodeStruct(arg interface{}, paramType reflect.Type) (reflect.Value, error) {
+	data, err := json.Marshal(arg)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("%s can't be decoded: %v", paramType, err)
+	}
+	decoded := reflect.New(paramType)
+	err = json.Unmarshal(data, decoded.Interface())
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("%s can't be decoded: %v", paramType, err)
+	}
+	return decoded.Elem(), nil
+}
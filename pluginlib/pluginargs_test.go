@@ -0,0 +1,110 @@
+package pluginlib
+
+import (
+	"context"
+	common "github.com/swarvanusg/GoPlug/common"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type argsPoint struct {
+	X     int    `json:"x"`
+	Label string `json:"label,omitempty"`
+}
+
+// The methods the arguments are decoded for
+type argsObject struct{}
+
+func (argsObject) Add(a int, b int8) int { return a + int(b) }
+
+func (argsObject) Scale(ctx context.Context, factor float64, values ...uint16) {}
+
+func (argsObject) Shape(point argsPoint, ptr *argsPoint, when time.Time, tags map[int]string, data []byte, pair [2]string) {
+}
+
+// Internal: decode the arguments as the plugin receives them from a json host
+func decodeArgs(t *testing.T, name string, args ...interface{}) ([]reflect.Value, error) {
+	codec := common.JsonCodec{}
+	data, err := codec.Encode(args)
+	if err != nil {
+		t.Fatalf("Failed to encode the arguments: %v", err)
+	}
+	decoded, err := codec.Decode(data)
+	if err != nil {
+		t.Fatalf("Failed to decode the arguments: %v", err)
+	}
+	method := reflect.ValueOf(argsObject{}).MethodByName(name)
+	return methodArgs(context.Background(), method, decoded, nil)
+}
+
+func TestMethodArgs(t *testing.T) {
+	values, err := decodeArgs(t, "Add", 40, 2)
+	if err != nil {
+		t.Fatalf("Add: unexpected error %v", err)
+	}
+	if values[0].Interface() != 40 || values[1].Interface() != int8(2) {
+		t.Errorf("Add: decoded %v", values)
+	}
+
+	values, err = decodeArgs(t, "Scale", 1.5, 1, 2)
+	if err != nil {
+		t.Fatalf("Scale: unexpected error %v", err)
+	}
+	if len(values) != 4 || values[1].Interface() != 1.5 || values[3].Interface() != uint16(2) {
+		t.Errorf("Scale: decoded %v", values)
+	}
+	if _, ok := values[0].Interface().(context.Context); !ok {
+		t.Errorf("Scale: the request context is not passed first")
+	}
+
+	when := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	point := argsPoint{X: 3, Label: "p"}
+	values, err = decodeArgs(t, "Shape", point, point, when, map[int]string{7: "seven"}, []byte("bytes"), []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("Shape: unexpected error %v", err)
+	}
+	expected := []interface{}{point, &point, when, map[int]string{7: "seven"}, []byte("bytes"), [2]string{"a", "b"}}
+	for i, value := range values {
+		if !reflect.DeepEqual(value.Interface(), expected[i]) {
+			t.Errorf("Shape argument %d: decoded %#v, expected %#v", i+1, value.Interface(), expected[i])
+		}
+	}
+}
+
+// Internal: the valid arguments of Shape with the argument at index replaced
+func shapeArgs(index int, arg interface{}) []interface{} {
+	args := []interface{}{argsPoint{X: 1}, nil, "2024-01-02T03:04:05Z", nil, nil, []string{"a", "b"}}
+	args[index] = arg
+	return args
+}
+
+func TestMethodArgsErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		args []interface{}
+		err  string
+	}{
+		{"Add", []interface{}{1}, "takes 2 arguments, 1 given"},
+		{"Add", []interface{}{1, 2, 3}, "takes 2 arguments, 3 given"},
+		{"Add", []interface{}{1, 300}, "argument 2: 300 overflows int8"},
+		{"Add", []interface{}{1.5, 2}, "argument 1: 1.5 is not an integer"},
+		{"Add", []interface{}{"1", 2}, "argument 1: string can't be used as int"},
+		{"Add", []interface{}{nil, 2}, "argument 1: nil can't be used as int"},
+		{"Scale", []interface{}{}, "takes at least 1 arguments, 0 given"},
+		{"Scale", []interface{}{1, -1}, "argument 2: -1 is negative for uint16"},
+		{"Shape", shapeArgs(0, 1), "argument 1: int64 can't be used as pluginlib.argsPoint"},
+		{"Shape", shapeArgs(0, nil), "argument 1: nil can't be used as pluginlib.argsPoint"},
+		{"Shape", shapeArgs(2, "yesterday"), "argument 3: invalid time.Time"},
+		{"Shape", shapeArgs(3, map[string]interface{}{"x": ""}), `argument 4: key "x" can't be used as int`},
+		{"Shape", shapeArgs(4, "not base64"), "argument 5: invalid base64 bytes"},
+		{"Shape", shapeArgs(5, []string{"a"}), "argument 6: 1 items can't be used as [2]string"},
+	}
+	for _, test := range cases {
+		_, err := decodeArgs(t, test.name, test.args...)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s%v: got error %v, expected %q", test.name, test.args, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/* The plugin publishes a descriptor of each method for the host. The parameter
+ * and result schemas are built from the method signature, the documentation,
+ * the parameter names and the idempotency and deprecation are given with
+ * DescribeMethod
+ */
+
+package pluginlib
+
+import (
+	common "github.com/swarvanusg/GoPlug/common"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+/* The documentation and the properties of a method published to the host */
+type MethodInfo struct {
+	// The method documentation
+	Doc string
+	// The parameter names, the request context and the stream writer are not named
+	Params []string
+	// The method could be retried safely
+	Idempotent bool
+	// The deprecation notice, the method is deprecated if set
+	Deprecated string
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	blobType = reflect.TypeOf(common.Blob{})
+)
+
+/* Describe a method to the host. It should be called before starting the plugin */
+func (plugin *Plugin) DescribeMethod(name string, info MethodInfo) {
+	if plugin.methodInfo == nil {
+		plugin.methodInfo = make(map[string]MethodInfo)
+	}
+	plugin.methodInfo[name] = info
+}
+
+// Internal: get the descriptors of the methods exposed to the host
+func (plugin *Plugin) describeMethods() []common.MethodDescriptor {
+	object := reflect.ValueOf(plugin.methodObject)
+	descriptors := make([]common.MethodDescriptor, 0)
+	for _, name := range plugin.exposedMethods() {
+		method := object.MethodByName(name)
+		if !method.IsValid() {
+			continue
+		}
+		descriptors = append(descriptors, describeMethod(name, method.Type(), plugin.methodInfo[name]))
+	}
+	return descriptors
+}
+
+// Internal: build the descriptor of a method from its signature
+func describeMethod(name string, methodType reflect.Type, info MethodInfo) common.MethodDescriptor {
+	descriptor := common.MethodDescriptor{Name: name, Doc: info.Doc, Idempotent: info.Idempotent,
+		Deprecated: info.Deprecated, Variadic: methodType.IsVariadic()}
+	descriptor.Params = make([]common.ParamDescriptor, 0)
+	descriptor.Results = make([]common.Schema, 0)
+
+	first := 0
+	if methodType.NumIn() > first && methodType.In(first) == contextType {
+		first++
+	}
+	if methodType.NumIn() > first && methodType.In(first) == streamWriterType {
+		descriptor.Stream = true
+		first++
+	}
+	for i := first; i < methodType.NumIn(); i++ {
+		param := common.ParamDescriptor{Schema: typeSchema(paramType(methodType, i), nil)}
+		if i-first < len(info.Params) {
+			param.Name = info.Params[i-first]
+		}
+		descriptor.Params = append(descriptor.Params, param)
+	}
+
+	for i := 0; i < methodType.NumOut(); i++ {
+		resultType := methodType.Out(i)
+		if i == methodType.NumOut()-1 && resultType == errorType {
+			break
+		}
+		if i == 0 && resultType.Kind() == reflect.Chan {
+			descriptor.Stream = true
+			descriptor.StreamItem = typeSchema(resultType.Elem(), nil)
+			continue
+		}
+		descriptor.Results = append(descriptor.Results, typeSchema(resultType, nil))
+	}
+	return descriptor
+}
+
+// Internal: build the JSON Schema of a type as it is sent by the codecs. seen holds the structs
+// being described, a recursive struct is described as any value
+func typeSchema(valueType reflect.Type, seen map[reflect.Type]bool) common.Schema {
+	switch valueType {
+	case fileType, connType, listenerType:
+		return common.Schema{common.SchemaKindKey: common.FdKindFile}
+	case blobType, reflect.PtrTo(blobType):
+		return common.Schema{common.SchemaKindKey: common.FdKindBlob}
+	case timeType:
+		return common.Schema{"type": "string", "format": "date-time"}
+	}
+	if reflect.PtrTo(valueType).Implements(textUnmarshalerType) && valueType.Kind() != reflect.Struct {
+		return common.Schema{"type": "string"}
+	}
+
+	switch valueType.Kind() {
+	case reflect.Bool:
+		return common.Schema{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		bits := uint(valueType.Bits())
+		return common.Schema{"type": "integer", "minimum": -float64(int64(1) << (bits - 1)), "maximum": float64(int64(1)<<(bits-1) - 1)}
+	case reflect.Int, reflect.Int64:
+		return common.Schema{"type": "integer"}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return common.Schema{"type": "integer", "minimum": 0, "maximum": float64(uint64(1)<<uint(valueType.Bits()) - 1)}
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		return common.Schema{"type": "integer", "minimum": 0}
+	case reflect.Float32:
+		return common.Schema{"type": "number", "minimum": -math.MaxFloat32, "maximum": math.MaxFloat32}
+	case reflect.Float64:
+		return common.Schema{"type": "number"}
+	case reflect.String:
+		return common.Schema{"type": "string"}
+	case reflect.Slice:
+		if valueType.Elem().Kind() == reflect.Uint8 {
+			return nullable(common.Schema{"type": "string", "contentEncoding": "base64"})
+		}
+		return nullable(common.Schema{"type": "array", "items": typeSchema(valueType.Elem(), seen)})
+	case reflect.Array:
+		return common.Schema{"type": "array", "items": typeSchema(valueType.Elem(), seen),
+			"minItems": valueType.Len(), "maxItems": valueType.Len()}
+	case reflect.Map:
+		return nullable(common.Schema{"type": "object", "additionalProperties": typeSchema(valueType.Elem(), seen)})
+	case reflect.Ptr:
+		return nullable(typeSchema(valueType.Elem(), seen))
+	case reflect.Struct:
+		if seen[valueType] {
+			return common.Schema{}
+		}
+		if seen == nil {
+			seen = make(map[reflect.Type]bool)
+		}
+		seen[valueType] = true
+		defer delete(seen, valueType)
+		properties := make(map[string]interface{})
+		structProperties(valueType, seen, properties)
+		return common.Schema{"type": "object", "properties": properties}
+	}
+	// interface{} and the types the codecs can't send take any value
+	return common.Schema{}
+}
+
+// Internal: add the fields of a struct as encoding/json names them, embedded structs are flattened
+func structProperties(structType reflect.Type, seen map[reflect.Type]bool, properties map[string]interface{}) {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			structProperties(field.Type, seen, properties)
+			continue
+		}
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = typeSchema(field.Type, seen)
+	}
+}
+
+// Internal: allow null for a schema of a single type
+func nullable(schema common.Schema) common.Schema {
+	if kind, ok := schema["type"].(string); ok {
+		schema["type"] = []string{kind, "null"}
+	}
+	return schema
+}
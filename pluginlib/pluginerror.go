@@ -0,0 +1,96 @@
+/* The errors of a method call are sent to the host as an error envelope.
+ * A returned error is sent with the plugin_error code, a method could return a
+ * *common.ErrorEnvelope (or wrap one) to set the code, details and retryable
+ * flag. A panic is recovered per call and sent with its stack trace, the plugin
+ * keeps serving the other calls unless it is set to exit after a number of panics
+ */
+
+package pluginlib
+
+import (
+	"context"
+	"errors"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	"os"
+	"reflect"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The exit code of a plugin exiting after too many panics
+	PanicExitCode = 3
+)
+
+var (
+	// The time the response of the last panic gets to reach the host before the plugin exits
+	PanicExitDelay = 100 * time.Millisecond
+)
+
+/* Create an error a method could return to send details to the host */
+func NewError(message string, details map[string]interface{}, retryable bool) *common.ErrorEnvelope {
+	return &common.ErrorEnvelope{Code: common.ErrorPlugin, Message: message, Details: details, Retryable: retryable}
+}
+
+// Internal: get the envelope of an error returned by a method
+func methodError(err error) *common.ErrorEnvelope {
+	var envelope *common.ErrorEnvelope
+	if errors.As(err, &envelope) {
+		return envelope
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &common.ErrorEnvelope{Code: common.ErrorTimeout, Message: err.Error(), Retryable: true}
+	}
+	return &common.ErrorEnvelope{Code: common.ErrorPlugin, Message: err.Error()}
+}
+
+// Internal: get the envelope of a recovered panic, it must be called in the deferred recover
+func panicError(method string, recovered interface{}) *common.ErrorEnvelope {
+	stack := string(debug.Stack())
+	log.ERROR.Printf("Method %s panicked: %v\n%s", method, recovered, stack)
+	envelope := common.NewErrorEnvelope(common.ErrorPanic, "Method %s panicked: %v", method, recovered)
+	envelope.Stack = stack
+	return envelope
+}
+
+// Internal: get the error result of a method, nil if it has no trailing error or it is nil
+func resultError(values []reflect.Value) error {
+	if len(values) == 0 {
+		return nil
+	}
+	last := values[len(values)-1]
+	if last.Type() != errorType || last.IsNil() {
+		return nil
+	}
+	return last.Interface().(error)
+}
+
+/* Make the plugin exit after a number of recovered method panics, so that the registry restarts
+   it in a clean state. The plugin never exits on panics if max is 0 (default) */
+func (plugin *Plugin) SetMaxPanics(max int) {
+	atomic.StoreInt64(&plugin.maxPanics, int64(max))
+}
+
+/* Get the number of method panics recovered by the plugin */
+func (plugin *Plugin) Panics() int64 {
+	return atomic.LoadInt64(&plugin.panics)
+}
+
+// Internal: count a recovered panic, the plugin exits once the max panics is reached
+func (plugin *Plugin) recordPanic() {
+	panics := atomic.AddInt64(&plugin.panics, 1)
+	max := atomic.LoadInt64(&plugin.maxPanics)
+	if max <= 0 || panics < max {
+		return
+	}
+	plugin.panicExit.Do(func() {
+		log.ERROR.Printf("Plugin exits after %d method panics", panics)
+		go func() {
+			time.Sleep(PanicExitDelay)
+			plugin.Stop()
+			os.Exit(PanicExitCode)
+		}()
+	})
+}
@@ -0,0 +1,248 @@
+/* The plugin receives the file descriptors passed by the host on its fd socket.
+ * A method call refers to a descriptor by id, the descriptor may arrive just
+ * before or after the call so the call waits for it for a short time.
+ *
+ * A method gets a passed file as an *os.File, net.Conn or net.Listener argument.
+ * The method owns it and must close it, the library closes it only if the call
+ * fails before the method is invoked
+ */
+
+package pluginlib
+
+import (
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	// The time a call waits for a referenced file descriptor
+	FdWaitTimeout = 5 * time.Second
+	// The time a received file descriptor is kept if no call claims it
+	FdClaimTimeout = time.Minute
+)
+
+// The file descriptors received from the host by id
+type fdTable struct {
+	pending map[string]chan *os.File
+	access  sync.Mutex
+}
+
+var receivedFds = &fdTable{pending: make(map[string]chan *os.File)}
+
+// Internal: get the channel a descriptor is delivered on (called with the access lock held)
+func (table *fdTable) channel(id string) chan *os.File {
+	channel, ok := table.pending[id]
+	if !ok {
+		channel = make(chan *os.File, 1)
+		table.pending[id] = channel
+	}
+	return channel
+}
+
+// Internal: store a received descriptor, it is closed if no call claims it. It is delivered under the
+// lock so that a call giving up on it either gets it or leaves it to the claim timeout
+func (table *fdTable) put(id string, file *os.File) {
+	table.access.Lock()
+	select {
+	case table.channel(id) <- file:
+		table.access.Unlock()
+	default:
+		table.access.Unlock()
+		log.ERROR.Printf("Duplicate file descriptor id %s", id)
+		file.Close()
+		return
+	}
+	time.AfterFunc(FdClaimTimeout, func() {
+		table.access.Lock()
+		defer table.access.Unlock()
+
+		channel, ok := table.pending[id]
+		if !ok {
+			return
+		}
+		select {
+		case unclaimed := <-channel:
+			delete(table.pending, id)
+			unclaimed.Close()
+		default:
+		}
+	})
+}
+
+// Internal: wait for a descriptor, the caller owns the returned file
+func (table *fdTable) take(id string, timeout time.Duration) (*os.File, error) {
+	table.access.Lock()
+	channel := table.channel(id)
+	table.access.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var file *os.File
+	select {
+	case file = <-channel:
+	case <-timer.C:
+	}
+
+	table.access.Lock()
+	if file == nil {
+		// The descriptor delivered after the timeout is not claimed by any call
+		select {
+		case late := <-channel:
+			late.Close()
+		default:
+		}
+	}
+	delete(table.pending, id)
+	table.access.Unlock()
+
+	if file == nil {
+		return nil, fmt.Errorf("File descriptor %s was not received", id)
+	}
+	return file, nil
+}
+
+// Internal: receive the descriptors passed by the host on the fd socket
+func startFdServer(sockFile string, secret string) (net.Listener, error) {
+	listener, err := PluginConn.ListenFdConn(sockFile)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			fdConn, acceptErr := PluginConn.AcceptFdConn(listener)
+			if acceptErr != nil {
+				return
+			}
+			go receiveFds(fdConn, secret)
+		}
+	}()
+	return listener, nil
+}
+
+// Internal: receive the descriptors of a connection till it is closed
+func receiveFds(fdConn *PluginConn.FdConn, secret string) {
+	defer fdConn.Close()
+	authErr := fdConn.Authenticate(secret, FdWaitTimeout)
+	if authErr != nil {
+		log.ERROR.Printf("Rejected fd connection: %v", authErr)
+		return
+	}
+	for {
+		id, files, err := fdConn.RecvFds()
+		if err != nil {
+			return
+		}
+		if len(files) != 1 {
+			log.ERROR.Printf("Expected one file descriptor for %s, received %d", id, len(files))
+			for _, file := range files {
+				file.Close()
+			}
+			continue
+		}
+		receivedFds.put(id, files[0])
+	}
+}
+
+/* Internal Method: Replace the blob and the file references of the arguments with the blobs
+   and the received files. The returned function releases the mapped blobs once the method returns */
+func resolveArgs(args []interface{}) ([]interface{}, func(), error) {
+	blobs := make([]*common.Blob, 0)
+	files := make([]*os.File, 0)
+	release := func() {
+		for _, blob := range blobs {
+			blob.Release()
+		}
+	}
+	// Called on failure, the method doesn't get the files
+	abort := func() {
+		release()
+		for _, file := range files {
+			file.Close()
+		}
+	}
+
+	for i, arg := range args {
+		if data, ok := common.ParseInlineBlob(arg); ok {
+			args[i] = common.NewBlob(data)
+			continue
+		}
+		id, kind, ok := common.ParseFdRef(arg)
+		if !ok {
+			continue
+		}
+		file, err := receivedFds.take(id, FdWaitTimeout)
+		if err != nil {
+			abort()
+			return nil, nil, err
+		}
+		switch kind {
+		case common.FdKindBlob:
+			// The mapping stays valid after the descriptor is closed
+			blob, mapErr := common.MapBlob(file)
+			file.Close()
+			if mapErr != nil {
+				abort()
+				return nil, nil, mapErr
+			}
+			blobs = append(blobs, blob)
+			args[i] = blob
+		case common.FdKindFile:
+			files = append(files, file)
+			args[i] = file
+		default:
+			file.Close()
+			abort()
+			return nil, nil, fmt.Errorf("Unknown file descriptor kind %q", kind)
+		}
+	}
+	return args, release, nil
+}
+
+// The argument types a passed file could be taken as
+var (
+	fileType     = reflect.TypeOf(&os.File{})
+	connType     = reflect.TypeOf((*net.Conn)(nil)).Elem()
+	listenerType = reflect.TypeOf((*net.Listener)(nil)).Elem()
+)
+
+/* Internal Method: Convert a received file to the parameter type of the method. A socket taken
+   as net.Conn or net.Listener is converted and its file is closed (the connection has its own).
+   A file that is not a socket of the type fails the call */
+func fileArg(file *os.File, paramType reflect.Type) (reflect.Value, error) {
+	var converted interface{}
+	var err error
+	switch paramType {
+	case connType:
+		converted, err = net.FileConn(file)
+	case listenerType:
+		converted, err = net.FileListener(file)
+	default:
+		return reflect.ValueOf(file), nil
+	}
+	file.Close()
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("the passed file can't be used as %s: %v", paramType, err)
+	}
+	return reflect.ValueOf(converted), nil
+}
+
+// Internal: close the passed files, connections and listeners of a failed call
+func closeFileArgs(values []reflect.Value) {
+	for _, value := range values {
+		switch arg := value.Interface().(type) {
+		case *os.File:
+			arg.Close()
+		case net.Conn:
+			arg.Close()
+		case net.Listener:
+			arg.Close()
+		}
+	}
+}
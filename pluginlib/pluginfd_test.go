@@ -0,0 +1,118 @@
+package pluginlib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (argsObject) Serve(conn net.Conn, data *os.File) {}
+
+// Internal: create a regular file to pass
+func passedFile(t *testing.T) *os.File {
+	file, err := os.Create(filepath.Join(t.TempDir(), "passed"))
+	if err != nil {
+		t.Fatalf("Failed to create the file: %v", err)
+	}
+	return file
+}
+
+// Internal: check that a file is closed
+func isClosed(file *os.File) bool {
+	_, err := file.Write([]byte("x"))
+	return errors.Is(err, os.ErrClosed)
+}
+
+func TestFdTake(t *testing.T) {
+	table := &fdTable{pending: make(map[string]chan *os.File)}
+	file := passedFile(t)
+	table.put("fd1", file)
+	taken, err := table.take("fd1", time.Second)
+	if err != nil || taken != file {
+		t.Fatalf("Took %v, %v", taken, err)
+	}
+	defer file.Close()
+
+	_, err = table.take("fd2", 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "fd2 was not received") {
+		t.Errorf("Missing descriptor: got error %v", err)
+	}
+	if len(table.pending) != 0 {
+		t.Errorf("Pending descriptors left: %v", table.pending)
+	}
+}
+
+func TestFdTakeLate(t *testing.T) {
+	table := &fdTable{pending: make(map[string]chan *os.File)}
+	taken := make(chan error)
+	go func() {
+		_, err := table.take("fd1", 20*time.Millisecond)
+		taken <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	// The descriptor is delivered once the call has timed out, before it removes the pending entry
+	table.access.Lock()
+	channel := table.pending["fd1"]
+	time.Sleep(40 * time.Millisecond)
+	late := passedFile(t)
+	channel <- late
+	table.access.Unlock()
+
+	if err := <-taken; err == nil {
+		t.Fatalf("The timed out call got the descriptor")
+	}
+	if !isClosed(late) {
+		t.Errorf("The late descriptor is left open")
+	}
+	if len(table.pending) != 0 {
+		t.Errorf("Pending descriptors left: %v", table.pending)
+	}
+}
+
+func TestFileArgs(t *testing.T) {
+	method := reflect.ValueOf(argsObject{}).MethodByName("Serve")
+
+	// A regular file can't be taken as a connection, the passed files are closed
+	conn := passedFile(t)
+	data := passedFile(t)
+	_, err := methodArgs(context.Background(), method, []interface{}{conn, data}, nil)
+	if err == nil || !strings.Contains(err.Error(), "argument 1: the passed file can't be used as net.Conn") {
+		t.Errorf("Got error %v", err)
+	}
+	if !isClosed(conn) || !isClosed(data) {
+		t.Errorf("The passed files of the failed call are left open")
+	}
+
+	// A socket is taken as a connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer dialed.Close()
+	socket, err := dialed.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatalf("Failed to get the socket file: %v", err)
+	}
+	data = passedFile(t)
+	defer data.Close()
+	values, err := methodArgs(context.Background(), method, []interface{}{socket, data}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, ok := values[0].Interface().(net.Conn); !ok || values[1].Interface() != data {
+		t.Errorf("Converted the arguments to %v", values)
+	}
+	values[0].Interface().(net.Conn).Close()
+}
@@ -0,0 +1,75 @@
+/* Host client lets the plugin call the functions exposed by the host
+ */
+
+package pluginlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"sync"
+)
+
+// The url the host functions are called on
+const hostUrl = "unix://host"
+
+// The response of a host function call
+type hostResponse struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// The connection to the host, created on the first call
+var hostConn *PluginConn.PluginClient
+var hostAccess sync.Mutex
+
+/* Call a function exposed by the host. The call is synchronous and returns the function
+   result or the error of the function */
+func (plugin *Plugin) CallHost(name string, args ...interface{}) (interface{}, error) {
+	return plugin.CallHostContext(context.Background(), name, args...)
+}
+
+/* Call a function exposed by the host with a context */
+func (plugin *Plugin) CallHostContext(ctx context.Context, name string, args ...interface{}) (interface{}, error) {
+	conn, err := plugin.hostClient()
+	if err != nil {
+		return nil, err
+	}
+
+	request := &PluginConn.PluginRequest{Url: hostUrl + "/" + name, Body: common.CreateJson(args...)}
+	resp, err := conn.RequestContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to call host function %s: %v", name, err)
+	}
+
+	response := hostResponse{}
+	unmarshalError := json.Unmarshal(resp.Body, &response)
+	if unmarshalError != nil {
+		return nil, fmt.Errorf("Json Unmarshal failed: %s", unmarshalError)
+	}
+	if resp.Status != "200 OK" {
+		return nil, fmt.Errorf("Host function %s failed: %s", name, response.Error)
+	}
+	return response.Result, nil
+}
+
+// Internal: get the connection to the host
+func (plugin *Plugin) hostClient() (*PluginConn.PluginClient, error) {
+	hostAccess.Lock()
+	defer hostAccess.Unlock()
+
+	if hostConn != nil {
+		return hostConn, nil
+	}
+	if plugin.conf.HostSock == "" {
+		return nil, fmt.Errorf("Host functions are not available")
+	}
+	conn, err := PluginConn.NewAuthPluginClient(plugin.conf.HostSock, plugin.secret)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to the host: %v", err)
+	}
+	hostConn = conn
+	return hostConn, nil
+}
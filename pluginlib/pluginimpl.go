@@ -4,6 +4,7 @@
 package pluginlib
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/spf13/jwalterweatherman"
@@ -11,8 +12,13 @@ import (
 	common "github.com/swarvanusg/GoPlug/common"
 	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Plugintype interface {
@@ -24,6 +30,14 @@ type Plugintype interface {
 	Stop() error
 }
 
+/* The health report of a plugin sent to the registry on readiness check */
+type HealthReport struct {
+	// Plugin is ready to serve requests
+	Ready bool `json:"ready"`
+	// The custom health details
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
 /* The Plugin Implentaion Struct to represent a Plugin, provides all the methods to be implemented */
 type Plugin struct {
 	pluginServer   *PluginConn.PluginServer
@@ -31,11 +45,25 @@ type Plugin struct {
 	methodObject   interface{}
 	conf           *common.RuntimeConf
 	started        bool
+	healthCheck    func() HealthReport
+	// The secret of the instance given by the registry
+	secret string
+	// The listener receiving the file descriptors passed by the host
+	fdListener net.Listener
+	// The recovered method panics and the number of panics the plugin exits after (0 never)
+	panics    int64
+	maxPanics int64
+	panicExit sync.Once
+	// The method information given with DescribeMethod
+	methodInfo map[string]MethodInfo
 }
 
 // channel list per callback that are registered
 var channelMap map[string]chan []byte
 
+// The mutex to sync the channel map access (requests are served concurrently)
+var channelAccess sync.Mutex
+
 /* Initialize a plugin as per the provided plugin implementation configuration.
    It returns a pointer to a Plugin that is used to perfom different operation
    on the implementde plugin */
@@ -43,8 +71,12 @@ func PluginInit(plugin Plugintype) (*Plugin, error) {
 
 	var plugin = &Plugin{}
 
-	// Load the plugin runtime conf from pluginPath
-	pluginConf, err := common.LoadRuntimeConfigs(DefaultPluginConfFile)
+	// Load the plugin runtime conf, the registry sets the conf file of the instance in environment
+	confFile := os.Getenv(common.RuntimeConfEnv)
+	if confFile == "" {
+		confFile = DefaultPluginConfFile
+	}
+	pluginConf, err := common.LoadRuntimeConfigs(confFile)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load the config file")
 	}
@@ -63,6 +95,10 @@ func PluginInit(plugin Plugintype) (*Plugin, error) {
 
 	plugin.conf = &pluginConf
 
+	// Take the secret out of the environment so that it is not passed to the child processes
+	plugin.secret = os.Getenv(common.AuthSecretEnv)
+	os.Unsetenv(common.AuthSecretEnv)
+
 	return plugin, nil
 }
 
@@ -87,7 +123,9 @@ func callbackExecute(data []byte) []byte {
 	channel := make(chan []byte, 0)
 
 	// Put the channel in the channelmap
+	channelAccess.Lock()
 	channelMap[funcName] = channel
+	channelAccess.Unlock()
 
 	// Wait for data from channel
 	returnData := <-channel
@@ -100,30 +138,93 @@ func (plugin *Plugin) Register() {
 	http.Handle("/", plugin)
 }
 
-/* Internal Method: Executes a method after unwrapping its arguments */
-func executeMethod(data interface{}, name string, data []byte) []byte {
-	// The receiver reades the Json and Do the magic
-	json_data := common.ReadJson(data)
-
-	argsspace := make([]reflect.Value, 0)
-	for _, arg := range json_data {
-		argsspace = append(argsspace, reflect.ValueOf(arg))
+/* Internal Method: Executes a method after unwrapping its arguments. The arguments are decoded
+   and the results are encoded with the codec of the request. A failure is returned as the
+   envelope sent to the host */
+func executeMethod(ctx context.Context, object interface{}, name string, data []byte, codec common.Codec) (result []byte, fault *common.ErrorEnvelope) {
+	args, decodeErr := codec.Decode(data)
+	if decodeErr != nil {
+		return nil, common.NewErrorEnvelope(common.ErrorBadArguments, "%v", decodeErr)
+	}
+	args, release, resolveErr := resolveArgs(args)
+	if resolveErr != nil {
+		return nil, common.NewErrorEnvelope(common.ErrorBadArguments, "%v", resolveErr)
+	}
+	defer release()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result, fault = nil, panicError(name, recovered)
+		}
+	}()
+	method := reflect.ValueOf(object).MethodByName(name)
+	callArgs, argsErr := methodArgs(ctx, method, args, nil)
+	if argsErr != nil {
+		return nil, common.NewErrorEnvelope(common.ErrorBadArguments, "Method %s: %v", name, argsErr)
+	}
+	values := method.Call(callArgs)
+	if err := resultError(values); err != nil {
+		return nil, methodError(err)
 	}
-	values := reflect.ValueOf(data).MethodByName(name).Call(argsspace)
 	return_vals := make([]interface{}, 0)
 	for _, value := range values {
 		return_vals = append(return_vals, value.Interface())
 	}
-	returnbytes = common.CreateJson(return_vals...)
-	return returnbytes
+	encoded, encodeErr := codec.Encode(return_vals)
+	if encodeErr != nil {
+		return nil, common.NewErrorEnvelope(common.ErrorInternal, "%v", encodeErr)
+	}
+	return encoded, nil
+}
+
+/* Internal Method: Get the context of a method call. It is cancelled when the host gives up
+   the call or at the deadline sent by the host */
+func requestContext(req *http.Request) (context.Context, context.CancelFunc) {
+	header := req.Header.Get(PluginConn.DeadlineHeader)
+	if header != "" {
+		deadline, err := time.Parse(time.RFC3339Nano, header)
+		if err == nil {
+			return context.WithDeadline(req.Context(), deadline)
+		}
+		log.ERROR.Printf("Invalid deadline in the request: %s", header)
+	}
+	return context.WithCancel(req.Context())
 }
 
 /* Internal Method: Default handler to serve all http request that comes to the plugin. Should not be called explicitly */
 func (plugin *Plugin) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
-	methodName := strings.Split(req.URL.Path, "/")[1]
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	methodName := strings.Split(path, "/")[0]
+	if strings.HasPrefix(path, common.ControlPrefix) {
+		// The control endpoints are served under a prefix no method name could take
+		methodName = path
+	}
+	// A panic out of the method call (i.e. in the health check) is reported to the host as well
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			PluginConn.WriteErrorResponse(panicError(methodName, recovered), res)
+			plugin.recordPanic()
+		}
+	}()
 	if methodName == "" {
 		res.WriteHeader(400)
+	} else if methodName == common.ControlLive {
+		// Liveness: the plugin is able to serve requests
+		res.WriteHeader(200)
+	} else if methodName == common.ControlReady {
+		// Readiness: reported by the plugin health check, ready once started if not set
+		report := HealthReport{Ready: plugin.started}
+		if plugin.healthCheck != nil {
+			report = plugin.healthCheck()
+		}
+		PluginConn.WriteJsonResponse(report, 200, res)
+	} else if methodName == common.ControlIdentity {
+		// Identity is used by the registry to verify the plugin instance while reattaching
+		identity := map[string]interface{}{"instanceid": plugin.conf.InstanceId, "pid": os.Getpid()}
+		PluginConn.WriteJsonResponse(identity, 200, res)
+	} else if methodName == common.ControlDescribe {
+		// The descriptors of the methods exposed to the host
+		PluginConn.WriteJsonResponse(plugin.describeMethods(), 200, res)
 	} else {
 		methods := plugin.methodRegistry
 		ok := false
@@ -136,36 +237,63 @@ func (plugin *Plugin) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		if ok {
 			// Check if the method is Activate
 			if methodName == "Start" {
-				methodReg := plugin.methodRegistry
-				var methods []string = nil
-				for _, method := range methodReg {
-					switch method {
-					case "Start":
-					case "Stop":
-					case "Init":
-					default:
-						methods = append(methods, method)
-					}
-				}
+				methods := plugin.exposedMethods()
 				// marshal the method list sent on activation
 				data, marshalErr := json.Marshal(methods)
 				if marshalErr != nil {
 					res.WriteHeader(400)
 				}
+				// Choose the payload codec among the ones offered by the host
+				codec := common.NegotiateCodec(req.Header.Get(common.CodecsHeader))
+				res.Header().Set(common.CodecHeader, codec.Name())
 				// Write the methods list
 				res.Write(data)
 			}
 			defer req.Body.Close()
 			input, _ := ioutil.ReadAll(req.Body)
-			returnData := executeMethod(plugin.methodObject, methodName, input)
+			ctx, cancel := requestContext(req)
+			defer cancel()
+			// Old hosts send json without negotiation
+			codec := common.CodecByContentType(req.Header.Get("Content-Type"))
+			method := reflect.ValueOf(plugin.methodObject).MethodByName(methodName)
+			if isStreamMethod(method) {
+				fault := serveStream(ctx, res, methodName, method, input, codec)
+				if fault != nil && fault.Code == common.ErrorPanic {
+					plugin.recordPanic()
+				}
+				return
+			}
+			returnData, fault := executeMethod(ctx, plugin.methodObject, methodName, input, codec)
+			if fault != nil {
+				PluginConn.WriteErrorResponse(fault, res)
+				if fault.Code == common.ErrorPanic {
+					plugin.recordPanic()
+				}
+				return
+			}
+			res.Header().Set("Content-Type", codec.ContentType())
 			if returnData != nil {
 				res.Write(returnData)
 			}
-			res.WriteHeader(200)
 		} else {
-			res.WriteHeader(400)
+			PluginConn.WriteErrorResponse(common.NewErrorEnvelope(common.ErrorMethodNotFound, "Method %s is not registered", methodName), res)
+		}
+	}
+}
+
+/* Internal Method: Get the methods exposed to the host, the lifecycle methods are not exposed */
+func (plugin *Plugin) exposedMethods() []string {
+	var methods []string = nil
+	for _, method := range plugin.methodRegistry {
+		switch method {
+		case "Start":
+		case "Stop":
+		case "Init":
+		default:
+			methods = append(methods, method)
 		}
 	}
+	return methods
 }
 
 /* Method to notify a callback registered by the application by the name of the callback.
@@ -176,7 +304,9 @@ func (plugin *Plugin) Notify(callBack string, args ...interface{}) error {
 
 	// Pnthread : on getting the notifcation and user data it puts the data on the channel
 	// Get the channel from global channel map
+	channelAccess.Lock()
 	channel, ok := channelMap[callBack]
+	channelAccess.Unlock()
 	if !ok {
 		return fmt.Errorf("Callback could not be found for: %s", callBack)
 	}
@@ -186,6 +316,12 @@ func (plugin *Plugin) Notify(callBack string, args ...interface{}) error {
 	return nil
 }
 
+/* Set the health check called on each readiness check from the registry.
+   The plugin could report it is not ready along with custom health details */
+func (plugin *Plugin) SetHealthCheck(check func() HealthReport) {
+	plugin.healthCheck = check
+}
+
 /* Used to start the Plugin Service. It makes a plugin operable and discoverable by application */
 func (plugin *Plugin) Start() error {
 
@@ -193,13 +329,37 @@ func (plugin *Plugin) Start() error {
 	addr := plugin.conf.Url
 
 	// Create the Plugin Server
+	// Only the host with the instance secret is served
 	config := &PluginConn.ServerConfiguration{Registrar: plugin, SockFile: sockFile, Addr: addr}
+	config.Secret = plugin.secret
+	config.PeerUids = []int{plugin.conf.HostUid}
+	if plugin.conf.Network == common.TransportTcp {
+		// A tcp plugin only accepts the host certificate signed by the CA
+		if plugin.conf.Tls == nil {
+			return fmt.Errorf("The TLS conf is required for a tcp plugin")
+		}
+		tlsConfig, tlsErr := PluginConn.ServerTlsConfig(plugin.conf.Tls.CA, plugin.conf.Tls.Cert, plugin.conf.Tls.Key)
+		if tlsErr != nil {
+			return tlsErr
+		}
+		config.Network = common.TransportTcp
+		config.Tls = tlsConfig
+	}
 	server, err := PluginConn.NewPluginServer(config)
 	if err != nil {
 		return fmt.Errorf("Failed to Create the server")
 	}
 	plugin.pluginServer = server
 
+	// Receive the file descriptors passed by the host
+	if plugin.conf.FdSock != "" {
+		fdListener, fdErr := startFdServer(plugin.conf.FdSock, plugin.secret)
+		if fdErr != nil {
+			return fdErr
+		}
+		plugin.fdListener = fdListener
+	}
+
 	// Start the server (it will add the sock file in proper position)
 	plugin.pluginServer.Start()
 
@@ -211,6 +371,9 @@ func (plugin *Plugin) Start() error {
 
 /* Used to stop the Plugin service. It makes the plugin hidden from the application and stops all functionalities */
 func (plugin *Plugin) Stop() error {
+	if plugin.fdListener != nil {
+		plugin.fdListener.Close()
+	}
 	err := plugin.pluginServer.Shutdown()
 	if err != nil {
 		return err
@@ -0,0 +1,152 @@
+/* Streaming methods send their results to the host as a sequence of items.
+ * A method streams if it takes a *StreamWriter argument (after the optional
+ * context) or if it returns a channel. The items are written as they are
+ * produced, the writer blocks while the host doesn't receive (backpressure)
+ */
+
+package pluginlib
+
+import (
+	"context"
+	"encoding/json"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"net/http"
+	"reflect"
+)
+
+/* The writer a streaming method sends its items with */
+type StreamWriter struct {
+	ctx     context.Context
+	encoder *json.Encoder
+	flusher http.Flusher
+}
+
+// The type of the stream writer argument of a streaming method
+var streamWriterType = reflect.TypeOf(&StreamWriter{})
+
+// The type of a trailing error result
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+/* Send an item to the host. It returns an error if the host has given up the stream */
+func (writer *StreamWriter) Send(item interface{}) error {
+	if writer.ctx.Err() != nil {
+		return writer.ctx.Err()
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	err = writer.encoder.Encode(PluginConn.StreamFrame{Item: data})
+	if err != nil {
+		return err
+	}
+	if writer.flusher != nil {
+		writer.flusher.Flush()
+	}
+	return nil
+}
+
+/* Get the context of the stream, it is cancelled when the host gives up the stream */
+func (writer *StreamWriter) Context() context.Context {
+	return writer.ctx
+}
+
+// Internal: check if a method streams its results
+func isStreamMethod(method reflect.Value) bool {
+	if !method.IsValid() {
+		return false
+	}
+	methodType := method.Type()
+	for i := 0; i < methodType.NumIn(); i++ {
+		if methodType.In(i) == streamWriterType {
+			return true
+		}
+	}
+	return methodType.NumOut() > 0 && methodType.Out(0).Kind() == reflect.Chan
+}
+
+// Internal: execute a streaming method and stream its items in the response. It returns the error
+// the stream ended with
+func serveStream(ctx context.Context, res http.ResponseWriter, name string, method reflect.Value, input []byte, codec common.Codec) (fault *common.ErrorEnvelope) {
+	args, decodeErr := codec.Decode(input)
+	if decodeErr != nil {
+		fault = common.NewErrorEnvelope(common.ErrorBadArguments, "%v", decodeErr)
+		PluginConn.WriteErrorResponse(fault, res)
+		return fault
+	}
+	args, release, resolveErr := resolveArgs(args)
+	if resolveErr != nil {
+		fault = common.NewErrorEnvelope(common.ErrorBadArguments, "%v", resolveErr)
+		PluginConn.WriteErrorResponse(fault, res)
+		return fault
+	}
+	defer release()
+
+	flusher, _ := res.(http.Flusher)
+	writer := &StreamWriter{ctx: ctx, encoder: json.NewEncoder(res), flusher: flusher}
+	callArgs, argsErr := methodArgs(ctx, method, args, writer)
+	if argsErr != nil {
+		fault = common.NewErrorEnvelope(common.ErrorBadArguments, "Method %s: %v", name, argsErr)
+		PluginConn.WriteErrorResponse(fault, res)
+		return fault
+	}
+
+	res.Header().Set("Content-Type", PluginConn.StreamContentType)
+	res.WriteHeader(200)
+
+	// A panic ends the stream with an error frame
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			fault = panicError(name, recovered)
+			writer.fail(fault)
+		}
+	}()
+	values := method.Call(callArgs)
+
+	var streamErr error
+	if len(values) > 0 && values[0].Kind() == reflect.Chan {
+		// Forward the channel items till it is closed or the host gives up
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: values[0]},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		}
+		for {
+			chosen, item, ok := reflect.Select(cases)
+			if chosen == 1 || !ok {
+				break
+			}
+			streamErr = writer.Send(item.Interface())
+			if streamErr != nil {
+				break
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		// The host has given up the stream
+		return nil
+	}
+
+	// A trailing error result ends the stream with the error
+	if streamErr == nil {
+		streamErr = resultError(values)
+	}
+	if streamErr != nil {
+		fault = methodError(streamErr)
+		writer.fail(fault)
+		return fault
+	}
+	writer.encoder.Encode(PluginConn.StreamFrame{End: true})
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// Internal: end the stream with an error frame
+func (writer *StreamWriter) fail(envelope *common.ErrorEnvelope) {
+	writer.encoder.Encode(PluginConn.StreamFrame{Error: envelope.Message, Fault: envelope})
+	if writer.flusher != nil {
+		writer.flusher.Flush()
+	}
+}
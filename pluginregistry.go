@@ -5,19 +5,24 @@
 package pluginmanager
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	log "github.com/spf13/jwalterweatherman"
-	commom "github.com/swarvanusg/GoPlug/common"
+	common "github.com/swarvanusg/GoPlug/common"
 	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -35,6 +40,12 @@ var (
 	// An error to indicate the plugin is already loaded
 	PluginLoaded = errors.New("Plugin is already loaded")
 
+	// An error to indicate the plugin method didn't complete before the context deadline
+	ExecuteTimeout = errors.New("Plugin method execution timed out")
+
+	// An error to indicate the plugin registry is stopped
+	RegistryStopped = errors.New("Plugin registry is stopped")
+
 	UntarError    = errors.New("Failed to unload the Tar file")
 	SaveConfError = errors.New("Failed to save the plugin conf")
 
@@ -45,11 +56,17 @@ var (
 	DefaultTarExt                = ".tar"
 	PluginBinary                 = "pluginmain"
 	PluginSockFile               = "pluginconn.sock"
-	PluginUrl                    = "unix://plugin"
+	// The private directory the sockets are created in (in the discovered plugin folder)
+	PluginRunDir = "run"
+	PluginUrl    = "unix://plugin"
 	// Default Interval for Discovery search in MS
 	DefaultInterval = 500 * time.Millisecond
 	// Default Connection retry Count
 	ConnRetryCount = 20
+	// The signal a plugin process gets when the host dies
+	PluginDeathSignal = syscall.SIGTERM
+	// The payload codecs offered to the plugins, a plugin that doesn't negotiate uses json
+	DefaultCodecs = []string{"msgpack", "json"}
 
 	// The Plugin Registry singular Instance
 	pluginReg *PluginReg = nil
@@ -67,18 +84,240 @@ type Plugin struct {
 	methods []string
 	// The plugin registered callback
 	callbacks map[string]bool
-	// Plugin disconnected state (currently Being set but not being used)
+	// Plugin disconnected state (maintained by the health monitor when enabled)
 	connected bool
 	// The Plugin instance PId
 	pid int
 	// the location of the plugin (It is required while reloading the plugin)
 	pluginloc string
+	// The plugin id (namespace _ name _ version)
+	key string
+	// The cgroup of the plugin process (empty if no cgroup limits are applied)
+	cgroupPath string
+	// Set while the plugin is being stopped by the registry
+	stopping bool
+	// The instance generation, changed each time the instance is started or stopped
+	generation int64
+	// The private writable data dir of a sandboxed plugin
+	dataDir string
+	// The launch spec the plugin process is started with
+	launchSpec *LaunchSpec
+	// The random id of the plugin instance (used to verify identity on reattach)
+	instanceId string
+	// The instance number in the plugin pool (0 for the primary instance)
+	instance int
+	// The pool owned by the primary instance (nil if the plugin runs a single instance)
+	pool *pluginPool
+	// The pool configuration of the plugin
+	poolConf *common.PoolConf
+	// The in-flight requests to the instance
+	outstanding int64
+	// The method panics reported by the instance
+	panics int64
+	// The health state and the monitor of the instance
+	health        HealthState
+	healthMonitor *healthMonitor
+	healthAccess  sync.Mutex
+	// The sampled process stats of the instance
+	statsHistory []ProcessStats
+	statsAccess  sync.Mutex
+	// The on-demand state (nil if the plugin is started on load)
+	onDemand *onDemand
+	// The listener serving the host functions to the instance
+	hostListener net.Listener
+	// The payload codec negotiated on activation
+	codec common.Codec
+	// The method descriptors fetched from the plugin (reset on activation)
+	descriptors    []common.MethodDescriptor
+	describeErr    error
+	describeAccess sync.Mutex
+	// The socket the file descriptors are passed to the instance on and its connection
+	fdSock   string
+	fdConn   *PluginConn.FdConn
+	fdAccess sync.Mutex
+	// The secret of the instance, sent with each request to the plugin and by the plugin to the host
+	secret string
+	// The transport of the instance (common.TransportUnix or common.TransportTcp)
+	network string
+	// The host TLS files and config of a tcp instance
+	hostTls   *common.TlsConf
+	tlsConfig *tls.Config
+	// The agent hosting a remote plugin (nil for a local plugin)
+	agent *AgentConf
+	// The registry the plugin is loaded by
+	registry *PluginReg
+	// Guard connected, stopping, pool and the connection of the instance (pluginConn, PluginUrl, pid,
+	// secret, methods and codec are replaced by a reload or a reconnect while the calls read them)
+	stateAccess sync.Mutex
+	// Serialize the recovery of the instance, the calls failed on the same connection recover it once
+	recoverAccess sync.Mutex
+	// Set once the loaded event is published, till the unloaded event
+	loaded bool
+}
+
+// Internal: check if the plugin instance is connected
+func (plugin *Plugin) isConnected() bool {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	return plugin.connected
+}
+
+// Internal: set the connected state of the plugin instance
+func (plugin *Plugin) setConnected(connected bool) {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	plugin.connected = connected
+}
+
+// Internal: check if the plugin instance is being stopped by the registry
+func (plugin *Plugin) isStopping() bool {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	return plugin.stopping
+}
+
+// Internal: set the stopping state of the plugin instance
+func (plugin *Plugin) setStopping(stopping bool) {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	plugin.stopping = stopping
+}
+
+// Internal: get the pool of the plugin (nil if the plugin runs a single instance)
+func (plugin *Plugin) getPool() *pluginPool {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	return plugin.pool
+}
+
+// Internal: set the pool of the plugin, the previous pool is returned
+func (plugin *Plugin) setPool(pool *pluginPool) *pluginPool {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	previous := plugin.pool
+	plugin.pool = pool
+	return previous
+}
+
+// Internal: get the connection of the plugin instance and the URL the plugin is reached with
+func (plugin *Plugin) connection() (*PluginConn.PluginClient, string) {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	return plugin.pluginConn, plugin.PluginUrl
+}
+
+// Internal: set the connection of the plugin instance, the previous connection is returned
+func (plugin *Plugin) setConnection(pluginConn *PluginConn.PluginClient, pluginUrl string) *PluginConn.PluginClient {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	previous := plugin.pluginConn
+	plugin.pluginConn = pluginConn
+	plugin.PluginUrl = pluginUrl
+	return previous
+}
+
+// Internal: get the process id of the plugin instance
+func (plugin *Plugin) processId() int {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	return plugin.pid
+}
+
+// Internal: set the process id of the plugin instance
+func (plugin *Plugin) setProcessId(pid int) {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	plugin.pid = pid
+}
+
+// Internal: get the secret of the plugin instance
+func (plugin *Plugin) authSecret() string {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	return plugin.secret
+}
+
+// Internal: set the secret of the plugin instance
+func (plugin *Plugin) setSecret(secret string) {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	plugin.secret = secret
+}
+
+// Internal: get the methods and the codec negotiated on activation
+func (plugin *Plugin) activation() ([]string, common.Codec) {
+	plugin.stateAccess.Lock()
+	defer plugin.stateAccess.Unlock()
+	return plugin.methods, plugin.codec
+}
+
+// Internal: publish the loaded event of the plugin
+func (plugin *Plugin) publishLoaded() {
+	plugin.stateAccess.Lock()
+	plugin.loaded = true
+	plugin.stateAccess.Unlock()
+	plugin.registry.publish(PluginEvent{Type: PluginLoadedEvent, Key: plugin.key, Pid: plugin.processId()})
+}
+
+// Internal: publish the unloaded event of the plugin, if its loaded event is published (not for a pool instance
+// or a plugin failed to load)
+func (plugin *Plugin) publishUnloaded() {
+	plugin.stateAccess.Lock()
+	loaded := plugin.loaded
+	plugin.loaded = false
+	plugin.stateAccess.Unlock()
+	if loaded {
+		plugin.registry.publish(PluginEvent{Type: PluginUnloadedEvent, Key: plugin.key, Pid: plugin.processId()})
+	}
+}
+
+// Internal: check if a method is registered by the plugin instance
+func (plugin *Plugin) hasMethod(funcName string) bool {
+	methods, _ := plugin.activation()
+	for _, method := range methods {
+		if method == funcName {
+			return true
+		}
+	}
+	return false
 }
 
 /* The configuaration for Plugin reg */
 type PluginRegConf struct {
 	// The location to search for Plugin. Default is .
 	PluginLocation string
+	// The resource limits applied to every plugin, it overrides the limits in the plugin conf
+	Limits *common.ResourceLimits
+	// The cgroup v2 parent for plugin cgroups. Default is DefaultCgroupRoot
+	CgroupRoot string
+	// The sandbox for the plugin processes, nil disables sandboxing
+	Sandbox *SandboxConf
+	// The launch conf applied to every plugin, it overrides the launch conf in the plugin conf
+	Launch *common.LaunchConf
+	// The launch conf per plugin id (namespace _ name _ version), it overrides Launch
+	PluginLaunch map[string]*common.LaunchConf
+	// The policy for plugin instances left over by a previous host. Default is OrphanTerminate
+	OrphanPolicy OrphanPolicy
+	// The instance pool applied to every plugin, it overrides the pool in the plugin conf
+	Pool *common.PoolConf
+	// The health check of the plugins, nil disables health monitoring
+	Health *HealthConf
+	// The interval to sample the plugin process stats. Default is DefaultStatsInterval, negative disables sampling
+	StatsInterval time.Duration
+	// The number of stats samples kept per plugin. Default is DefaultStatsHistory
+	StatsHistory int
+	// The payload codecs offered to the plugins in preference order. Default is DefaultCodecs
+	Codecs []string
+	// Validate the arguments of the calls against the method descriptors before sending
+	ValidateArgs bool
+	// The host TLS files for the tcp plugins supplied with their own certificates
+	Tls *common.TlsConf
+	// The agents the plugins not discovered locally are loaded from
+	Agents []*AgentConf
+	// Start every plugin process on the first call and stop it when idle
+	OnDemand bool
+	// The idle time after which an on-demand plugin is stopped, it overrides the plugin conf. Default is DefaultIdleTimeout
+	IdleTimeout time.Duration
 }
 
 /* PluginReg should be created per types of Plugin
@@ -94,18 +333,68 @@ type PluginReg struct {
 	regAccess *sync.Mutex
 	// The flag to stop PluginRegistry Service
 	stopchan chan int
+	stopOnce sync.Once
+	// Closed once all the plugins are unloaded on stop
+	stopped chan int
+	// The host resource limits for the plugins
+	limits *common.ResourceLimits
+	// The cgroup v2 parent for plugin cgroups
+	cgroupRoot string
+	// The sandbox for the plugin processes
+	sandbox *SandboxConf
+	// The host launch confs
+	launch       *common.LaunchConf
+	pluginLaunch map[string]*common.LaunchConf
+	// The loaded plugins by plugin id
+	plugins map[string]*Plugin
+	// The policy for leftover plugin instances
+	orphanPolicy OrphanPolicy
+	// The host instance pool conf
+	pool *common.PoolConf
+	// The health check conf
+	health *HealthConf
+	// The process stats sampling conf
+	statsInterval time.Duration
+	statsHistory  int
+	// The on-demand conf
+	onDemand    bool
+	idleTimeout time.Duration
+	// The functions exposed to the plugins
+	hostFuncs map[string]*hostFunc
+	// The payload codecs offered to the plugins
+	codecs []string
+	// The call arguments are validated against the method descriptors
+	validateArgs bool
+	// The host TLS files for the tcp plugins
+	tls *common.TlsConf
+	// The agents hosting remote plugins
+	agents []*AgentConf
+	// The registered event handlers
+	eventHandlers []func(PluginEvent)
+	// The mutex to sync the event handlers access
+	eventAccess *sync.Mutex
 }
 
 /* Function is called to inititate the PluginRegistry as per the Plugin registry Configuration
    It initiate and return a plugin registry pointer that could be used to manage plugins.
    If Discovery is enabled the DiscoverService Starts */
 func PluginRegInit(regConf PluginRegConf) (*PluginReg, error) {
+	registry, err := newPluginReg(regConf)
+	if err != nil {
+		return nil, err
+	}
+	pluginReg = registry
+	return registry, nil
+}
+
+// Internal: initiate a plugin registry without making it the registry singular instance (an agent owns its registry)
+func newPluginReg(regConf PluginRegConf) (*PluginReg, error) {
 
 	var wg sync.WaitGroup
 
 	pluginLocation := regConf.PluginLocation
 
-	pluginReg = &PluginReg{}
+	pluginReg := &PluginReg{}
 
 	// Map to hold discovered Plugins
 	pluginReg.DiscoveredPlugin = make(map[string]struct{})
@@ -119,24 +408,48 @@ func PluginRegInit(regConf PluginRegConf) (*PluginReg, error) {
 		return nil, fmt.Errorf("Failed to create discovered plugin location, Error : %v", direrr)
 	}
 	pluginReg.Wg = &wg
-	pluginReg.RegAccess = &sync.Mutex{}
+	pluginReg.regAccess = &sync.Mutex{}
 	pluginReg.stopchan = make(chan int)
+	pluginReg.stopped = make(chan int)
+	pluginReg.limits = regConf.Limits
+	pluginReg.cgroupRoot = regConf.CgroupRoot
+	pluginReg.sandbox = regConf.Sandbox
+	pluginReg.launch = regConf.Launch
+	pluginReg.pluginLaunch = regConf.PluginLaunch
+	pluginReg.eventAccess = &sync.Mutex{}
+	pluginReg.plugins = make(map[string]*Plugin)
+	pluginReg.hostFuncs = make(map[string]*hostFunc)
+	pluginReg.codecs = regConf.Codecs
+	if len(pluginReg.codecs) == 0 {
+		pluginReg.codecs = DefaultCodecs
+	}
+	pluginReg.validateArgs = regConf.ValidateArgs
+	pluginReg.tls = regConf.Tls
+	pluginReg.agents = regConf.Agents
+	pluginReg.orphanPolicy = regConf.OrphanPolicy
+	pluginReg.pool = regConf.Pool
+	pluginReg.health = regConf.Health
+	pluginReg.statsInterval = regConf.StatsInterval
+	if pluginReg.statsInterval == 0 {
+		pluginReg.statsInterval = DefaultStatsInterval
+	}
+	pluginReg.statsHistory = regConf.StatsHistory
+	if pluginReg.statsHistory <= 0 {
+		pluginReg.statsHistory = DefaultStatsHistory
+	}
+	pluginReg.onDemand = regConf.OnDemand
+	pluginReg.idleTimeout = regConf.IdleTimeout
+	// Reattach or terminate the plugin instances left by a previous host
+	pluginReg.recoverOrphans()
+	if pluginReg.statsInterval > 0 {
+		go pluginReg.statsService()
+	}
 	wg.Add(1)
 	go pluginReg.discoverPluginService(&wg)
 	log.INFO.Printf("Plugin discovery started for : %s", pluginLocation)
 	return pluginReg, nil
 }
 
-/* Function to wait for PluginReg Discovery service to be stopped. If its not started then it return immediately */
-func (pluginReg *PluginReg) WaitForStop() {
-	pluginReg.Wg.Wait()
-}
-
-/* Function to stop the Plugin Registry service. It stops the discovery service */
-func (pluginReg *PluginReg) Stop() {
-	pluginReg.StopFlag = true
-}
-
 func (pluginReg *PluginReg) processFile() (isplugin bool, name string, namespace string, version string, untarFold string) {
 	var fileName string
 	isplugin = false
@@ -184,6 +497,14 @@ func getKey(name, namespace, version string) string {
 	return key
 }
 
+// Internal: get the plugin id with the instance number of a pool instance
+func (plugin *Plugin) instanceKey() string {
+	if plugin.instance == 0 {
+		return plugin.key
+	}
+	return fmt.Sprintf("%s-%d", plugin.key, plugin.instance)
+}
+
 /**
 	// Create the plugin id (namespace _ name _ version)
 	namespace := pluginconf.NameSpace
@@ -251,9 +572,11 @@ func (pluginReg *PluginReg) discoverPluginService(wg *sync.WaitGroup) {
 				if !isplugin {
 					continue
 				}
-				key := getKey(name, namespace, version)
-				if Is
-				if !pluginreg.lazyload {
+				if pluginReg.GetPlugin(namespace, name, version) != nil {
+					continue
+				}
+				// On-demand plugins get a handle right away, the process starts on the first call
+				if !pluginreg.lazyload || pluginReg.onDemand {
 					pluginreg.LoadPlugin(namespace, name, version)
 				}
 			case ev.IsModify():
@@ -280,7 +603,7 @@ func (pluginReg *PluginReg) discoverPluginService(wg *sync.WaitGroup) {
 		case watchererr := <-watcher.Error:
 			log.ERROR.Printf("Error while watching on %s: , Error : %v", pluginLocation, watchererr)
 			return
-		case pluginReg.stopchan:
+		case <-pluginReg.stopchan:
 			log.Info.Printf("Stopping PluginReg Channel")
 			return
 		}
@@ -302,113 +625,368 @@ func (pluginReg *PluginReg) isDiscovered(appPlugin string) bool {
 	return true
 }
 
+/* Get a loaded plugin by the plugin namespace, name and version. It returns nil if the plugin is not loaded */
+func (pluginReg *PluginReg) GetPlugin(namespace string, name string, version string) *Plugin {
+	pluginReg.regAccess.Lock()
+	defer pluginReg.regAccess.Unlock()
+
+	return pluginReg.plugins[getKey(name, namespace, version)]
+}
+
+// Internal: put a loaded plugin in the registry. A stopped registry doesn't take the plugin, the
+// plugins added before the stop are unloaded by the stop
+func (pluginReg *PluginReg) addPlugin(plugin *Plugin) error {
+	pluginReg.regAccess.Lock()
+	defer pluginReg.regAccess.Unlock()
+
+	if pluginReg.isStopped() {
+		return RegistryStopped
+	}
+	pluginReg.plugins[plugin.key] = plugin
+	return nil
+}
+
+// Internal: remove an unloaded plugin from the registry
+func (pluginReg *PluginReg) removePlugin(plugin *Plugin) {
+	pluginReg.regAccess.Lock()
+	defer pluginReg.regAccess.Unlock()
+
+	if pluginReg.plugins[plugin.key] == plugin {
+		delete(pluginReg.plugins, plugin.key)
+	}
+}
+
 /* Unload a Plugin from the plugin Registry. It invokes a stop request to the plugin.
    (It doesn't remove the Plugin from Discovered Plugin List) */
 func (plugin *Plugin) UnloadPlugin() error {
 
-	// Initiate Locking
-	//pluginReg.RegAccess.Lock()
-	//defer pluginReg.RegAccess.Unlock()
-
-	// Send the Stop request
-	stopErr := plugin.stop()
-	if stopErr != nil {
-		log.ERROR.Println("Failed to send stop to the plugin: ", stopErr)
+	// The agent stops a remote plugin
+	if plugin.agent != nil {
+		return plugin.unloadRemote()
 	}
 
-	// Close the connection
-	plugin.pluginConn.Close()
+	if plugin.onDemand != nil {
+		plugin.onDemand.stop(plugin)
+		plugin.registry.removePlugin(plugin)
+		return nil
+	}
 
-	// Kill the plugin process
-	stoppErr := stopProcess(plugin.pid)
-	if stoppErr != nil {
-		log.ERROR.Println("Failed to stop the plugin process: ", stoppErr)
+	// Unload the other instances of the pool
+	if pool := plugin.setPool(nil); pool != nil {
+		pool.stop()
 	}
 
+	plugin.unloadInstance()
+	plugin.registry.removePlugin(plugin)
+
 	return nil
 }
 
+// Internal: stop a single plugin instance
+func (plugin *Plugin) unloadInstance() {
+
+	plugin.stopHealthMonitor()
+
+	// Send the Stop request (an instance that never connected has no connection)
+	pluginConn, _ := plugin.connection()
+	if pluginConn != nil {
+		stopErr := plugin.stop()
+		if stopErr != nil {
+			log.ERROR.Println("Failed to send stop to the plugin: ", stopErr)
+		}
+	}
+
+	// Close the connection (the callback long polls of the instance end quietly)
+	atomic.AddInt64(&plugin.generation, 1)
+	if pluginConn != nil {
+		pluginConn.Close()
+	}
+	plugin.stopHostServer()
+	plugin.closeFdConn()
+
+	// Kill the plugin process (an instance that never started has no process)
+	plugin.setStopping(true)
+	if pid := plugin.processId(); pid > 0 {
+		stoppErr := stopProcess(pid)
+		if stoppErr != nil {
+			log.ERROR.Println("Failed to stop the plugin process: ", stoppErr)
+		}
+	}
+	plugin.publishUnloaded()
+}
+
 /* Function to reload a plugin */
 func (plugin *Plugin) ReloadPlugin() error {
+	plugin.recoverAccess.Lock()
+	defer plugin.recoverAccess.Unlock()
+	return plugin.reload()
+}
+
+// Internal: stop the plugin instance and start it again in the same handle (called with recoverAccess held)
+func (plugin *Plugin) reload() error {
 
-	plugin.UnloadPlugin()
+	if plugin.agent != nil {
+		return plugin.reloadRemote()
+	}
 
-	newPlugin, err := pluginReg.LoadPluginInstance(plugin.pluginloc)
+	// On-demand plugin is stopped and started as on the next call
+	if plugin.onDemand != nil {
+		return plugin.onDemand.reload(plugin)
+	}
+
+	plugin.unloadInstance()
+
+	// Start the instance again in the same handle
+	err := plugin.registry.startInstance(plugin)
 	if err != nil {
 		return fmt.Errorf("Failed to reload plugin: %v", err)
 	}
-
-	// The plugin Connection
-	plugin.pluginConn = newPlugin.pluginConn
-	// Plugin disconnected state (currently Being set but not being used)
-	plugin.connected = newPlugin.connected
-	// The Plugin instance PId
-	plugin.pid = newPlugin.pid
+	plugin.publishLoaded()
 
 	return nil
 }
 
 func stopProcess(pid int) error {
 
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		return fmt.Errorf("Failed to get Process of Id: %d", pid)
-	}
-
 	// Kill the procecss
-	killErr := process.Signal(syscall.SIGUSR1)
+	killErr := signalProcess(pid, stopSignal)
 	if killErr != nil {
-		return fmt.Errorf("Failed to deliver SIGUSR1 to process %d: %v", pid, killErr)
+		return fmt.Errorf("Failed to deliver %v to process %d: %v", stopSignal, pid, killErr)
 	}
 
 	return nil
 }
 
+// Internal: wait for the plugin process to terminate and publish the termination reason
+func (pluginReg *PluginReg) watchProcess(plugin *Plugin, pid int) {
+	status, waitErr := waitProcess(pid)
+	if waitErr != nil {
+		log.ERROR.Printf("Failed to wait for plugin process %d: %v", pid, waitErr)
+		return
+	}
+
+	// The handle could be already running a new process (reloaded or restarted on demand)
+	replaced := plugin.processId() != pid
+	reason, code := terminationReason(status, plugin.cgroupPath, plugin.isStopping() || replaced)
+	log.INFO.Printf("Plugin %s process %d terminated: %s (%d)", plugin.key, pid, reason, code)
+	if !replaced {
+		removeCgroup(plugin.cgroupPath)
+		removePidFile(plugin.pluginloc, plugin.instance)
+	}
+
+	pluginReg.publish(PluginEvent{Type: PluginTerminatedEvent, Key: plugin.key, Pid: pid, Reason: reason, Status: code})
+}
+
 /* Load the plugin to the plugin Registry explicitly when lazy load is active.
 (if The discovery Process is not running, It search for the plugin and then load it to the registry)
 */
 func (pluginReg *PluginReg) LoadPlugin(namespace string, name string, version string) (*Plugin, error) {
 
+	key := getKey(name, namespace, version)
+	pluginLoc := filepath.Join(pluginReg.discoveredPluginLoc, key)
+
+	// A plugin not discovered locally is loaded from the agent hosting it
+	if _, statErr := os.Stat(pluginLoc); os.IsNotExist(statErr) && len(pluginReg.agents) > 0 {
+		agent := pluginReg.findAgent(key)
+		if agent != nil {
+			return pluginReg.loadRemote(agent, key)
+		}
+	}
+
+	return pluginReg.LoadPluginInstance(pluginLoc)
+}
+
+/* Load a plugin from the discovered plugin location. If the plugin is configured with
+   a pool the minimum number of instances are started. If the plugin is configured on-demand
+   the returned handle starts the plugin on the first call */
+func (pluginReg *PluginReg) LoadPluginInstance(pluginLoc string) (*Plugin, error) {
+
+	if pluginReg.isStopped() {
+		return nil, RegistryStopped
+	}
+
+	// On-demand plugin gets a handle now, the process is started on the first call
+	plugin := pluginReg.onDemandPlugin(pluginLoc)
+	if plugin != nil {
+		addErr := pluginReg.addPlugin(plugin)
+		if addErr != nil {
+			return nil, addErr
+		}
+		return plugin, nil
+	}
+
+	plugin, err := pluginReg.loadInstance(pluginLoc, 0)
+	if err != nil {
+		return plugin, err
+	}
+
+	poolErr := pluginReg.startPool(plugin)
+	if poolErr != nil {
+		plugin.unloadInstance()
+		return nil, poolErr
+	}
+	addErr := pluginReg.addPlugin(plugin)
+	if addErr != nil {
+		// The registry is stopped while the plugin was starting
+		plugin.UnloadPlugin()
+		return nil, addErr
+	}
+	plugin.publishLoaded()
+
+	return plugin, nil
+}
+
+// Internal: start a plugin instance (process) and connect to it
+func (pluginReg *PluginReg) loadInstance(pluginLoc string, instance int) (*Plugin, error) {
+
+	plugin := &Plugin{}
+	plugin.key = filepath.Base(pluginLoc)
+	plugin.pluginloc = pluginLoc
+	plugin.instance = instance
+	plugin.registry = pluginReg
+	plugin.callbacks = make(map[string]bool)
+
+	err := pluginReg.startInstance(plugin)
+	if err != nil {
+		return nil, err
+	}
+	return plugin, nil
+}
+
+// Internal: create the private directory the plugin sockets are created in
+func prepareRunDir(pluginLoc string) error {
+	runDir := filepath.Join(pluginLoc, PluginRunDir)
+	err := os.MkdirAll(runDir, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create run dir %s: %v", runDir, err)
+	}
+	// The dir may be left by an earlier version with a wider mode
+	return os.Chmod(runDir, 0700)
+}
+
+// Internal: start the plugin process of an instance handle and connect to it
+func (pluginReg *PluginReg) startInstance(plugin *Plugin) error {
+
 	// Get the plugin tar location
+	pluginLoc := plugin.pluginloc
 	tarFold := pluginLoc
+	key := plugin.key
+	instance := plugin.instance
+
+	// Load the plugin conf to get the requested limits
+	pluginConfFile := filepath.Join(tarFold, DefaultPluginConfFile)
+	pluginConfig, confLoadErr := common.LoadPluginConfigs(pluginConfFile)
+	if confLoadErr != nil {
+		log.ERROR.Println("Configuration load failed for file: ", pluginConfFile, ", Error: ", confLoadErr)
+		return ConfigLoadFailed
+	}
+	limits := common.MergeResourceLimits(pluginConfig.Limits, pluginReg.limits)
 
-	// Runtime Conf file
-	confFile := filepath.Join(tarFold, DefaultPluginiRuntimeConfFile)
+	// Runtime Conf file (each instance has its own)
+	confFile, _ := filepath.Abs(filepath.Join(tarFold, instanceFile(DefaultPluginRuntimeConfFile, instance)))
 
 	// Create RuntimeConf
 	pluginConf := common.RuntimeConf{}
-	StartPath := "./" + PluginBinary
 	pluginConf.Url = PluginUrl
-	pluginConf.Sock = PluginSockFile
+	pluginConf.Sock = filepath.Join(PluginRunDir, instanceFile(PluginSockFile, instance))
+	pluginConf.HostUid = os.Getuid()
+	if pluginReg.sandbox != nil && pluginReg.sandbox.NewUserNs {
+		// The host uid is mapped to root in the plugin user namespace
+		pluginConf.HostUid = 0
+	}
+
+	plugin.setStopping(false)
+	atomic.AddInt64(&plugin.generation, 1)
+	plugin.poolConf = common.MergePoolConf(pluginConfig.Pool, pluginReg.pool)
+	plugin.instanceId = newInstanceId()
+	pluginConf.InstanceId = plugin.instanceId
+	plugin.launchSpec = pluginReg.launchSpec(key, pluginLoc, pluginConfig.Launch)
+	plugin.launchSpec.Env = append(plugin.launchSpec.Env, common.RuntimeConfEnv+"="+confFile)
+
+	secret := newSecret()
+	plugin.setSecret(secret)
+
+	// get the unix socket file path
+	sockFile := filepath.Join(tarFold, pluginConf.Sock)
+	pluginConf.HostSock = filepath.Join(PluginRunDir, instanceFile(HostSockFile, instance))
+	hostSockFile := filepath.Join(tarFold, pluginConf.HostSock)
+	pluginConf.FdSock = filepath.Join(PluginRunDir, instanceFile(PluginFdSockFile, instance))
+	fdSockFile := filepath.Join(tarFold, pluginConf.FdSock)
+
+	// Sandboxed plugin creates the socket in its private data dir as the plugin folder is read only
+	if pluginReg.sandbox != nil {
+		dataDir, dataErr := pluginReg.prepareSandboxData(plugin)
+		if dataErr != nil {
+			log.ERROR.Println("Failed to prepare the plugin sandbox: ", dataErr)
+			return dataErr
+		}
+		plugin.dataDir = dataDir
+		pluginConf.Sock = filepath.Join(SandboxDataMount, instanceFile(PluginSockFile, instance))
+		sockFile = filepath.Join(dataDir, instanceFile(PluginSockFile, instance))
+		pluginConf.HostSock = filepath.Join(SandboxDataMount, instanceFile(HostSockFile, instance))
+		hostSockFile = filepath.Join(dataDir, instanceFile(HostSockFile, instance))
+		pluginConf.FdSock = filepath.Join(SandboxDataMount, instanceFile(PluginFdSockFile, instance))
+		fdSockFile = filepath.Join(dataDir, instanceFile(PluginFdSockFile, instance))
+	} else {
+		runErr := prepareRunDir(tarFold)
+		if runErr != nil {
+			log.ERROR.Println("Failed to prepare the plugin run dir: ", runErr)
+			return runErr
+		}
+	}
+
+	// A tcp plugin is served on its listen address with mutual TLS
+	plugin.network = common.TransportUnix
+	if pluginConfig.Transport.IsTcp() {
+		addr, tcpErr := pluginReg.prepareTcp(plugin, pluginConfig.Transport, &pluginConf)
+		if tcpErr != nil {
+			log.ERROR.Println("Failed to prepare the plugin transport: ", tcpErr)
+			return tcpErr
+		}
+		sockFile = addr
+		fdSockFile = ""
+	}
+
+	// Serve the host functions before the plugin starts so it could call them on init
+	hostErr := pluginReg.startHostServer(plugin, hostSockFile)
+	if hostErr != nil {
+		log.ERROR.Println("Failed to serve the host functions: ", hostErr)
+		return hostErr
+	}
 
 	// Save new plugin Conf
 	confSaveError := common.SaveRuntimeConfigs(confFile, pluginConf)
 	if confSaveError != nil {
 		log.ERROR.Println("Configuration load failed for file: ", confFile, ", Error: ", confSaveError)
-		return nil, SaveConfError
+		plugin.stopHostServer()
+		return SaveConfError
 	}
 
-	// get the start path
-	startPath := filepath.Join(tarFold, StartPath)
+	// The secret is handed in the process environment so that it is not stored in the plugin folder,
+	// it is not added to the launch spec returned for debugging
+	execSpec := *plugin.launchSpec
+	execSpec.Env = append(append([]string{}, execSpec.Env...), common.AuthSecretEnv+"="+secret)
 
 	// Start the Plugin
-	log.DEBUG.Printf("Starting plugin: %s\n", startPath)
-	pid, startErr := pluginReg.startPlugin(startPath)
+	log.DEBUG.Printf("Starting plugin: %s\n", execSpec.Path)
+	pid, startErr := pluginReg.startPlugin(plugin, &execSpec, limits)
 	if startErr != nil {
 		log.ERROR.Println("Failed to start the plugin: ", startErr)
+		plugin.stopHostServer()
+		return startErr
 	}
+	// set the plugin instance process id
+	plugin.setProcessId(pid)
+	go pluginReg.watchProcess(plugin, pid)
 
-	// get the unix socket file path
-	sockFile := filepath.Join(tarFold, pluginConf.Sock)
-
+	plugin.PluginSock = sockFile
 	retryCount := 0
 	var pluginConn *PluginConn.PluginClient = nil
-	time.Sleep(DefaultInterval * 4)
 	for retryCount < ConnRetryCount {
 		var connErr error
 		// Initiate Connection to a Plugin
 		log.DEBUG.Printf("Trying to connect: %s\n", sockFile)
-		pluginConn, connErr = PluginConn.NewPluginClient(sockFile)
+		pluginConn, connErr = plugin.newClient()
 		if connErr == nil {
 			break
 		}
@@ -417,49 +995,69 @@ func (pluginReg *PluginReg) LoadPlugin(namespace string, name string, version st
 		time.Sleep(DefaultInterval)
 	}
 	if pluginConn == nil {
-		return nil, PluginConnFailed
+		plugin.abortStart(pid, nil)
+		return PluginConnFailed
 	}
 
-	plugin := &Plugin{}
-	plugin.PluginSock = sockFile
-	plugin.PluginUrl = pluginConf.Url
-	plugin.pluginConn = pluginConn
-	plugin.connected = true
+	plugin.fdSock = ""
+	if fdSockFile != "" {
+		plugin.fdSock, _ = filepath.Abs(fdSockFile)
+	}
+	plugin.setConnection(pluginConn, pluginConf.Url)
+	plugin.setConnected(true)
 	plugin.callbacks = make(map[string]bool)
-	// set the plugin instance process id
-	plugin.pid = pid
-	plugin.pluginloc = pluginLoc
+
+	// Save the pidfile to find the instance if the host crashes
+	pidFileErr := writePidFile(plugin)
+	if pidFileErr != nil {
+		log.ERROR.Println("Failed to save the plugin pidfile: ", pidFileErr)
+	}
 
 	// Activate the plugin
 	activateErr := plugin.activate()
 	if activateErr != nil {
-		return plugin, activateErr
+		plugin.abortStart(pid, pluginConn)
+		return activateErr
 	}
+	pluginReg.startHealthMonitor(plugin)
 
-	return plugin, nil
+	return nil
+}
+
+// Internal: stop the process of an instance that failed to start and release what it was started with
+func (plugin *Plugin) abortStart(pid int, pluginConn *PluginConn.PluginClient) {
+	plugin.setStopping(true)
+	plugin.setConnected(false)
+	atomic.AddInt64(&plugin.generation, 1)
+	if pluginConn != nil {
+		pluginConn.Close()
+	}
+	plugin.stopHostServer()
+	plugin.closeFdConn()
+	stopErr := stopProcess(pid)
+	if stopErr != nil {
+		log.ERROR.Println("Failed to stop the plugin process: ", stopErr)
+	}
+	removePidFile(plugin.pluginloc, plugin.instance)
 }
 
-func (pluginReg *PluginReg) startPlugin(startFile string) (int, error) {
+/* Internal: start the plugin process with the resource limits and the sandbox applied */
+func (pluginReg *PluginReg) startPlugin(plugin *Plugin, spec *LaunchSpec, limits *common.ResourceLimits) (int, error) {
 
 	// Change the file permission
-	err := os.Chmod(startFile, 0777)
+	err := os.Chmod(spec.Path, 0777)
 	if err != nil {
 		log.DEBUG.Printf("Failed to change mode: %v", err)
 		return 0, err
 	}
 
-	dir := filepath.Dir(startFile)
-	startPath, _ := filepath.Abs(dir)
-	file := path.Base(startFile)
-
-	_, lookErr := exec.LookPath(startFile)
+	_, lookErr := exec.LookPath(spec.Path)
 	if lookErr != nil {
 		log.DEBUG.Printf("Lookerror")
 		return 0, lookErr
 	}
-	env := os.Environ()
-	attr := &syscall.ProcAttr{Dir: startPath, Env: env}
-	pid, execErr := syscall.ForkExec(file, nil, attr)
+
+	pid, execErr := pluginReg.startProcess(plugin, spec, limits)
 	if execErr != nil {
 		log.DEBUG.Printf("Exeerror")
 		return 0, execErr
@@ -476,32 +1074,72 @@ func (plugin *Plugin) checkConnection() bool {
 	return true
 }
 
+/* Reconnect to the plugin, the previous connection is closed */
 func (plugin *Plugin) ReConnect() error {
+	plugin.recoverAccess.Lock()
+	defer plugin.recoverAccess.Unlock()
+	return plugin.reconnect()
+}
+
+// Internal: connect to the plugin instance again and close the previous connection (called with recoverAccess held)
+func (plugin *Plugin) reconnect() error {
 
 	// Connect to the plugin
-	pluginConn, connErr := PluginConn.NewPluginClient(plugin.PluginSock)
+	pluginConn, connErr := plugin.newClient()
 	if connErr != nil {
-		plugin.connected = false
+		plugin.setConnected(false)
 		return fmt.Errorf("Failed to reconnect: %v", connErr)
 	}
-	// Set connection object
-	plugin.pluginConn = pluginConn
-	plugin.connected = true
+	// Set connection object, the callback long polls move to the new connection
+	_, pluginUrl := plugin.connection()
+	previous := plugin.setConnection(pluginConn, pluginUrl)
+	plugin.setConnected(true)
+	if previous != nil {
+		previous.Close()
+	}
 
 	return nil
 }
 
+// Internal: recover the instance after a call failed on a connection, the plugin is reconnected or else
+// reloaded. The calls failed concurrently wait for the first one to recover it and share its result
+func (plugin *Plugin) recover(generation int64, failed *PluginConn.PluginClient) error {
+	plugin.recoverAccess.Lock()
+	defer plugin.recoverAccess.Unlock()
+
+	if plugin.registry.isStopped() {
+		// The plugin is not started again while the registry unloads it
+		return RegistryStopped
+	}
+	current, _ := plugin.connection()
+	if atomic.LoadInt64(&plugin.generation) != generation || current != failed {
+		// Already reconnected, reloaded or stopped since the call was sent
+		if !plugin.isConnected() {
+			return fmt.Errorf("Plugin is not connected")
+		}
+		return nil
+	}
+
+	err := plugin.reconnect()
+	if err != nil {
+		err = plugin.reload()
+	}
+	return err
+}
+
 // Activate a plugin
 func (plugin *Plugin) activate() error {
-	pluginUrl := plugin.PluginUrl
-	pluginConn := plugin.pluginConn
+	pluginConn, pluginUrl := plugin.connection()
 
 	requestUrl := pluginUrl + "/Activate"
 	request := &PluginConn.PluginRequest{Url: requestUrl, Body: nil}
+	// Offer the codecs, the plugin returns the one it has chosen
+	request.Header = http.Header{}
+	request.Header.Set(common.CodecsHeader, strings.Join(plugin.registry.codecs, ", "))
 
 	resp, reqerr := pluginConn.Request(request)
 	if reqerr != nil {
-		plugin.connected = false
+		plugin.setConnected(false)
 		return reqerr
 	}
 	if resp.Status != "200 OK" {
@@ -509,18 +1147,31 @@ func (plugin *Plugin) activate() error {
 	}
 
 	// Get the response
-	unmarshalError := json.Unmarshal(resp.Body, &plugin.methods)
+	var methods []string
+	unmarshalError := json.Unmarshal(resp.Body, &methods)
 	if unmarshalError != nil {
 		return fmt.Errorf("Json Unmarshal failed: %s", unmarshalError)
 	}
+	codec := common.GetCodec(resp.Header.Get(common.CodecHeader))
+	if codec == nil {
+		codec = common.GetCodec(common.DefaultCodec)
+	}
+	plugin.stateAccess.Lock()
+	plugin.methods = methods
+	plugin.codec = codec
+	plugin.stateAccess.Unlock()
+	// The reloaded plugin could have changed its methods
+	plugin.describeAccess.Lock()
+	plugin.descriptors = nil
+	plugin.describeErr = nil
+	plugin.describeAccess.Unlock()
 
 	return nil
 }
 
 // Deactivate a plugin
 func (plugin *Plugin) stop() error {
-	pluginUrl := plugin.PluginUrl
-	pluginConn := plugin.pluginConn
+	pluginConn, pluginUrl := plugin.connection()
 
 	requestUrl := pluginUrl + "/Stop"
 	request := &PluginConn.PluginRequest{Url: requestUrl, Body: nil}
@@ -539,22 +1190,36 @@ func (plugin *Plugin) stop() error {
 /* Get the list of available (registered) methods for a specific plugin */
 func (plugin *Plugin) GetMethods() []string {
 
-	var methods []string
-	methods = plugin.methods
+	methods, _ := plugin.activation()
 	return methods
 }
 
 /* Register a callback that will be called on notification from the plugin */
 func (plugin *Plugin) RegisterCallback(function func([]byte)) error {
 
-	if !plugin.connected {
-		return fmt.Errorf("Plugin is not connected")
-	}
-
 	funcName := getFuncName(function)
 	if funcName == "" {
 		return fmt.Errorf("Failed to get the method name")
 	}
+	return plugin.registerNamedCallback(funcName, function)
+}
+
+// Internal: register a callback by name
+func (plugin *Plugin) registerNamedCallback(funcName string, function func([]byte)) error {
+
+	// On-demand plugin registers the callback on each start
+	if plugin.onDemand != nil {
+		return plugin.onDemand.registerCallback(plugin, funcName, function)
+	}
+
+	if !plugin.isConnected() {
+		return fmt.Errorf("Plugin is not connected")
+	}
+	return plugin.registerCallback(funcName, function)
+}
+
+// Internal: register a callback by name on the running plugin instance
+func (plugin *Plugin) registerCallback(funcName string, function func([]byte)) error {
 	// Check if the callback is already registered
 	_, ok := plugin.callbacks[funcName]
 	if ok {
@@ -563,14 +1228,14 @@ func (plugin *Plugin) RegisterCallback(function func([]byte)) error {
 	// Put the callback function in the callbacks map
 	plugin.callbacks[funcName] = false
 
-	// Start the execution thread
-	go plugin.executeCallback(funcName, function)
+	// Start the execution thread, it ends once the instance is stopped or restarted
+	go plugin.executeCallback(atomic.LoadInt64(&plugin.generation), funcName, function)
 
 	return nil
 }
 
 // Internal:  thread body to execute a callback request
-func (plugin *Plugin) executeCallback(funcName string, function func([]byte)) {
+func (plugin *Plugin) executeCallback(generation int64, funcName string, function func([]byte)) {
 	// wrap the method name in bytes
 	data, marshalErr := json.Marshal(funcName)
 	if marshalErr != nil {
@@ -578,22 +1243,29 @@ func (plugin *Plugin) executeCallback(funcName string, function func([]byte)) {
 		return
 	}
 
-	pluginUrl := plugin.PluginUrl
-	pluginConn := plugin.pluginConn
-
-	requestUrl := pluginUrl + "/" + "RegisterCallback"
-	request := &PluginConn.PluginRequest{Url: requestUrl, Body: data}
-
 	//	for plugin.callbacks[funcName] == false {
 	for true {
-		resp, err := pluginConn.Request(request)
+		pluginConn, pluginUrl := plugin.connection()
+		requestUrl := pluginUrl + "/" + "RegisterCallback"
+		request := &PluginConn.PluginRequest{Url: requestUrl, Body: data}
+
+		// Long poll on its own connection so that the method calls are not blocked
+		resp, err := pluginConn.LongPoll(request)
+		if atomic.LoadInt64(&plugin.generation) != generation {
+			// The instance is stopped or restarted by the registry
+			return
+		}
+		if current, _ := plugin.connection(); err != nil && current != pluginConn {
+			// The plugin is reconnected, poll on the new connection
+			continue
+		}
 		if err != nil {
-			plugin.connected = false
-			log.FATAL.Fatalf("Failed to sent CallBack Execution Request: %v", err)
+			plugin.setConnected(false)
+			log.ERROR.Printf("Failed to sent CallBack Execution Request for %s: %v", funcName, err)
 			return
 		}
 		if resp.Status != "200 OK" {
-			log.FATAL.Fatalf("Failed to sent callback request")
+			log.ERROR.Printf("Failed to sent callback request for %s: %s", funcName, resp.Status)
 			return
 		}
 		// get the data from resp
@@ -604,62 +1276,114 @@ func (plugin *Plugin) executeCallback(funcName string, function func([]byte)) {
 }
 
 /* Executes a specific plugin method by the method name. Each method takes a byte array as input
-   and returns a byte array as output */
+   and returns a byte array as output. For a plugin pool the call is sent to one of the instances.
+   An on-demand plugin is started if it is not running. An *os.File, socket or listener argument
+   is passed to the plugin as an open descriptor, the caller keeps its own */
 func (plugin *Plugin) Execute(funcName string, args ...interface{}) (error, []interface{}) {
+	return plugin.ExecuteContext(context.Background(), funcName, args...)
+}
 
-	if !plugin.connected {
-		return fmt.Errorf("Plugin is not connected"), nil
+/* Executes a specific plugin method with a context. The context deadline is propagated to the plugin
+   and the plugin method context is cancelled when ctx is done. It returns ExecuteTimeout if the
+   deadline is exceeded and the context error if it is cancelled */
+func (plugin *Plugin) ExecuteContext(ctx context.Context, funcName string, args ...interface{}) (error, []interface{}) {
+	if plugin.registry.isStopped() {
+		return RegistryStopped, nil
 	}
-
-	found := false
-	// check if method is registered
-	for _, method := range plugin.methods {
-		if method == funcName {
-			found = true
-			break
+	if plugin.onDemand != nil {
+		startErr := plugin.onDemand.acquire(plugin)
+		if startErr != nil {
+			return startErr, nil
 		}
+		defer plugin.onDemand.release()
 	}
-	if !found {
-		return fmt.Errorf("Method of name : %s is not registered", funcName), nil
+	validateErr := plugin.validateArgs(funcName, args)
+	if validateErr != nil {
+		return validateErr, nil
 	}
+	if pool := plugin.getPool(); pool != nil {
+		return pool.execute(ctx, funcName, args...)
+	}
+	atomic.AddInt64(&plugin.outstanding, 1)
+	defer atomic.AddInt64(&plugin.outstanding, -1)
+	return plugin.execute(ctx, funcName, args...)
+}
 
-	pluginUrl := plugin.PluginUrl
-	pluginConn := plugin.pluginConn
+// Internal: execute a method on the plugin instance (the call is accounted in outstanding by the caller)
+func (plugin *Plugin) execute(ctx context.Context, funcName string, args ...interface{}) (error, []interface{}) {
+
+	if !plugin.isConnected() {
+		return plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorPluginCrashed, "Plugin is not connected")), nil
+	}
+
+	// check if method is registered
+	if !plugin.hasMethod(funcName) {
+		return plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorMethodNotFound, "Method of name : %s is not registered", funcName)), nil
+	}
+
+	generation := atomic.LoadInt64(&plugin.generation)
+	pluginConn, pluginUrl := plugin.connection()
 
 	requestUrl := pluginUrl + "/" + funcName
-	data := CreateJson(args)
-	request := &PluginConn.PluginRequest{Url: requestUrl, Body: data}
+	request, encodeErr := plugin.newRequest(requestUrl, args)
+	if encodeErr != nil {
+		return plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorInternal, "Failed to encode the arguments: %v", encodeErr)), nil
+	}
 
-	resp, err := pluginConn.Request(request)
-	if err != nil {
-		plugin.connected = false
-		// try to reconnect the plugin
-		err := plugin.ReConnect()
-		if err != nil {
-			err = plugin.ReloadPlugin()
-		}
-		if err != nil {
-			return fmt.Errorf("Failed to communicate with plugin"), nil
+	resp, reqErr := pluginConn.RequestContext(ctx, request)
+	if reqErr != nil && ctx.Err() != nil {
+		// The caller gave up, the plugin is still connected
+		if ctx.Err() == context.DeadlineExceeded {
+			return ExecuteTimeout, nil
 		}
+		return ctx.Err(), nil
+	}
+	if reqErr != nil {
+		plugin.setConnected(false)
+		// try to reconnect the plugin (once for the calls failed on the same connection)
+		err := plugin.recover(generation, pluginConn)
+		// The call is lost, it could be retried on the recovered plugin
+		envelope := common.NewErrorEnvelope(common.ErrorPluginCrashed, "Failed to communicate with plugin: %v", reqErr)
+		envelope.Retryable = err == nil
+		return plugin.callError(funcName, envelope), nil
 	}
 	if resp.Status != "200 OK" {
-		return fmt.Errorf("request failed"), nil
+		return plugin.responseError(funcName, resp.Status, resp.Header, resp.Body), nil
 	}
 
-	ret := resp.Body
-
-	if string(resp.Body) == "<nil>" {
-		ret = nil
+	// The results are decoded with the codec the plugin has answered with
+	codec := common.CodecByContentType(resp.Header.Get("Content-Type"))
+	ret, decodeErr := codec.Decode(resp.Body)
+	if decodeErr != nil {
+		return plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorInternal, "%v", decodeErr)), nil
 	}
 
 	return nil, ret
 }
 
+// Internal: prepare a method call request with the arguments encoded by the negotiated codec
+func (plugin *Plugin) newRequest(requestUrl string, args []interface{}) (*PluginConn.PluginRequest, error) {
+	_, codec := plugin.activation()
+	if codec == nil {
+		codec = common.GetCodec(common.DefaultCodec)
+	}
+	args, err := plugin.passArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	data, err := codec.Encode(args)
+	if err != nil {
+		return nil, err
+	}
+	request := &PluginConn.PluginRequest{Url: requestUrl, Body: data, Header: http.Header{}}
+	request.Header.Set("Content-Type", codec.ContentType())
+	return request, nil
+}
+
 /* Ping a specific plugin to check the plugin status */
 func (plugin *Plugin) Ping() error {
 
-	pluginUrl := plugin.PluginUrl
-	pluginConn := plugin.pluginConn
+	pluginConn, pluginUrl := plugin.connection()
 
 	testData := "Test Data"
 	sendData := []byte(testData)
@@ -669,7 +1393,7 @@ func (plugin *Plugin) Ping() error {
 
 	resp, err := pluginConn.Request(request)
 	if err != nil {
-		plugin.connected = false
+		plugin.setConnected(false)
 		return err
 	}
 	if resp.Status != "200 OK" {
@@ -0,0 +1,87 @@
+package pluginmanager
+
+import (
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Internal: listen on a unix socket and count the accepted connections
+func countingListener(t *testing.T) (string, *int64) {
+	sockFile := filepath.Join(t.TempDir(), PluginSockFile)
+	listener, err := net.Listen("unix", sockFile)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := new(int64)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(accepted, 1)
+			conn.Close()
+		}
+	}()
+	return sockFile, accepted
+}
+
+func TestRecoverOnce(t *testing.T) {
+	sockFile, accepted := countingListener(t)
+	failed, err := PluginConn.NewAuthPluginClient(sockFile, "")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	plugin := &Plugin{key: "ns_calc_1", PluginSock: sockFile, PluginUrl: PluginUrl, pluginConn: failed}
+	generation := atomic.LoadInt64(&plugin.generation)
+	for atomic.LoadInt64(accepted) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt64(accepted, 0)
+
+	// The calls failed on the same connection reconnect the plugin once
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- plugin.recover(generation, failed)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Recover failed: %v", err)
+		}
+	}
+	// The accepts are counted after the dials return
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(accepted) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if count := atomic.LoadInt64(accepted); count != 1 {
+		t.Errorf("The plugin is reconnected %d times", count)
+	}
+	current, _ := plugin.connection()
+	if current == failed || !plugin.isConnected() {
+		t.Errorf("The failed connection is not replaced")
+	}
+
+	// A call failed before a reload doesn't recover the restarted instance
+	atomic.AddInt64(&plugin.generation, 1)
+	err = plugin.recover(generation, current)
+	time.Sleep(50 * time.Millisecond)
+	if err != nil || atomic.LoadInt64(accepted) != 1 {
+		t.Errorf("A stale call recovered the plugin: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+/* Plugin pool runs multiple instances (processes) of a plugin and
+ * distributes the Execute calls among them. The first instance is the
+ * plugin handle returned by the registry, it owns the pool
+ */
+
+package pluginmanager
+
+import (
+	"context"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type pluginPool struct {
+	pluginReg *PluginReg
+	pluginLoc string
+	conf      *common.PoolConf
+	// The running instances, instances[0] is the primary plugin handle
+	instances []*Plugin
+	// The instances removed on scale down, they are unloaded once their in-flight calls end
+	draining []*Plugin
+	// Round robin counter
+	next uint64
+	// Set while an instance is being started for scale up
+	scaling bool
+	// The last time the pool had in-flight requests
+	lastBusy time.Time
+	access   *sync.Mutex
+	stopchan chan int
+}
+
+// Internal: get the instance specific name of a plugin file (the first instance keeps the name as it is)
+func instanceFile(name string, instance int) string {
+	if instance == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), instance, ext)
+}
+
+// Internal: start the minimum number of instances for a plugin configured with a pool
+func (pluginReg *PluginReg) startPool(primary *Plugin) error {
+	conf := primary.poolConf
+	if conf == nil || conf.Max <= 1 {
+		return nil
+	}
+
+	pool := &pluginPool{
+		pluginReg: pluginReg,
+		pluginLoc: primary.pluginloc,
+		conf:      conf,
+		instances: []*Plugin{primary},
+		lastBusy:  time.Now(),
+		access:    &sync.Mutex{},
+		stopchan:  make(chan int),
+	}
+	for len(pool.instances) < conf.Min {
+		instance, err := pluginReg.loadInstance(pool.pluginLoc, pool.freeInstance())
+		if err != nil {
+			pool.unloadInstances()
+			return fmt.Errorf("Failed to start plugin pool instance: %v", err)
+		}
+		pool.instances = append(pool.instances, instance)
+	}
+	primary.setPool(pool)
+
+	if conf.Max > conf.Min {
+		go pool.autoscale()
+	}
+	return nil
+}
+
+// Internal: get the lowest instance number not in use
+func (pool *pluginPool) freeInstance() int {
+	for number := 1; ; number++ {
+		used := false
+		for _, instance := range pool.instances {
+			if instance.instance == number {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return number
+		}
+	}
+}
+
+// Internal: pick an instance as per the balancing configuration. The call is accounted in the
+// outstanding requests of the instance under the pool lock, so the instance is not drained before
+// the call is sent. The caller decrements it at the end of the call
+func (pool *pluginPool) pick() *Plugin {
+	pool.access.Lock()
+	defer pool.access.Unlock()
+
+	var picked *Plugin
+	if pool.conf.Balance == common.BalanceLeastOutstanding {
+		picked = pool.instances[0]
+		for _, instance := range pool.instances[1:] {
+			if atomic.LoadInt64(&instance.outstanding) < atomic.LoadInt64(&picked.outstanding) {
+				picked = instance
+			}
+		}
+	} else {
+		pool.next++
+		picked = pool.instances[pool.next%uint64(len(pool.instances))]
+	}
+	atomic.AddInt64(&picked.outstanding, 1)
+	return picked
+}
+
+// Internal: execute a method on one of the pool instances
+func (pool *pluginPool) execute(ctx context.Context, funcName string, args ...interface{}) (error, []interface{}) {
+	instance := pool.pick()
+	defer atomic.AddInt64(&instance.outstanding, -1)
+	return instance.execute(ctx, funcName, args...)
+}
+
+// Internal: the pool monitor that scales up on queue depth and scales down when idle
+func (pool *pluginPool) autoscale() {
+	ticker := time.NewTicker(DefaultInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-pool.stopchan:
+			return
+		}
+
+		pool.access.Lock()
+		var outstanding int64 = 0
+		for _, instance := range pool.instances {
+			outstanding += atomic.LoadInt64(&instance.outstanding)
+		}
+		count := len(pool.instances)
+		if outstanding > 0 {
+			pool.lastBusy = time.Now()
+		}
+		idle := time.Since(pool.lastBusy) > time.Duration(pool.conf.ScaleDownIdle)*time.Second
+
+		switch {
+		case !pool.scaling && count < pool.conf.Max && outstanding > int64(count*pool.conf.ScaleUpQueue):
+			pool.scaling = true
+			go pool.scaleUp(pool.freeInstance())
+		case idle && count > pool.conf.Min:
+			// Drain the last started instance, it is not picked anymore
+			instance := pool.instances[count-1]
+			pool.instances = pool.instances[:count-1]
+			pool.draining = append(pool.draining, instance)
+			pool.lastBusy = time.Now()
+			log.INFO.Printf("Scaling down plugin %s to %d instances", instance.key, count-1)
+			go pool.drain(instance)
+		}
+		pool.access.Unlock()
+	}
+}
+
+// Internal: unload a drained instance once its in-flight calls end (or right away if the pool is stopped)
+func (pool *pluginPool) drain(instance *Plugin) {
+	ticker := time.NewTicker(DefaultInterval / 5)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&instance.outstanding) > 0 {
+		select {
+		case <-ticker.C:
+		case <-pool.stopchan:
+			// The draining instances are unloaded with the pool
+			return
+		}
+	}
+
+	pool.access.Lock()
+	found := false
+	for index, draining := range pool.draining {
+		if draining == instance {
+			pool.draining = append(pool.draining[:index], pool.draining[index+1:]...)
+			found = true
+			break
+		}
+	}
+	pool.access.Unlock()
+	if found {
+		instance.unloadInstance()
+	}
+}
+
+// Internal: get the running and the draining instances
+func (pool *pluginPool) allInstances() []*Plugin {
+	pool.access.Lock()
+	defer pool.access.Unlock()
+	instances := append([]*Plugin{}, pool.instances...)
+	return append(instances, pool.draining...)
+}
+
+// Internal: start a new instance and add it to the pool
+func (pool *pluginPool) scaleUp(number int) {
+	instance, err := pool.pluginReg.loadInstance(pool.pluginLoc, number)
+
+	pool.access.Lock()
+	defer pool.access.Unlock()
+	pool.scaling = false
+	if err != nil {
+		log.ERROR.Printf("Failed to scale up plugin pool %s: %v", pool.pluginLoc, err)
+		return
+	}
+	select {
+	case <-pool.stopchan:
+		// pool stopped while the instance was starting
+		go instance.unloadInstance()
+		return
+	default:
+	}
+	pool.instances = append(pool.instances, instance)
+	log.INFO.Printf("Scaled up plugin %s to %d instances", instance.key, len(pool.instances))
+}
+
+// Internal: stop the pool monitor and unload all the instances except the primary
+func (pool *pluginPool) stop() {
+	close(pool.stopchan)
+	pool.unloadInstances()
+}
+
+func (pool *pluginPool) unloadInstances() {
+	pool.access.Lock()
+	instances := append(append([]*Plugin{}, pool.instances[1:]...), pool.draining...)
+	pool.instances = pool.instances[:1]
+	pool.draining = nil
+	pool.access.Unlock()
+
+	for _, instance := range instances {
+		instance.unloadInstance()
+	}
+}
+
+/* Get the number of running instances of a plugin */
+func (plugin *Plugin) Instances() int {
+	pool := plugin.getPool()
+	if pool == nil {
+		return 1
+	}
+	pool.access.Lock()
+	defer pool.access.Unlock()
+	return len(pool.instances)
+}
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package pluginmanager
+
+import (
+	common "github.com/swarvanusg/GoPlug/common"
+	"syscall"
+)
+
+/* Internal: start the plugin process. Cgroup constraints are applied at fork, the rlimits and the
+   sandbox are applied by the init stage before the plugin binary is executed */
+func (pluginReg *PluginReg) startProcess(plugin *Plugin, spec *LaunchSpec, limits *common.ResourceLimits) (int, error) {
+	attr := &syscall.ProcAttr{Dir: spec.Dir, Env: spec.Env}
+	// The plugin process dies with the host
+	sys := &syscall.SysProcAttr{Pdeathsig: PluginDeathSignal}
+	attr.Sys = sys
+
+	if limits != nil && limits.Cgroup != nil {
+		cgroupPath, cgroupFd, cgroupErr := createCgroup(pluginReg.cgroupRoot, plugin.instanceKey(), limits.Cgroup)
+		if cgroupErr != nil {
+			return 0, cgroupErr
+		}
+		defer syscall.Close(cgroupFd)
+		plugin.cgroupPath = cgroupPath
+		sys.UseCgroupFD = true
+		sys.CgroupFD = cgroupFd
+	}
+
+	rlimits := rlimitValues(limits)
+	if len(rlimits) == 0 && pluginReg.sandbox == nil {
+		pid, execErr := syscall.ForkExec(spec.Path, spec.Args, attr)
+		if execErr != nil {
+			removeCgroup(plugin.cgroupPath)
+			return 0, execErr
+		}
+		return pid, nil
+	}
+
+	stage := &initSpec{File: spec.Path, Args: spec.Args, Env: spec.Env, Dir: spec.Dir, Rlimits: rlimits, Pdeathsig: int(sys.Pdeathsig)}
+	if pluginReg.sandbox != nil {
+		sandboxErr := pluginReg.prepareSandbox(plugin, stage, sys)
+		if sandboxErr != nil {
+			removeCgroup(plugin.cgroupPath)
+			return 0, sandboxErr
+		}
+	}
+
+	pid, execErr := forkInit(stage, attr)
+	if execErr != nil {
+		removeCgroup(plugin.cgroupPath)
+		if pluginReg.sandbox != nil {
+			return 0, sandboxStartError(pluginReg.sandbox, execErr)
+		}
+		return 0, execErr
+	}
+	return pid, nil
+}
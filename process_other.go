@@ -0,0 +1,23 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package pluginmanager
+
+import (
+	"fmt"
+	common "github.com/swarvanusg/GoPlug/common"
+	"runtime"
+	"syscall"
+)
+
+// Internal: start the plugin process, the resource limits and the sandbox are not supported
+func (pluginReg *PluginReg) startProcess(plugin *Plugin, spec *LaunchSpec, limits *common.ResourceLimits) (int, error) {
+	if limits != nil {
+		return 0, fmt.Errorf("Resource limits are not supported on %s", runtime.GOOS)
+	}
+	if pluginReg.sandbox != nil {
+		return 0, fmt.Errorf("Sandbox is not supported on %s", runtime.GOOS)
+	}
+	attr := &syscall.ProcAttr{Dir: spec.Dir, Env: spec.Env}
+	return syscall.ForkExec(spec.Path, spec.Args, attr)
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package pluginmanager
+
+import (
+	"syscall"
+)
+
+var (
+	// The signal the plugin process is stopped with
+	stopSignal = syscall.SIGUSR1
+)
+
+// Internal: check if a process is running
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// Internal: send a signal to a process
+func signalProcess(pid int, signal syscall.Signal) error {
+	return syscall.Kill(pid, signal)
+}
+
+// Internal: wait for a child process to terminate
+func waitProcess(pid int) (syscall.WaitStatus, error) {
+	var status syscall.WaitStatus
+	_, err := syscall.Wait4(pid, &status, 0, nil)
+	return status, err
+}
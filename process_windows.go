@@ -0,0 +1,79 @@
+//go:build windows
+// +build windows
+
+package pluginmanager
+
+import (
+	"fmt"
+	common "github.com/swarvanusg/GoPlug/common"
+	"runtime"
+	"syscall"
+)
+
+const (
+	// The exit code of a process still running
+	stillActive = 259
+)
+
+var (
+	// Windows has no signals, the plugin process is terminated
+	stopSignal = syscall.SIGKILL
+)
+
+// Internal: start the plugin process, the resource limits and the sandbox are not supported
+func (pluginReg *PluginReg) startProcess(plugin *Plugin, spec *LaunchSpec, limits *common.ResourceLimits) (int, error) {
+	if limits != nil {
+		return 0, fmt.Errorf("Resource limits are not supported on %s", runtime.GOOS)
+	}
+	if pluginReg.sandbox != nil {
+		return 0, fmt.Errorf("Sandbox is not supported on %s", runtime.GOOS)
+	}
+	attr := &syscall.ProcAttr{Dir: spec.Dir, Env: spec.Env}
+	pid, handle, err := syscall.StartProcess(spec.Path, spec.Args, attr)
+	if err != nil {
+		return 0, err
+	}
+	syscall.CloseHandle(syscall.Handle(handle))
+	return pid, nil
+}
+
+// Internal: check if a process is running
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	handle, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(handle)
+	var code uint32
+	err = syscall.GetExitCodeProcess(handle, &code)
+	return err == nil && code == stillActive
+}
+
+// Internal: terminate a process, the signal is not delivered
+func signalProcess(pid int, signal syscall.Signal) error {
+	handle, err := syscall.OpenProcess(syscall.PROCESS_TERMINATE, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+	return syscall.TerminateProcess(handle, uint32(128+int(signal)))
+}
+
+// Internal: wait for a process to terminate
+func waitProcess(pid int) (syscall.WaitStatus, error) {
+	handle, err := syscall.OpenProcess(syscall.SYNCHRONIZE|syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return syscall.WaitStatus{}, err
+	}
+	defer syscall.CloseHandle(handle)
+	_, err = syscall.WaitForSingleObject(handle, syscall.INFINITE)
+	if err != nil {
+		return syscall.WaitStatus{}, err
+	}
+	var code uint32
+	err = syscall.GetExitCodeProcess(handle, &code)
+	return syscall.WaitStatus{ExitCode: code}, err
+}
@@ -0,0 +1,204 @@
+/* Remote plugins are hosted by an agent on another machine. The registry loads
+ * them through the agent control API and calls them with the plugin protocol
+ * over tcp with mutual TLS, so a remote plugin is used like a local one
+ */
+
+package pluginmanager
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"strings"
+	"sync/atomic"
+)
+
+/* The configuration of an agent the registry loads remote plugins from */
+type AgentConf struct {
+	// The name the agent is referred by
+	Name string
+	// The tcp address of the agent
+	Addr string
+	// The host TLS files, the agent certificate must be signed by the CA
+	Tls *common.TlsConf
+	// The secret the agent requires (not sent if empty)
+	Secret string
+}
+
+/* A plugin hosted by an agent */
+type AgentPluginInfo struct {
+	// The plugin id (namespace _ name _ version)
+	Key string `json:"key"`
+	// The plugin is loaded by the agent
+	Loaded bool `json:"loaded"`
+	// The methods of a loaded plugin
+	Methods []string `json:"methods,omitempty"`
+}
+
+// Internal: connect to an agent
+func (agent *AgentConf) connect() (*PluginConn.PluginClient, *tls.Config, error) {
+	if agent.Tls == nil {
+		return nil, nil, fmt.Errorf("The TLS conf of agent %s is not set", agent.Name)
+	}
+	tlsConfig, err := hostTlsConfig(agent.Tls)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := PluginConn.NewTcpPluginClient(agent.Addr, tlsConfig, agent.Secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to connect to agent %s: %v", agent.Name, err)
+	}
+	return conn, tlsConfig, nil
+}
+
+// Internal: send a control request to an agent and decode its json response in result
+func agentControl(conn *PluginConn.PluginClient, action string, key string, result interface{}) error {
+	requestUrl := PluginUrl + agentControlPath + action
+	if key != "" {
+		requestUrl += "/" + key
+	}
+	resp, err := conn.Request(&PluginConn.PluginRequest{Url: requestUrl, Body: nil})
+	if err != nil {
+		return err
+	}
+	if resp.Status != "200 OK" {
+		return fmt.Errorf("Agent %s request failed. Status: %s, %s", action, resp.Status, strings.TrimSpace(string(resp.Body)))
+	}
+	if result == nil {
+		return nil
+	}
+	unmarshalError := json.Unmarshal(resp.Body, result)
+	if unmarshalError != nil {
+		return fmt.Errorf("Json Unmarshal failed: %s", unmarshalError)
+	}
+	return nil
+}
+
+// Internal: get an agent by name
+func (pluginReg *PluginReg) getAgent(name string) *AgentConf {
+	for _, agent := range pluginReg.agents {
+		if agent.Name == name {
+			return agent
+		}
+	}
+	return nil
+}
+
+/* Get the plugins discovered by an agent */
+func (pluginReg *PluginReg) AgentPlugins(name string) ([]AgentPluginInfo, error) {
+	agent := pluginReg.getAgent(name)
+	if agent == nil {
+		return nil, fmt.Errorf("Agent %s is not configured", name)
+	}
+	conn, _, err := agent.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	plugins := make([]AgentPluginInfo, 0)
+	err = agentControl(conn, "plugins", "", &plugins)
+	return plugins, err
+}
+
+// Internal: find the agent hosting a plugin, nil if no agent has it
+func (pluginReg *PluginReg) findAgent(key string) *AgentConf {
+	for _, agent := range pluginReg.agents {
+		plugins, err := pluginReg.AgentPlugins(agent.Name)
+		if err != nil {
+			log.ERROR.Printf("Failed to get the plugins of agent %s: %v", agent.Name, err)
+			continue
+		}
+		for _, plugin := range plugins {
+			if plugin.Key == key {
+				return agent
+			}
+		}
+	}
+	return nil
+}
+
+/* Load a plugin hosted by an agent. The agent launches and supervises the plugin process,
+   the returned plugin is used like a local one (files and blobs are sent inline or not at all) */
+func (pluginReg *PluginReg) LoadRemotePlugin(agentName string, namespace string, name string, version string) (*Plugin, error) {
+	agent := pluginReg.getAgent(agentName)
+	if agent == nil {
+		return nil, fmt.Errorf("Agent %s is not configured", agentName)
+	}
+	return pluginReg.loadRemote(agent, getKey(name, namespace, version))
+}
+
+// Internal: load a plugin on an agent and connect to it
+func (pluginReg *PluginReg) loadRemote(agent *AgentConf, key string) (*Plugin, error) {
+	conn, tlsConfig, err := agent.connect()
+	if err != nil {
+		return nil, err
+	}
+	info := AgentPluginInfo{}
+	err = agentControl(conn, "load", key, &info)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	plugin := &Plugin{}
+	plugin.key = key
+	plugin.agent = agent
+	plugin.registry = pluginReg
+	plugin.PluginSock = agent.Addr
+	plugin.PluginUrl = PluginUrl + agentPluginPath + key
+	plugin.pluginConn = conn
+	plugin.setConnected(true)
+	plugin.callbacks = make(map[string]bool)
+	plugin.network = common.TransportTcp
+	plugin.hostTls = agent.Tls
+	plugin.tlsConfig = tlsConfig
+	plugin.secret = agent.Secret
+
+	// Negotiate the codec with the agent
+	activateErr := plugin.activate()
+	if activateErr != nil {
+		conn.Close()
+		return nil, activateErr
+	}
+	addErr := pluginReg.addPlugin(plugin)
+	if addErr != nil {
+		plugin.UnloadPlugin()
+		return nil, addErr
+	}
+	log.INFO.Printf("Loaded plugin %s from agent %s", key, agent.Name)
+
+	return plugin, nil
+}
+
+// Internal: unload a remote plugin on its agent
+func (plugin *Plugin) unloadRemote() error {
+	plugin.setStopping(true)
+	pluginConn, _ := plugin.connection()
+	err := agentControl(pluginConn, "unload", plugin.key, nil)
+	// Abort the callback long polls
+	atomic.AddInt64(&plugin.generation, 1)
+	pluginConn.Close()
+	plugin.setConnected(false)
+	plugin.registry.removePlugin(plugin)
+	return err
+}
+
+// Internal: reload a remote plugin on its agent (called with recoverAccess held)
+func (plugin *Plugin) reloadRemote() error {
+	if !plugin.isConnected() {
+		err := plugin.reconnect()
+		if err != nil {
+			return err
+		}
+	}
+	pluginConn, _ := plugin.connection()
+	err := agentControl(pluginConn, "reload", plugin.key, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to reload plugin: %v", err)
+	}
+	return plugin.activate()
+}
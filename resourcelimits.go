@@ -0,0 +1,54 @@
+/* Resource limits (rlimits and cgroup v2) applied to the plugin processes.
+ * The limits are supported on linux only
+ */
+
+package pluginmanager
+
+import (
+	"bufio"
+	log "github.com/spf13/jwalterweatherman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Default cgroup v2 parent of the plugin cgroups
+	DefaultCgroupRoot = "/sys/fs/cgroup/goplug"
+)
+
+// Internal: remove a plugin cgroup, it fails silently if process is still attached
+func removeCgroup(cgroupPath string) {
+	if cgroupPath == "" {
+		return
+	}
+	err := os.Remove(cgroupPath)
+	if err != nil {
+		log.DEBUG.Printf("Failed to remove cgroup %s: %v", cgroupPath, err)
+	}
+}
+
+func writeCgroupFile(cgroupPath string, file string, value string) error {
+	return ioutil.WriteFile(filepath.Join(cgroupPath, file), []byte(value), 0644)
+}
+
+// Internal: get the number of oom kill recorded for a cgroup
+func cgroupOomKills(cgroupPath string) int {
+	file, err := os.Open(filepath.Join(cgroupPath, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, _ := strconv.Atoi(fields[1])
+			return count
+		}
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+//go:build linux
+// +build linux
+
+package pluginmanager
+
+import (
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Internal: create the cgroup for a plugin and write the configured constraints.
+// It returns the cgroup path and an open fd of the cgroup dir to be used while forking
+func createCgroup(cgroupRoot string, key string, limits *common.CgroupLimits) (string, int, error) {
+	if cgroupRoot == "" {
+		cgroupRoot = DefaultCgroupRoot
+	}
+	err := os.MkdirAll(cgroupRoot, 0755)
+	if err != nil {
+		return "", -1, fmt.Errorf("Failed to create cgroup root %s: %v", cgroupRoot, err)
+	}
+	// Enable the controllers for the child cgroups, it might be already enabled
+	controlErr := writeCgroupFile(cgroupRoot, "cgroup.subtree_control", "+memory +cpu +pids")
+	if controlErr != nil {
+		log.DEBUG.Printf("Failed to enable cgroup controllers in %s: %v", cgroupRoot, controlErr)
+	}
+
+	cgroupPath := filepath.Join(cgroupRoot, key)
+	err = os.MkdirAll(cgroupPath, 0755)
+	if err != nil {
+		return "", -1, fmt.Errorf("Failed to create cgroup %s: %v", cgroupPath, err)
+	}
+
+	constraints := map[string]string{
+		"memory.max": limits.MemoryMax,
+		"cpu.max":    limits.CpuMax,
+		"pids.max":   limits.PidsMax,
+	}
+	for file, value := range constraints {
+		if value == "" {
+			continue
+		}
+		writeErr := writeCgroupFile(cgroupPath, file, value)
+		if writeErr != nil {
+			removeCgroup(cgroupPath)
+			return "", -1, fmt.Errorf("Failed to set %s for %s: %v", file, key, writeErr)
+		}
+	}
+
+	fd, openErr := syscall.Open(cgroupPath, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if openErr != nil {
+		removeCgroup(cgroupPath)
+		return "", -1, fmt.Errorf("Failed to open cgroup %s: %v", cgroupPath, openErr)
+	}
+
+	return cgroupPath, fd, nil
+}
+
+// Internal: get the rlimits to apply by resource
+func rlimitValues(limits *common.ResourceLimits) map[int]uint64 {
+	rlimits := map[int]uint64{}
+	if limits == nil {
+		return rlimits
+	}
+	if limits.AddressSpace != 0 {
+		rlimits[syscall.RLIMIT_AS] = limits.AddressSpace
+	}
+	if limits.OpenFiles != 0 {
+		rlimits[syscall.RLIMIT_NOFILE] = limits.OpenFiles
+	}
+	if limits.CpuSeconds != 0 {
+		rlimits[syscall.RLIMIT_CPU] = limits.CpuSeconds
+	}
+	if limits.CoreDump != nil {
+		rlimits[syscall.RLIMIT_CORE] = *limits.CoreDump
+	}
+	return rlimits
+}
+
+// Internal: apply the rlimits to the current process, it is done by the init stage before exec
+func setRlimits(rlimits map[int]uint64) error {
+	for resource, value := range rlimits {
+		rlimit := syscall.Rlimit{Cur: value, Max: value}
+		err := syscall.Setrlimit(resource, &rlimit)
+		if err != nil {
+			return fmt.Errorf("Failed to set rlimit %d to %d: %v", resource, value, err)
+		}
+	}
+	return nil
+}
+
+// Internal: find the termination reason of a plugin process from its wait status
+func terminationReason(status syscall.WaitStatus, cgroupPath string, stopping bool) (TerminationReason, int) {
+	if status.Signaled() {
+		signal := status.Signal()
+		switch {
+		case signal == syscall.SIGXCPU:
+			return TerminationCpuLimit, int(signal)
+		case signal == syscall.SIGXFSZ:
+			return TerminationFileSizeLimit, int(signal)
+		case signal == syscall.SIGKILL && cgroupOomKills(cgroupPath) > 0:
+			return TerminationMemoryLimit, int(signal)
+		case stopping:
+			return TerminationStopped, int(signal)
+		}
+		return TerminationSignaled, int(signal)
+	}
+	if stopping {
+		return TerminationStopped, status.ExitStatus()
+	}
+	return TerminationExited, status.ExitStatus()
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package pluginmanager
+
+import (
+	"syscall"
+)
+
+// Internal: find the termination reason of a plugin process from its wait status
+func terminationReason(status syscall.WaitStatus, cgroupPath string, stopping bool) (TerminationReason, int) {
+	if status.Signaled() {
+		if stopping {
+			return TerminationStopped, int(status.Signal())
+		}
+		return TerminationSignaled, int(status.Signal())
+	}
+	if stopping {
+		return TerminationStopped, status.ExitStatus()
+	}
+	return TerminationExited, status.ExitStatus()
+}
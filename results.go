@@ -0,0 +1,28 @@
+package pluginmanager
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/* Decode the results of a method call into targets (pointers to the result types), a nil target
+   skips its result. The generic values decoded by the codecs are converted as by encoding/json */
+func DecodeResults(results []interface{}, targets ...interface{}) error {
+	if len(results) != len(targets) {
+		return fmt.Errorf("The method returned %d results, %d expected", len(results), len(targets))
+	}
+	for i, target := range targets {
+		if target == nil {
+			continue
+		}
+		data, err := json.Marshal(results[i])
+		if err != nil {
+			return fmt.Errorf("Failed to decode result %d: %v", i+1, err)
+		}
+		err = json.Unmarshal(data, target)
+		if err != nil {
+			return fmt.Errorf("Failed to decode result %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
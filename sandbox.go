@@ -0,0 +1,64 @@
+/* Sandbox runs the untrusted plugin processes in separate linux namespaces
+ * with a read-only view of the plugin folder and a seccomp allowlist.
+ * The namespaces are created at fork, the mounts and the seccomp filter are
+ * applied by the init stage (the host binary re-executed) before the
+ * plugin binary is executed. The sandbox is supported on linux only
+ */
+
+package pluginmanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// An error to indicate the kernel doesn't permit the requested namespaces
+	SandboxUnsupported = errors.New("Sandbox namespaces are not permitted by the kernel")
+
+	// Default dir in the plugin location that holds the private writable data dir of each plugin
+	DefaultSandboxDataDir = "plugindata"
+	// The mount point of the private data dir inside the plugin folder
+	SandboxDataMount = "data"
+)
+
+/* The sandbox configuration for plugin processes */
+type SandboxConf struct {
+	// The uid and gid the plugin runs with (0 keeps the host uid/gid)
+	Uid uint32
+	Gid uint32
+	// The namespaces to create for the plugin process
+	NewUserNs  bool
+	NewMountNs bool
+	NewNetNs   bool
+	NewPidNs   bool
+	// The location of the private data dirs. Default is PluginLocation/DefaultSandboxDataDir
+	DataLocation string
+	// Enable the seccomp filter with DefaultSeccompAllowlist
+	Seccomp bool
+	// The syscalls allowed in addition to DefaultSeccompAllowlist
+	SeccompAllowlist []string
+}
+
+// Internal: create the private data dir of a plugin and its mount point in the plugin folder
+func (pluginReg *PluginReg) prepareSandboxData(plugin *Plugin) (string, error) {
+	dataLocation := pluginReg.sandbox.DataLocation
+	if dataLocation == "" {
+		dataLocation = filepath.Join(pluginReg.PluginLocation, DefaultSandboxDataDir)
+	}
+	dataDir, _ := filepath.Abs(filepath.Join(dataLocation, plugin.key))
+	err := os.MkdirAll(dataDir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create sandbox data dir %s: %v", dataDir, err)
+	}
+	err = os.MkdirAll(filepath.Join(plugin.pluginloc, SandboxDataMount), 0755)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create sandbox data mount point: %v", err)
+	}
+	if pluginReg.sandbox.Uid != 0 || pluginReg.sandbox.Gid != 0 {
+		os.Chown(dataDir, int(pluginReg.sandbox.Uid), int(pluginReg.sandbox.Gid))
+	}
+	return dataDir, nil
+}
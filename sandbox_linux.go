@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package pluginmanager
+
+import (
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Internal: set the namespaces to start a plugin in and the sandbox steps of the init stage
+func (pluginReg *PluginReg) prepareSandbox(plugin *Plugin, spec *initSpec, sys *syscall.SysProcAttr) error {
+	conf := pluginReg.sandbox
+
+	spec.PluginLoc, _ = filepath.Abs(plugin.pluginloc)
+	spec.DataDir = plugin.dataDir
+	spec.Mount = conf.NewMountNs
+	spec.MountProc = conf.NewMountNs && conf.NewPidNs
+	if conf.Seccomp {
+		spec.Seccomp = append(append([]string{}, DefaultSeccompAllowlist...), conf.SeccompAllowlist...)
+	}
+	if conf.Uid != 0 || conf.Gid != 0 {
+		spec.SetId = true
+		spec.Uid = conf.Uid
+		spec.Gid = conf.Gid
+	}
+
+	if conf.NewUserNs {
+		sys.Cloneflags |= syscall.CLONE_NEWUSER
+		hostUid := os.Getuid()
+		hostGid := os.Getgid()
+		// init stage runs as root in the namespace to be able to mount
+		sys.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: hostUid, Size: 1}}
+		sys.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: hostGid, Size: 1}}
+		if spec.SetId {
+			if hostUid != 0 {
+				return fmt.Errorf("Sandbox uid/gid in a user namespace requires the host to run as root")
+			}
+			sys.UidMappings = append(sys.UidMappings, syscall.SysProcIDMap{ContainerID: int(conf.Uid), HostID: int(conf.Uid), Size: 1})
+			sys.GidMappings = append(sys.GidMappings, syscall.SysProcIDMap{ContainerID: int(conf.Gid), HostID: int(conf.Gid), Size: 1})
+			// init stage sets the supplementary groups to the sandbox gid before it switches to it
+			sys.GidMappingsEnableSetgroups = true
+		}
+	} else if os.Getuid() != 0 && (conf.NewMountNs || conf.NewNetNs || conf.NewPidNs || spec.SetId) {
+		return fmt.Errorf("Sandbox without a user namespace requires the host to run as root")
+	}
+	if conf.NewMountNs {
+		sys.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if conf.NewNetNs {
+		sys.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if conf.NewPidNs {
+		sys.Cloneflags |= syscall.CLONE_NEWPID
+	}
+
+	return nil
+}
+
+// Internal: translate a fork error of a sandboxed process to a clear error
+func sandboxStartError(conf *SandboxConf, err error) error {
+	if err != syscall.EPERM && err != syscall.EINVAL && err != syscall.ENOSPC && err != syscall.EUSERS {
+		return err
+	}
+	if conf.NewUserNs && !unprivilegedUserNsAllowed() {
+		log.ERROR.Printf("Unprivileged user namespaces are disabled (kernel.unprivileged_userns_clone or user.max_user_namespaces)")
+	}
+	return SandboxUnsupported
+}
+
+// Internal: check the sysctls that disallow unprivileged user namespaces
+func unprivilegedUserNsAllowed() bool {
+	for _, sysctl := range []string{"/proc/sys/kernel/unprivileged_userns_clone", "/proc/sys/user/max_user_namespaces"} {
+		value, err := ioutil.ReadFile(sysctl)
+		if err == nil && strings.TrimSpace(string(value)) == "0" {
+			return false
+		}
+	}
+	return true
+}
+
+// Internal: mount the read-only plugin folder, the private data dir and the /proc of the pid namespace
+func sandboxMount(spec *initSpec) error {
+	// Don't propagate the sandbox mounts to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("Failed to make mounts private: %v", err)
+	}
+
+	// Bind the plugin folder on itself to remount it read only
+	err = syscall.Mount(spec.PluginLoc, spec.PluginLoc, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("Failed to bind plugin folder: %v", err)
+	}
+	if spec.DataDir != "" {
+		dataMount := filepath.Join(spec.PluginLoc, SandboxDataMount)
+		err = syscall.Mount(spec.DataDir, dataMount, "", syscall.MS_BIND, "")
+		if err != nil {
+			return fmt.Errorf("Failed to bind data dir: %v", err)
+		}
+	}
+	err = syscall.Mount("", spec.PluginLoc, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, "")
+	if err != nil {
+		return fmt.Errorf("Failed to remount plugin folder read only: %v", err)
+	}
+
+	if spec.MountProc {
+		err = syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+		if err != nil {
+			return fmt.Errorf("Failed to mount /proc: %v", err)
+		}
+	}
+	return nil
+}
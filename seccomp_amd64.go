@@ -0,0 +1,147 @@
+//go:build linux && amd64
+// +build linux,amd64
+
+/* Seccomp allowlist filter for the sandboxed plugin processes (x86_64)
+ */
+
+package pluginmanager
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	auditArchX86_64 = 0xc000003e
+
+	prSetNoNewPrivs       = 38
+	sysSeccomp            = 317
+	seccompSetModeFilter  = 1
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	bpfLdWAbs  = 0x20
+	bpfJeqK    = 0x15
+	bpfRetK    = 0x06
+	seccompArc = 4
+	seccompNr  = 0
+)
+
+var (
+	// The syscalls allowed by default, enough for a Go plugin serving over a unix socket
+	DefaultSeccompAllowlist = []string{
+		"read", "write", "close", "stat", "fstat", "lstat", "newfstatat", "statx", "lseek",
+		"mmap", "mprotect", "munmap", "brk", "mremap", "madvise",
+		"rt_sigaction", "rt_sigprocmask", "rt_sigreturn", "sigaltstack",
+		"ioctl", "pread64", "pwrite64", "readv", "writev", "access", "faccessat", "faccessat2",
+		"pipe", "pipe2", "select", "pselect6", "poll", "ppoll", "sched_yield", "sched_getaffinity",
+		"dup", "dup2", "dup3", "nanosleep", "clock_nanosleep", "clock_gettime", "gettimeofday",
+		"getpid", "getppid", "gettid", "getuid", "getgid", "geteuid", "getegid",
+		"socket", "connect", "accept", "accept4", "bind", "listen", "shutdown",
+		"sendto", "recvfrom", "sendmsg", "recvmsg", "getsockname", "getpeername",
+		"setsockopt", "getsockopt", "socketpair",
+		"clone", "clone3", "execve", "exit", "exit_group", "wait4", "kill", "tgkill",
+		"uname", "fcntl", "flock", "fsync", "fdatasync", "truncate", "ftruncate",
+		"getdents64", "getcwd", "chdir", "fchdir", "rename", "renameat", "mkdir", "mkdirat",
+		"rmdir", "unlink", "unlinkat", "readlink", "readlinkat", "chmod", "fchmod",
+		"open", "openat", "getrlimit", "prlimit64", "arch_prctl", "futex",
+		"set_tid_address", "set_robust_list", "rseq", "restart_syscall", "getrandom",
+		"epoll_create", "epoll_create1", "epoll_ctl", "epoll_wait", "epoll_pwait", "eventfd2",
+	}
+
+	// The x86_64 syscall numbers by name
+	seccompSyscalls = map[string]uint32{
+		"read": syscall.SYS_READ, "write": syscall.SYS_WRITE, "close": syscall.SYS_CLOSE,
+		"stat": syscall.SYS_STAT, "fstat": syscall.SYS_FSTAT, "lstat": syscall.SYS_LSTAT,
+		"newfstatat": syscall.SYS_NEWFSTATAT, "statx": 332, "lseek": syscall.SYS_LSEEK,
+		"mmap": syscall.SYS_MMAP, "mprotect": syscall.SYS_MPROTECT, "munmap": syscall.SYS_MUNMAP,
+		"brk": syscall.SYS_BRK, "mremap": syscall.SYS_MREMAP, "madvise": syscall.SYS_MADVISE,
+		"rt_sigaction": syscall.SYS_RT_SIGACTION, "rt_sigprocmask": syscall.SYS_RT_SIGPROCMASK,
+		"rt_sigreturn": syscall.SYS_RT_SIGRETURN, "sigaltstack": syscall.SYS_SIGALTSTACK,
+		"ioctl": syscall.SYS_IOCTL, "pread64": syscall.SYS_PREAD64, "pwrite64": syscall.SYS_PWRITE64,
+		"readv": syscall.SYS_READV, "writev": syscall.SYS_WRITEV, "access": syscall.SYS_ACCESS,
+		"faccessat": syscall.SYS_FACCESSAT, "faccessat2": 439,
+		"pipe": syscall.SYS_PIPE, "pipe2": syscall.SYS_PIPE2, "select": syscall.SYS_SELECT,
+		"pselect6": syscall.SYS_PSELECT6, "poll": syscall.SYS_POLL, "ppoll": syscall.SYS_PPOLL,
+		"sched_yield": syscall.SYS_SCHED_YIELD, "sched_getaffinity": syscall.SYS_SCHED_GETAFFINITY,
+		"dup": syscall.SYS_DUP, "dup2": syscall.SYS_DUP2, "dup3": syscall.SYS_DUP3,
+		"nanosleep": syscall.SYS_NANOSLEEP, "clock_nanosleep": syscall.SYS_CLOCK_NANOSLEEP,
+		"clock_gettime": syscall.SYS_CLOCK_GETTIME, "gettimeofday": syscall.SYS_GETTIMEOFDAY,
+		"getpid": syscall.SYS_GETPID, "getppid": syscall.SYS_GETPPID, "gettid": syscall.SYS_GETTID,
+		"getuid": syscall.SYS_GETUID, "getgid": syscall.SYS_GETGID, "geteuid": syscall.SYS_GETEUID,
+		"getegid": syscall.SYS_GETEGID,
+		"socket":  syscall.SYS_SOCKET, "connect": syscall.SYS_CONNECT, "accept": syscall.SYS_ACCEPT,
+		"accept4": syscall.SYS_ACCEPT4, "bind": syscall.SYS_BIND, "listen": syscall.SYS_LISTEN,
+		"shutdown": syscall.SYS_SHUTDOWN, "sendto": syscall.SYS_SENDTO, "recvfrom": syscall.SYS_RECVFROM,
+		"sendmsg": syscall.SYS_SENDMSG, "recvmsg": syscall.SYS_RECVMSG,
+		"getsockname": syscall.SYS_GETSOCKNAME, "getpeername": syscall.SYS_GETPEERNAME,
+		"setsockopt": syscall.SYS_SETSOCKOPT, "getsockopt": syscall.SYS_GETSOCKOPT,
+		"socketpair": syscall.SYS_SOCKETPAIR,
+		"clone":      syscall.SYS_CLONE, "clone3": 435, "execve": syscall.SYS_EXECVE,
+		"exit": syscall.SYS_EXIT, "exit_group": syscall.SYS_EXIT_GROUP, "wait4": syscall.SYS_WAIT4,
+		"kill": syscall.SYS_KILL, "tgkill": syscall.SYS_TGKILL,
+		"uname": syscall.SYS_UNAME, "fcntl": syscall.SYS_FCNTL, "flock": syscall.SYS_FLOCK,
+		"fsync": syscall.SYS_FSYNC, "fdatasync": syscall.SYS_FDATASYNC,
+		"truncate": syscall.SYS_TRUNCATE, "ftruncate": syscall.SYS_FTRUNCATE,
+		"getdents64": syscall.SYS_GETDENTS64, "getcwd": syscall.SYS_GETCWD,
+		"chdir": syscall.SYS_CHDIR, "fchdir": syscall.SYS_FCHDIR,
+		"rename": syscall.SYS_RENAME, "renameat": syscall.SYS_RENAMEAT,
+		"mkdir": syscall.SYS_MKDIR, "mkdirat": syscall.SYS_MKDIRAT, "rmdir": syscall.SYS_RMDIR,
+		"unlink": syscall.SYS_UNLINK, "unlinkat": syscall.SYS_UNLINKAT,
+		"readlink": syscall.SYS_READLINK, "readlinkat": syscall.SYS_READLINKAT,
+		"chmod": syscall.SYS_CHMOD, "fchmod": syscall.SYS_FCHMOD,
+		"open": syscall.SYS_OPEN, "openat": syscall.SYS_OPENAT,
+		"getrlimit": syscall.SYS_GETRLIMIT, "prlimit64": syscall.SYS_PRLIMIT64,
+		"arch_prctl": syscall.SYS_ARCH_PRCTL, "futex": syscall.SYS_FUTEX,
+		"set_tid_address": syscall.SYS_SET_TID_ADDRESS, "set_robust_list": syscall.SYS_SET_ROBUST_LIST,
+		"rseq": 334, "restart_syscall": syscall.SYS_RESTART_SYSCALL, "getrandom": 318,
+		"epoll_create": syscall.SYS_EPOLL_CREATE, "epoll_create1": syscall.SYS_EPOLL_CREATE1,
+		"epoll_ctl": syscall.SYS_EPOLL_CTL, "epoll_wait": syscall.SYS_EPOLL_WAIT,
+		"epoll_pwait": syscall.SYS_EPOLL_PWAIT, "eventfd2": syscall.SYS_EVENTFD2,
+	}
+)
+
+type sockFilter struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+type sockFprog struct {
+	Len    uint16
+	Filter *sockFilter
+}
+
+// Internal: install a seccomp filter allowing only the listed syscalls, other syscalls fail with EPERM
+func installSeccomp(allowlist []string) error {
+	program := []sockFilter{
+		// Kill the process if it is not a x86_64 syscall
+		{Code: bpfLdWAbs, K: seccompArc},
+		{Code: bpfJeqK, Jt: 1, Jf: 0, K: auditArchX86_64},
+		{Code: bpfRetK, K: seccompRetKillProcess},
+		{Code: bpfLdWAbs, K: seccompNr},
+	}
+	for _, name := range allowlist {
+		nr, ok := seccompSyscalls[name]
+		if !ok {
+			return fmt.Errorf("Unknown syscall in seccomp allowlist: %s", name)
+		}
+		program = append(program, sockFilter{Code: bpfJeqK, Jt: 0, Jf: 1, K: nr})
+		program = append(program, sockFilter{Code: bpfRetK, K: seccompRetAllow})
+	}
+	program = append(program, sockFilter{Code: bpfRetK, K: seccompRetErrno | uint32(syscall.EPERM)})
+
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("Failed to set no new privs: %v", errno)
+	}
+	fprog := sockFprog{Len: uint16(len(program)), Filter: &program[0]}
+	_, _, errno = syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, 0, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("Failed to install seccomp filter: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux || !amd64
+// +build !linux !amd64
+
+package pluginmanager
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var (
+	// The syscalls allowed by default (seccomp is supported only on linux amd64)
+	DefaultSeccompAllowlist = []string{}
+)
+
+// Internal: seccomp filter is not supported on this platform
+func installSeccomp(allowlist []string) error {
+	return fmt.Errorf("Seccomp filter is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,190 @@
+/* Registry shutdown stops the discovery and unloads every loaded plugin in
+ * reverse dependency order. In-flight calls are drained before a plugin is
+ * unloaded and the plugin processes still running at the context deadline
+ * are killed
+ */
+
+package pluginmanager
+
+import (
+	"context"
+	log "github.com/spf13/jwalterweatherman"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/* Stop the Plugin Registry service. It stops the discovery service and unloads all the plugins,
+   a plugin is unloaded before the plugins it depends on. Each plugin gets its in-flight calls
+   drained and its process is killed if it is still running when ctx is done */
+func (pluginReg *PluginReg) Stop(ctx context.Context) error {
+	first := false
+	pluginReg.stopOnce.Do(func() {
+		first = true
+		close(pluginReg.stopchan)
+	})
+	if !first {
+		// Already stopping, wait for it to complete
+		select {
+		case <-pluginReg.stopped:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer close(pluginReg.stopped)
+
+	log.INFO.Printf("Stopping plugin registry for : %s", pluginReg.PluginLocation)
+	for _, level := range pluginReg.unloadOrder() {
+		var wg sync.WaitGroup
+		for _, plugin := range level {
+			wg.Add(1)
+			go func(plugin *Plugin) {
+				defer wg.Done()
+				pluginReg.stopPlugin(ctx, plugin)
+			}(plugin)
+		}
+		wg.Wait()
+	}
+	log.INFO.Printf("Plugin registry stopped for : %s", pluginReg.PluginLocation)
+	return ctx.Err()
+}
+
+/* Wait till the Plugin Registry service is stopped. If Stop is called it returns once all the
+   plugins are unloaded */
+func (pluginReg *PluginReg) WaitForStop() {
+	pluginReg.Wg.Wait()
+
+	select {
+	case <-pluginReg.stopchan:
+		<-pluginReg.stopped
+	default:
+	}
+}
+
+// Internal: check if the registry is stopped or being stopped
+func (pluginReg *PluginReg) isStopped() bool {
+	if pluginReg == nil || pluginReg.stopchan == nil {
+		return false
+	}
+	select {
+	case <-pluginReg.stopchan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Internal: get the loaded plugins grouped in levels, a plugin is in a level before the plugins it depends on
+func (pluginReg *PluginReg) unloadOrder() [][]*Plugin {
+	pluginReg.regAccess.Lock()
+	remaining := make(map[string]*Plugin, len(pluginReg.plugins))
+	for key, plugin := range pluginReg.plugins {
+		remaining[key] = plugin
+	}
+	pluginReg.regAccess.Unlock()
+
+	depends := make(map[string][]string, len(remaining))
+	for key, plugin := range remaining {
+		depends[key], _ = pluginDepends(plugin.pluginloc)
+	}
+
+	levels := [][]*Plugin{}
+	for len(remaining) > 0 {
+		// The plugins no remaining plugin depends on
+		required := make(map[string]bool)
+		for key := range remaining {
+			for _, depend := range depends[key] {
+				required[depend] = true
+			}
+		}
+		level := []*Plugin{}
+		for key, plugin := range remaining {
+			if !required[key] {
+				level = append(level, plugin)
+			}
+		}
+		if len(level) == 0 {
+			// Dependency cycle, unload the rest together
+			for _, plugin := range remaining {
+				level = append(level, plugin)
+			}
+		}
+		for _, plugin := range level {
+			delete(remaining, plugin.key)
+		}
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// Internal: drain and unload a plugin, its processes are killed if ctx is done first
+func (pluginReg *PluginReg) stopPlugin(ctx context.Context, plugin *Plugin) {
+	instances := []*Plugin{plugin}
+	if pool := plugin.getPool(); pool != nil {
+		instances = pool.allInstances()
+	}
+
+	// Drain the in-flight calls
+	draining := true
+	for draining && outstandingCalls(instances) > 0 {
+		select {
+		case <-ctx.Done():
+			log.ERROR.Printf("Plugin %s has %d calls in-flight at shutdown", plugin.key, outstandingCalls(instances))
+			draining = false
+		case <-time.After(DefaultInterval / 5):
+		}
+	}
+
+	// The processes are referenced before the unload, their pids could be reused once they exit
+	processes := make([]processRef, 0, len(instances))
+	if plugin.IsRunning() {
+		for _, instance := range instances {
+			if pid := instance.processId(); pid > 0 {
+				processes = append(processes, newProcessRef(pid))
+			}
+		}
+	}
+
+	unloaded := make(chan int)
+	go func() {
+		plugin.UnloadPlugin()
+		close(unloaded)
+	}()
+
+	// Wait for the unload and the processes to exit
+	select {
+	case <-unloaded:
+	case <-ctx.Done():
+	}
+	for _, process := range processes {
+		for process.alive() {
+			select {
+			case <-ctx.Done():
+				killProcesses(plugin.key, processes)
+				return
+			case <-time.After(DefaultInterval / 5):
+			}
+		}
+	}
+}
+
+// Internal: kill the plugin processes still running
+func killProcesses(key string, processes []processRef) {
+	for _, process := range processes {
+		if process.alive() {
+			log.ERROR.Printf("Killing plugin %s process %d at shutdown", key, process.pid)
+			process.signal(syscall.SIGKILL)
+		}
+	}
+}
+
+// Internal: get the in-flight calls of the plugin instances
+func outstandingCalls(instances []*Plugin) int64 {
+	var outstanding int64 = 0
+	for _, instance := range instances {
+		outstanding += atomic.LoadInt64(&instance.outstanding)
+	}
+	return outstanding
+}
@@ -0,0 +1,236 @@
+/* Process stats of the plugin instances sampled from /proc and exposed as
+ * per plugin snapshot/history and as registry metrics
+ */
+
+package pluginmanager
+
+import (
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Default interval to sample the plugin process stats
+	DefaultStatsInterval = 10 * time.Second
+	// Default number of samples kept per plugin instance
+	DefaultStatsHistory = 60
+
+	// The kernel clock ticks per second (USER_HZ)
+	clockTicks = 100
+)
+
+/* The process stats of a plugin instance */
+type ProcessStats struct {
+	// The time of the sample
+	Time time.Time
+	// The Plugin instance PId
+	Pid int
+	// The user + system CPU time consumed
+	CpuTime time.Duration
+	// The CPU usage (in percent of one CPU) since the previous sample
+	CpuPercent float64
+	// The resident memory in bytes
+	Rss uint64
+	// The number of open file descriptors
+	OpenFds int
+	// The number of threads
+	Threads int
+	// The time since the process has started
+	Uptime time.Duration
+	// The method panics recovered by the plugin, counted by the host
+	Panics int64
+}
+
+/* Get the latest process stats of the plugin. If no sample is taken yet the process is sampled now */
+func (plugin *Plugin) Stats() (ProcessStats, error) {
+	plugin.statsAccess.Lock()
+	defer plugin.statsAccess.Unlock()
+
+	if len(plugin.statsHistory) > 0 {
+		stats := plugin.statsHistory[len(plugin.statsHistory)-1]
+		stats.Panics = atomic.LoadInt64(&plugin.panics)
+		return stats, nil
+	}
+	stats, err := readProcessStats(plugin.processId())
+	stats.Panics = atomic.LoadInt64(&plugin.panics)
+	return stats, err
+}
+
+/* Get the sampled process stats history of the plugin, oldest first */
+func (plugin *Plugin) StatsHistory() []ProcessStats {
+	plugin.statsAccess.Lock()
+	defer plugin.statsAccess.Unlock()
+
+	return append([]ProcessStats{}, plugin.statsHistory...)
+}
+
+// Internal: sample the stats of a plugin instance and add it to the history
+func (plugin *Plugin) sampleStats(historySize int) error {
+	stats, err := readProcessStats(plugin.processId())
+	if err != nil {
+		return err
+	}
+	stats.Panics = atomic.LoadInt64(&plugin.panics)
+
+	plugin.statsAccess.Lock()
+	defer plugin.statsAccess.Unlock()
+
+	if len(plugin.statsHistory) > 0 {
+		previous := plugin.statsHistory[len(plugin.statsHistory)-1]
+		elapsed := stats.Time.Sub(previous.Time)
+		if previous.Pid == stats.Pid && elapsed > 0 {
+			stats.CpuPercent = float64(stats.CpuTime-previous.CpuTime) / float64(elapsed) * 100
+		}
+	}
+	plugin.statsHistory = append(plugin.statsHistory, stats)
+	if len(plugin.statsHistory) > historySize {
+		plugin.statsHistory = plugin.statsHistory[len(plugin.statsHistory)-historySize:]
+	}
+	return nil
+}
+
+// Internal: read the stats of a process from /proc
+func readProcessStats(pid int) (ProcessStats, error) {
+	stats := ProcessStats{Time: time.Now(), Pid: pid}
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return stats, fmt.Errorf("Failed to read stats of process %d: %v", pid, err)
+	}
+	// The fields after the command name (which could contain spaces), starting from the state (field 3)
+	content := string(data)
+	fields := strings.Fields(content[strings.LastIndex(content, ")")+1:])
+	if len(fields) < 22 {
+		return stats, fmt.Errorf("Unexpected stat format of process %d", pid)
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	threads, _ := strconv.Atoi(fields[17])
+	starttime, _ := strconv.ParseUint(fields[19], 10, 64)
+	rss, _ := strconv.ParseUint(fields[21], 10, 64)
+
+	stats.CpuTime = time.Duration(utime+stime) * time.Second / time.Duration(clockTicks)
+	stats.Threads = threads
+	stats.Rss = rss * uint64(os.Getpagesize())
+
+	uptimeData, uptimeErr := ioutil.ReadFile("/proc/uptime")
+	if uptimeErr == nil {
+		systemUptime, _ := strconv.ParseFloat(strings.Fields(string(uptimeData))[0], 64)
+		processStart := float64(starttime) / float64(clockTicks)
+		stats.Uptime = time.Duration((systemUptime - processStart) * float64(time.Second))
+	}
+
+	fds, fdErr := ioutil.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if fdErr == nil {
+		stats.OpenFds = len(fds)
+	}
+
+	return stats, nil
+}
+
+// Internal: get all the running plugin instances (including the pool instances)
+func (pluginReg *PluginReg) allInstances() []*Plugin {
+	pluginReg.regAccess.Lock()
+	plugins := make([]*Plugin, 0, len(pluginReg.plugins))
+	for _, plugin := range pluginReg.plugins {
+		plugins = append(plugins, plugin)
+	}
+	pluginReg.regAccess.Unlock()
+
+	instances := make([]*Plugin, 0, len(plugins))
+	for _, plugin := range plugins {
+		if plugin.agent != nil {
+			// The agent samples its plugins
+			continue
+		}
+		pool := plugin.getPool()
+		if pool == nil {
+			instances = append(instances, plugin)
+			continue
+		}
+		instances = append(instances, pool.allInstances()...)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].instanceKey() < instances[j].instanceKey() })
+	return instances
+}
+
+// Internal: the routine sampling the stats of all the plugin instances
+func (pluginReg *PluginReg) statsService() {
+	ticker := time.NewTicker(pluginReg.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-pluginReg.stopchan:
+			return
+		}
+		for _, instance := range pluginReg.allInstances() {
+			err := instance.sampleStats(pluginReg.statsHistory)
+			if err != nil {
+				log.DEBUG.Printf("Failed to sample plugin %s stats: %v", instance.instanceKey(), err)
+			}
+		}
+	}
+}
+
+/* Write the metrics of all the plugin instances in the Prometheus text format */
+func (pluginReg *PluginReg) WriteMetrics(writer io.Writer) error {
+	instances := pluginReg.allInstances()
+
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(ProcessStats) float64
+	}{
+		{"goplug_plugin_cpu_seconds_total", "counter", "Total user and system CPU time of the plugin process",
+			func(stats ProcessStats) float64 { return stats.CpuTime.Seconds() }},
+		{"goplug_plugin_cpu_percent", "gauge", "CPU usage of the plugin process since the previous sample",
+			func(stats ProcessStats) float64 { return stats.CpuPercent }},
+		{"goplug_plugin_resident_memory_bytes", "gauge", "Resident memory of the plugin process",
+			func(stats ProcessStats) float64 { return float64(stats.Rss) }},
+		{"goplug_plugin_open_fds", "gauge", "Open file descriptors of the plugin process",
+			func(stats ProcessStats) float64 { return float64(stats.OpenFds) }},
+		{"goplug_plugin_threads", "gauge", "Threads of the plugin process",
+			func(stats ProcessStats) float64 { return float64(stats.Threads) }},
+		{"goplug_plugin_uptime_seconds", "gauge", "Time since the plugin process has started",
+			func(stats ProcessStats) float64 { return stats.Uptime.Seconds() }},
+		{"goplug_plugin_panics_total", "counter", "Method panics recovered by the plugin",
+			func(stats ProcessStats) float64 { return float64(stats.Panics) }},
+	}
+
+	samples := make([]ProcessStats, len(instances))
+	sampled := make([]bool, len(instances))
+	for i, instance := range instances {
+		var err error
+		samples[i], err = instance.Stats()
+		sampled[i] = err == nil
+	}
+
+	for _, metric := range metrics {
+		_, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		if err != nil {
+			return err
+		}
+		for i, instance := range instances {
+			if !sampled[i] {
+				continue
+			}
+			_, err = fmt.Fprintf(writer, "%s{plugin=%q,instance=\"%d\"} %g\n",
+				metric.name, instance.key, instance.instance, metric.value(samples[i]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+/* Streamed method results: a plugin method could send its results as a
+ * sequence of items that the host receives as they arrive
+ */
+
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	common "github.com/swarvanusg/GoPlug/common"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+/* An item of a streamed method result */
+type StreamItem struct {
+	// The json encoded item
+	Data json.RawMessage
+	// The error sent by the plugin or the stream failure. It is the last item of the stream
+	Err error
+}
+
+/* Decode the item in v */
+func (item StreamItem) Decode(v interface{}) error {
+	return json.Unmarshal(item.Data, v)
+}
+
+/* Executes a streaming plugin method. The items are sent on the returned channel as they arrive
+   and the channel is closed at the end of the stream. The plugin is blocked while the items are not
+   received (backpressure). Cancelling ctx aborts the stream and cancels the plugin method context */
+func (plugin *Plugin) ExecuteStream(ctx context.Context, funcName string, args ...interface{}) (<-chan StreamItem, error) {
+	if plugin.registry.isStopped() {
+		return nil, RegistryStopped
+	}
+	release := func() {}
+	if plugin.onDemand != nil {
+		startErr := plugin.onDemand.acquire(plugin)
+		if startErr != nil {
+			return nil, startErr
+		}
+		release = plugin.onDemand.release
+	}
+	validateErr := plugin.validateArgs(funcName, args)
+	if validateErr != nil {
+		release()
+		return nil, validateErr
+	}
+
+	instance := plugin
+	if pool := plugin.getPool(); pool != nil {
+		instance = pool.pick()
+	} else {
+		atomic.AddInt64(&plugin.outstanding, 1)
+	}
+	items, err := instance.executeStream(ctx, funcName, args, release)
+	if err != nil {
+		atomic.AddInt64(&instance.outstanding, -1)
+		release()
+		return nil, err
+	}
+	return items, nil
+}
+
+// Internal: execute a streaming method on the plugin instance, release is called and the outstanding call
+// accounted by the caller ends at the end of the stream
+func (plugin *Plugin) executeStream(ctx context.Context, funcName string, args []interface{}, release func()) (<-chan StreamItem, error) {
+
+	if !plugin.isConnected() {
+		return nil, plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorPluginCrashed, "Plugin is not connected"))
+	}
+
+	// check if method is registered
+	if !plugin.hasMethod(funcName) {
+		return nil, plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorMethodNotFound, "Method of name : %s is not registered", funcName))
+	}
+
+	pluginConn, pluginUrl := plugin.connection()
+	requestUrl := pluginUrl + "/" + funcName
+	request, encodeErr := plugin.newRequest(requestUrl, args)
+	if encodeErr != nil {
+		return nil, plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorInternal, "Failed to encode the arguments: %v", encodeErr))
+	}
+
+	stream, err := pluginConn.Stream(ctx, request)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ExecuteTimeout
+		}
+		return nil, plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorPluginCrashed, "Failed to communicate with plugin: %v", err))
+	}
+	if stream.Status != "200 OK" {
+		body, _ := ioutil.ReadAll(stream.Body)
+		stream.Close()
+		return nil, plugin.responseError(funcName, stream.Status, stream.Header, body)
+	}
+
+	items := make(chan StreamItem)
+	go func() {
+		defer release()
+		defer atomic.AddInt64(&plugin.outstanding, -1)
+		defer close(items)
+		defer stream.Close()
+
+		for {
+			frame, frameErr := stream.Next()
+			if ctx.Err() != nil {
+				// The caller gave up
+				return
+			}
+			var item StreamItem
+			switch {
+			case frameErr != nil:
+				item.Err = plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorPluginCrashed, "Stream interrupted: %v", frameErr))
+			case frame.End:
+				return
+			case frame.Fault != nil:
+				item.Err = plugin.callError(funcName, frame.Fault)
+			case frame.Error != "":
+				item.Err = plugin.callError(funcName, common.NewErrorEnvelope(common.ErrorPlugin, "%s", frame.Error))
+			default:
+				item.Data = frame.Item
+			}
+
+			select {
+			case items <- item:
+			case <-ctx.Done():
+				return
+			}
+			if item.Err != nil {
+				return
+			}
+		}
+	}()
+
+	return items, nil
+}
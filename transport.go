@@ -0,0 +1,152 @@
+/* A plugin could be served on tcp so that it runs in a separate container or VM.
+ * The connections use mutual TLS, the certificates are either supplied with the
+ * plugin and the registry conf or generated by the registry per plugin
+ */
+
+package pluginmanager
+
+import (
+	"crypto/tls"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	common "github.com/swarvanusg/GoPlug/common"
+	PluginConn "github.com/swarvanusg/GoPlug/common/pluginconn"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// The generated certificates are renewed when they expire within this time
+	CertRenewBefore = 24 * time.Hour
+
+	// Guard the certificate generation of the plugins loaded concurrently
+	certAccess sync.Mutex
+)
+
+// Internal: connect to a plugin instance over its transport
+func (plugin *Plugin) newClient() (*PluginConn.PluginClient, error) {
+	if plugin.network == common.TransportTcp {
+		return PluginConn.NewTcpPluginClient(plugin.PluginSock, plugin.tlsConfig, plugin.authSecret())
+	}
+	return PluginConn.NewAuthPluginClient(plugin.PluginSock, plugin.authSecret())
+}
+
+// Internal: configure the tcp transport of a plugin instance. It returns the address the host connects to
+func (pluginReg *PluginReg) prepareTcp(plugin *Plugin, transport *common.TransportConf, pluginConf *common.RuntimeConf) (string, error) {
+	listen, err := listenAddr(transport.Listen, plugin.instance)
+	if err != nil {
+		return "", err
+	}
+	addr := transport.Addr
+	if addr == "" {
+		addr = listen
+	} else if plugin.instance > 0 {
+		return "", fmt.Errorf("A pool of tcp plugin instances can't share the address %s", addr)
+	}
+
+	if transport.Tls != nil {
+		// The plugin certificates are supplied with the plugin, the host ones with the registry conf
+		if pluginReg.tls == nil {
+			return "", fmt.Errorf("The registry Tls conf is required for a plugin with its own certificates")
+		}
+		pluginConf.Tls = transport.Tls
+		plugin.hostTls = pluginReg.tls
+	} else {
+		certDir := filepath.Join(plugin.pluginloc, PluginRunDir)
+		mountDir := PluginRunDir
+		if plugin.dataDir != "" {
+			certDir = plugin.dataDir
+			mountDir = SandboxDataMount
+		}
+		genErr := pluginReg.generateCerts(certDir, listen, addr)
+		if genErr != nil {
+			return "", genErr
+		}
+		pluginConf.Tls = &common.TlsConf{
+			CA:   filepath.Join(mountDir, PluginConn.CACertFile),
+			Cert: filepath.Join(mountDir, PluginConn.PluginCertFile),
+			Key:  filepath.Join(mountDir, PluginConn.PluginKeyFile),
+		}
+		certDir, _ = filepath.Abs(certDir)
+		plugin.hostTls = &common.TlsConf{
+			CA:   filepath.Join(certDir, PluginConn.CACertFile),
+			Cert: filepath.Join(certDir, PluginConn.HostCertFile),
+			Key:  filepath.Join(certDir, PluginConn.HostKeyFile),
+		}
+	}
+
+	tlsConfig, err := hostTlsConfig(plugin.hostTls)
+	if err != nil {
+		return "", err
+	}
+	pluginConf.Network = common.TransportTcp
+	pluginConf.Sock = listen
+	// The file descriptors can't be passed over tcp
+	pluginConf.FdSock = ""
+	plugin.network = common.TransportTcp
+	plugin.tlsConfig = tlsConfig
+	return addr, nil
+}
+
+// Internal: get the client TLS config of the host
+func hostTlsConfig(conf *common.TlsConf) (*tls.Config, error) {
+	return PluginConn.ClientTlsConfig(conf.CA, conf.Cert, conf.Key, conf.ServerName)
+}
+
+// Internal: generate the certificates of a plugin if they are missing or about to expire
+func (pluginReg *PluginReg) generateCerts(certDir string, addrs ...string) error {
+	certAccess.Lock()
+	defer certAccess.Unlock()
+
+	if PluginConn.CertsValid(certDir, CertRenewBefore) {
+		return nil
+	}
+	hosts := make([]string, 0)
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil && host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	log.INFO.Printf("Generating the plugin certificates in %s", certDir)
+	err := PluginConn.GenerateCerts(certDir, hosts...)
+	if err != nil {
+		return fmt.Errorf("Failed to generate the plugin certificates: %v", err)
+	}
+	// The sandboxed plugin reads its certificate as the sandbox user
+	if pluginReg.sandbox != nil && (pluginReg.sandbox.Uid != 0 || pluginReg.sandbox.Gid != 0) {
+		for _, file := range []string{PluginConn.CACertFile, PluginConn.PluginCertFile, PluginConn.PluginKeyFile} {
+			os.Chown(filepath.Join(certDir, file), int(pluginReg.sandbox.Uid), int(pluginReg.sandbox.Gid))
+		}
+	}
+	return nil
+}
+
+// Internal: get the listen address of an instance. A zero port on a loopback address is replaced
+// with a free port, the other instances of a pool require it
+func listenAddr(listen string, instance int) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", fmt.Errorf("Invalid plugin listen address %q: %v", listen, err)
+	}
+	if port != "0" {
+		if instance > 0 {
+			return "", fmt.Errorf("A pool of tcp plugin instances requires a zero port in the listen address")
+		}
+		return listen, nil
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("A zero port is supported on a loopback address only: %s", listen)
+	}
+	// The port is free when probed, the plugin binds it right after
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return "", fmt.Errorf("Failed to find a free port on %s: %v", host, err)
+	}
+	defer listener.Close()
+	return listener.Addr().String(), nil
+}